@@ -35,4 +35,17 @@ func printConfig(cfg *config.Config, log *util.Logger) {
 	log.Debug("MaxSize:   %d", cfg.MaxSize)
 	log.Debug("Verify:    %t", cfg.Verify)
 	log.Debug("Verbose:   %t", cfg.Verbose)
+	log.Debug("TLS:       %t", cfg.TLS)
+	log.Debug("Secret:    %t", cfg.Secret != "")
+	log.Debug("Pair:      %t", cfg.Pair)
+	log.Debug("Discover:  %t", cfg.Discover)
+	log.Debug("Announce:  %t", cfg.Announce)
+	log.Debug("Ranges:    %d", cfg.Ranges)
+	log.Debug("Compress:  %t", cfg.Compress)
+	log.Debug("Dedup:     %t", cfg.Dedup)
+	log.Debug("LimitRate: %s up, %s down", util.FormatRate(cfg.LimitRate), util.FormatRate(cfg.LimitRateIn))
+	log.Debug("Concurrent: %d", cfg.Concurrent)
+	log.Debug("Overwrite: %s", cfg.Overwrite)
+	log.Debug("Xattrs:    %t", cfg.Xattrs)
+	log.Debug("Watch:     %t", cfg.Watch)
 }
@@ -3,23 +3,39 @@ package config
 import (
 	"flag"
 	"fmt"
+	"local-file-sharer/internal/util"
 	"os"
 )
 
 type Config struct {
-	TargetAddr string
-	ListenAddr string
-	Folder     string
-	Name       string
-	ReadOnly   bool
-	WriteOnly  bool
-	MaxSize    int
-	Verify     bool
-	Verbose    bool
+	TargetAddr  string
+	ListenAddr  string
+	Folder      string
+	Name        string
+	ReadOnly    bool
+	WriteOnly   bool
+	MaxSize     int
+	Verify      bool
+	Verbose     bool
+	TLS         bool
+	Secret      string
+	Pair        bool
+	Discover    bool
+	Announce    bool
+	Ranges      int
+	Compress    bool
+	Dedup       bool
+	LimitRate   int64
+	LimitRateIn int64
+	Concurrent  int
+	Overwrite   string
+	Xattrs      bool
+	Watch       bool
+	AllowDelete bool
 }
 
 func Load() *Config {
-	cfg := &Config{}
+	cfg := &Config{Overwrite: util.OverwriteRename}
 
 	var targetIP string
 	var targetPort int
@@ -34,6 +50,34 @@ func Load() *Config {
 	flag.IntVar(&cfg.MaxSize, "maxsize", 0, "Maximum file size in MB allowed for transfer (0 = unlimited)")
 	flag.BoolVar(&cfg.Verify, "verify", true, "Enables checksum verification to ensure file integrity")
 	flag.BoolVar(&cfg.Verbose, "verbose", false, "Enables detailed logging for debugging")
+	flag.BoolVar(&cfg.TLS, "tls", true, "Encrypts connections with TLS and pins peer certificates on first use")
+	flag.StringVar(&cfg.Secret, "secret", "", "Shared secret or pairing code required to authenticate peers")
+	flag.BoolVar(&cfg.Pair, "pair", false, "Shows a one-time pairing code that connecting peers must supply with --secret")
+	flag.BoolVar(&cfg.Discover, "discover", false, "Lists peers announced on the local network and opens the prompt without waiting for a connection")
+	flag.BoolVar(&cfg.Announce, "announce", true, "Announces this node on the local network so peers can find it with DISCOVER")
+	flag.IntVar(&cfg.Ranges, "ranges", 4, "Number of ranges of a large file that are read, hashed and sent in parallel over the one connection (1 = sequential)")
+	flag.IntVar(&cfg.Ranges, "streams", 4, "Deprecated alias for --ranges")
+	flag.BoolVar(&cfg.Compress, "compress", true, "Compresses file data with gzip when the peer supports it and the data shrinks")
+	flag.BoolVar(&cfg.Dedup, "dedup", true, "Sends only the content-defined chunks of a file that the peer cannot find anywhere in its share")
+	flag.BoolVar(&cfg.Xattrs, "xattrs", false, "Sends and restores user extended attributes of files (Linux only)")
+	flag.BoolVar(&cfg.Watch, "watch", false, "Watches the shared folder and pushes created or modified files to every connected peer")
+	flag.BoolVar(&cfg.AllowDelete, "allow-delete", false, "Lets peers delete files here with SYNC --delete (previous versions are kept in .p2p/backups)")
+	flag.IntVar(&cfg.Concurrent, "concurrent", 3, "Number of queued transfers that run at the same time")
+	flag.Func("limit-rate", "Caps the total upload rate, e.g. 500K or 2M bytes per second (0 = unlimited)", func(s string) error {
+		rate, err := util.ParseRate(s)
+		cfg.LimitRate = rate
+		return err
+	})
+	flag.Func("limit-rate-in", "Caps the total download rate, e.g. 500K or 2M bytes per second (0 = unlimited)", func(s string) error {
+		rate, err := util.ParseRate(s)
+		cfg.LimitRateIn = rate
+		return err
+	})
+	flag.Func("overwrite", "What to do when an incoming file already exists: rename, overwrite, skip, newer, ask or backup (default rename)", func(s string) error {
+		policy, err := util.ParseOverwritePolicy(s)
+		cfg.Overwrite = policy
+		return err
+	})
 
 	flag.Parse()
 
@@ -1,48 +1,175 @@
 package network
 
 import (
+	"crypto/tls"
+	"fmt"
 	"local-file-sharer/internal/config"
 	"local-file-sharer/internal/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type App struct {
 	Config        *config.Config
 	Log           *util.Logger
 	Connections   map[string]*Connection
-	Transfers     map[string]*FileTransfer
+	Transfers     map[int]*FileTransfer
 	CommandParser *CommandParser
 	mu            sync.Mutex
 	Ready         bool
+	Root          string
+	StateDir      string
+	NodeID        string
+	Certificate   tls.Certificate
+	Fingerprint   string
+	KnownPeers    *KnownPeers
+	Pairing       *Pairing
+	Discovery     *Discovery
+	interfaceOnce sync.Once
+	sessions      map[string]*detachedSession
+	wireTransfers map[transferKey]*FileTransfer
 	transferID    int
+	peerID        int
+	sendLimiter   *rateLimiter
+	recvLimiter   *rateLimiter
+	Queue         *TransferQueue
+	Chunks        *ChunkStore
+	promptMu      sync.Mutex
+	prompt        *pendingPrompt
+	hashMu        sync.Mutex
+	hashes        map[string]cachedHash
+	syncMu        sync.Mutex
+	watchMu       sync.Mutex
+	watches       []*dirWatch
+	received      map[string]receivedFile
 }
 
 func NewApp(cfg *config.Config, log *util.Logger) *App {
+	absFolder, err := filepath.Abs(cfg.Folder)
+	if err != nil {
+		absFolder = cfg.Folder
+	}
+
 	app := &App{
-		Config:      cfg,
-		Log:         log,
-		Connections: make(map[string]*Connection),
-		Transfers:   make(map[string]*FileTransfer),
-		Ready:       true,
+		Config:        cfg,
+		Log:           log,
+		Connections:   make(map[string]*Connection),
+		Transfers:     make(map[int]*FileTransfer),
+		sessions:      make(map[string]*detachedSession),
+		wireTransfers: make(map[transferKey]*FileTransfer),
+		hashes:        make(map[string]cachedHash),
+		received:      make(map[string]receivedFile),
+		Ready:         true,
+		Root:          absFolder,
+		StateDir:      filepath.Join(absFolder, util.StateDirName),
+		sendLimiter:   newRateLimiter(cfg.LimitRate),
+		recvLimiter:   newRateLimiter(cfg.LimitRateIn),
+	}
+
+	nodeID, err := loadOrCreateNodeID(app.StateDir)
+	if err != nil {
+		log.Warn("Failed to persist node ID, using a temporary one: %v", err)
+	}
+	app.NodeID = nodeID
+
+	if cfg.TLS {
+		app.loadTLSIdentity()
+	}
+
+	if cfg.Pair {
+		app.Pairing = NewPairing()
+	}
+
+	queue, err := LoadTransferQueue(app)
+	if err != nil {
+		log.Warn("Failed to load transfer queue: %v", err)
+	}
+	app.Queue = queue
+	app.sweepPartFiles()
+	go app.Queue.Run()
+
+	app.Chunks = NewChunkStore(app)
+	if cfg.Dedup {
+		go app.Chunks.Run()
+	}
+
+	if cfg.Watch {
+		if _, err := app.StartWatch(".", nil, ""); err != nil {
+			log.Warn("Failed to watch %s: %v", cfg.Folder, err)
+		} else {
+			log.Info("Watching %s and pushing changes to connected peers", cfg.Folder)
+		}
 	}
+
 	app.CommandParser = NewCommandParser(app)
 	return app
 }
 
+func (a *App) loadTLSIdentity() {
+	cert, err := loadOrCreateCertificate(a.StateDir, a.Config.Name)
+	if err != nil {
+		if len(cert.Certificate) == 0 {
+			a.Log.Fatal("Failed to create node certificate: %v", err)
+			os.Exit(1)
+		}
+		a.Log.Warn("Failed to persist node certificate, using a temporary one: %v", err)
+	}
+
+	a.Certificate = cert
+	a.Fingerprint = CertificateFingerprint(cert.Certificate[0])
+
+	knownPeers, err := LoadKnownPeers(filepath.Join(a.StateDir, "known_peers"))
+	if err != nil {
+		a.Log.Warn("Failed to read known peers: %v", err)
+	}
+	a.KnownPeers = knownPeers
+}
+
+func (a *App) StartDiscovery() {
+	discovery := NewDiscovery(a)
+	if err := discovery.Listen(); err != nil {
+		a.Log.Warn("Peer discovery unavailable: %v", err)
+		return
+	}
+	a.Discovery = discovery
+}
+
+func (a *App) TLSConfig(isClient bool) *tls.Config {
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{a.Certificate},
+		MinVersion:   tls.VersionTLS13,
+	}
+
+	if isClient {
+		cfg.InsecureSkipVerify = true
+	} else {
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	}
+
+	return cfg
+}
+
 func (a *App) Shutdown() {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	a.Ready = false
+
 	for _, conn := range a.Connections {
-		conn.Conn.Close()
+		conn.Disconnect()
 	}
-
-	a.Ready = false
 }
 
 func (a *App) AddConnection(conn *Connection) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	a.peerID++
+	conn.PeerID = a.peerID
 	a.Connections[conn.ID] = conn
 }
 
@@ -52,18 +179,101 @@ func (a *App) RemoveConnection(conn *Connection) {
 	delete(a.Connections, conn.ID)
 }
 
-func (a *App) AddTransfer(transfer *FileTransfer) {
+type transferKey struct {
+	conn   *Connection
+	typ    string
+	wireID uint32
+}
+
+func (t *FileTransfer) key() transferKey {
+	return transferKey{conn: t.Conn, typ: t.Type, wireID: t.WireID}
+}
+
+func (a *App) AddTransfer(transfer *FileTransfer) error {
+	if err := a.addTransfer(transfer); err != nil {
+		return err
+	}
+
+	a.Queue.transferAdded(transfer)
+	return nil
+}
+
+func (a *App) addTransfer(transfer *FileTransfer) error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+
 	a.transferID++
 	transfer.ID = a.transferID
-	a.Transfers[transfer.Name] = transfer
+	if transfer.Type == TransferTypeSend {
+		transfer.WireID = uint32(transfer.ID)
+	}
+
+	if _, exists := a.wireTransfers[transfer.key()]; exists {
+		return fmt.Errorf("transfer %d is already in progress", transfer.WireID)
+	}
+
+	a.Transfers[transfer.ID] = transfer
+	a.wireTransfers[transfer.key()] = transfer
+	return nil
 }
 
 func (a *App) RemoveTransfer(transfer *FileTransfer) {
+	a.mu.Lock()
+	a.removeTransferLocked(transfer)
+	a.mu.Unlock()
+
+	a.Queue.transferRemoved(transfer)
+}
+
+func (a *App) removeTransferLocked(transfer *FileTransfer) {
+	delete(a.Transfers, transfer.ID)
+	if a.wireTransfers[transfer.key()] == transfer {
+		delete(a.wireTransfers, transfer.key())
+	}
+}
+
+func (a *App) FindTransfer(conn *Connection, transferType string, wireID uint32) *FileTransfer {
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	delete(a.Transfers, transfer.Name)
+	return a.wireTransfers[transferKey{conn: conn, typ: transferType, wireID: wireID}]
+}
+
+func (a *App) GetTransfer(id int) *FileTransfer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.Transfers[id]
+}
+
+func (a *App) AbortTransfers(conn *Connection) []*FileTransfer {
+	aborted := a.abortTransfers(conn)
+	for _, t := range aborted {
+		a.Queue.transferInterrupted(t)
+	}
+	return aborted
+}
+
+func (a *App) abortTransfers(conn *Connection) []*FileTransfer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var aborted []*FileTransfer
+	for _, t := range a.Transfers {
+		if t.Conn != conn {
+			continue
+		}
+
+		t.Status = TransferStatusFailed
+		t.CloseFile()
+
+		aborted = append(aborted, t)
+		a.removeTransferLocked(t)
+	}
+
+	sort.Slice(aborted, func(i, j int) bool {
+		return aborted[i].ID < aborted[j].ID
+	})
+
+	return aborted
 }
 
 func (a *App) GetCurrentTransfers() []*FileTransfer {
@@ -116,11 +326,95 @@ func (a *App) GetActiveConnections() []*Connection {
 		conns = append(conns, conn)
 	}
 
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].PeerID < conns[j].PeerID
+	})
+
 	return conns
 }
 
+func (a *App) FindConnection(ref string) (*Connection, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("no peer specified")
+	}
+
+	conns := a.GetActiveConnections()
+
+	if id, err := strconv.Atoi(ref); err == nil {
+		for _, conn := range conns {
+			if conn.PeerID == id {
+				return conn, nil
+			}
+		}
+		return nil, fmt.Errorf("no peer with ID %d, use PEERS to list connected peers", id)
+	}
+
+	var matches []*Connection
+	for _, conn := range conns {
+		if strings.EqualFold(conn.RemoteName, ref) || conn.ID == ref {
+			matches = append(matches, conn)
+		}
+	}
+
+	if len(matches) == 0 {
+		for _, conn := range conns {
+			if conn.RemoteNodeID != "" && strings.HasPrefix(conn.RemoteNodeID, strings.ToLower(ref)) {
+				matches = append(matches, conn)
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("unknown peer: %s, use PEERS to list connected peers", ref)
+	case 1:
+		return matches[0], nil
+	}
+
+	return nil, fmt.Errorf("peer %s is ambiguous, use its numeric ID from PEERS", ref)
+}
+
 func (a *App) HasConnections() bool {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	return len(a.Connections) > 0
 }
+
+func (a *App) BackupFile(path string) (string, error) {
+	rel := filepath.Base(path)
+	if absPath, err := filepath.Abs(path); err == nil {
+		if r, err := filepath.Rel(a.Root, absPath); err == nil && !strings.HasPrefix(r, "..") {
+			rel = r
+		}
+	}
+
+	target := filepath.Join(a.StateDir, "backups", fmt.Sprintf("%s.%s", rel, time.Now().Format("20060102-150405.000")))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(path, target); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
+func (a *App) QuarantineFile(path string) (string, error) {
+	quarantineDir := filepath.Join(a.StateDir, "quarantine")
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(path)
+	if isPartFile(path) {
+		name = filepath.Base(finalFilePath(path))
+	}
+
+	target := filepath.Join(quarantineDir, fmt.Sprintf("%s.%d", name, time.Now().Unix()))
+	if err := os.Rename(path, target); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
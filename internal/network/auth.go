@@ -0,0 +1,363 @@
+package network
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+const (
+	authLabel          = "p2p-file-sharer-auth-v2"
+	pairingCodeChars   = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	maxPairingFailures = 3
+	maxAuthSecrets     = 2
+)
+
+var (
+	spakeCurve       = elliptic.P256()
+	spakeMx, spakeMy = spakePoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	spakeNx, spakeNy = spakePoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+type spakeParty struct {
+	role   string
+	w      *big.Int
+	scalar *big.Int
+	share  []byte
+}
+
+type Pairing struct {
+	code     string
+	failures int
+	mu       sync.Mutex
+}
+
+func NewPairing() *Pairing {
+	p := &Pairing{}
+	p.rotate()
+	return p
+}
+
+func (p *Pairing) Code() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.code
+}
+
+func (p *Pairing) rotate() {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+
+	code := make([]byte, 0, 9)
+	for i, b := range buf {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, pairingCodeChars[int(b)%len(pairingCodeChars)])
+	}
+
+	p.code = string(code)
+	p.failures = 0
+}
+
+func (p *Pairing) Consume() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rotate()
+	return p.code
+}
+
+func (p *Pairing) Fail() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failures++
+	if p.failures >= maxPairingFailures {
+		p.rotate()
+		return p.code, true
+	}
+	return p.code, false
+}
+
+func normalizeSecret(secret string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), "-", ""))
+}
+
+func spakePoint(encoded string) (*big.Int, *big.Int) {
+	data, _ := hex.DecodeString(encoded)
+	x, y := elliptic.UnmarshalCompressed(spakeCurve, data)
+	if x == nil {
+		panic("invalid SPAKE2 point " + encoded)
+	}
+	return x, y
+}
+
+func spakeScalar(secret string) *big.Int {
+	sum := sha256.Sum256([]byte(authLabel + "|" + normalizeSecret(secret)))
+	return new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), spakeCurve.Params().N)
+}
+
+func (p *spakeParty) blinding(role string) (*big.Int, *big.Int) {
+	x, y := spakeMx, spakeMy
+	if role == "server" {
+		x, y = spakeNx, spakeNy
+	}
+	return spakeCurve.ScalarMult(x, y, p.w.Bytes())
+}
+
+func newSpakeParty(secret, role string) (*spakeParty, error) {
+	n := spakeCurve.Params().N
+	scalar, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	scalar.Add(scalar, big.NewInt(1))
+
+	p := &spakeParty{role: role, w: spakeScalar(secret), scalar: scalar}
+
+	px, py := spakeCurve.ScalarBaseMult(scalar.Bytes())
+	bx, by := p.blinding(role)
+	sx, sy := spakeCurve.Add(px, py, bx, by)
+	p.share = elliptic.Marshal(spakeCurve, sx, sy)
+	return p, nil
+}
+
+func (p *spakeParty) Share() string {
+	return hex.EncodeToString(p.share)
+}
+
+func (p *spakeParty) Proofs(peerShare string, binding []byte) (string, string, error) {
+	peer, err := hex.DecodeString(peerShare)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid key share")
+	}
+
+	px, py := elliptic.Unmarshal(spakeCurve, peer)
+	if px == nil {
+		return "", "", fmt.Errorf("invalid key share")
+	}
+
+	peerRole := "server"
+	clientShare, serverShare := p.share, peer
+	if p.role == "server" {
+		peerRole = "client"
+		clientShare, serverShare = peer, p.share
+	}
+
+	bx, by := p.blinding(peerRole)
+	by.Sub(spakeCurve.Params().P, by)
+	zx, zy := spakeCurve.Add(px, py, bx, by)
+	if zx.Sign() == 0 && zy.Sign() == 0 {
+		return "", "", fmt.Errorf("invalid key share")
+	}
+	kx, ky := spakeCurve.ScalarMult(zx, zy, p.scalar.Bytes())
+
+	transcript := sha256.New()
+	fmt.Fprintf(transcript, "%s|", authLabel)
+	for _, part := range [][]byte{binding, clientShare, serverShare, elliptic.Marshal(spakeCurve, kx, ky), p.w.Bytes()} {
+		binary.Write(transcript, binary.BigEndian, uint32(len(part)))
+		transcript.Write(part)
+	}
+	key := transcript.Sum(nil)
+
+	return authProof(key, "client"), authProof(key, "server"), nil
+}
+
+func authProof(key []byte, role string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Connection) channelBinding() []byte {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	binding, err := state.ExportKeyingMaterial(authLabel, nil, 32)
+	if err != nil {
+		return nil
+	}
+	return binding
+}
+
+func (c *Connection) authSecrets() []string {
+	var secrets []string
+	if c.App.Config.Secret != "" {
+		secrets = append(secrets, c.App.Config.Secret)
+	}
+	if !c.isClient && c.App.Pairing != nil {
+		secrets = append(secrets, c.App.Pairing.Code())
+	}
+	return secrets
+}
+
+func (c *Connection) readAuthMessage(step string) (string, error) {
+	msg, err := c.readMessage()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", step, err)
+	}
+
+	if msg == nil {
+		return "", fmt.Errorf("invalid %s message", step)
+	}
+
+	if msg.Type == MsgTypeError {
+		return "", fmt.Errorf("rejected by peer: %s", msg.Data)
+	}
+
+	parts := strings.SplitN(msg.Data, "|", 2)
+	if msg.Type != MsgTypeAuth || len(parts) != 2 || parts[0] != step {
+		return "", fmt.Errorf("expected %s, got %s", step, msg.Type)
+	}
+
+	return parts[1], nil
+}
+
+func (c *Connection) rejectAuth(reason string) error {
+	c.SendMessage(Message{
+		Type: MsgTypeError,
+		Data: reason,
+	})
+	return fmt.Errorf("%s", reason)
+}
+
+func (c *Connection) authenticate(remoteRequiresAuth bool) error {
+	secrets := c.authSecrets()
+	localRequiresAuth := len(secrets) > 0
+
+	if !localRequiresAuth && !remoteRequiresAuth {
+		c.authenticated = true
+		return nil
+	}
+
+	if !localRequiresAuth {
+		return c.rejectAuth("peer requires authentication, restart with --secret")
+	}
+
+	if !remoteRequiresAuth {
+		return c.rejectAuth("authentication required: peer has no shared secret configured")
+	}
+
+	if c.ProtocolVersion < AuthProtocolVersion {
+		return c.rejectAuth(fmt.Sprintf("authentication failed: peer speaks protocol %d, authentication needs protocol %d or newer",
+			c.ProtocolVersion, AuthProtocolVersion))
+	}
+
+	binding := c.channelBinding()
+
+	if c.isClient {
+		party, err := newSpakeParty(secrets[0], "client")
+		if err != nil {
+			return err
+		}
+
+		if err := c.SendMessage(Message{Type: MsgTypeAuth, Data: "SHARE|" + party.Share()}); err != nil {
+			return fmt.Errorf("failed to send key share: %v", err)
+		}
+
+		shares, err := c.readAuthMessage("SHARE")
+		if err != nil {
+			return err
+		}
+
+		remoteProofs, err := c.readAuthMessage("PROOF")
+		if err != nil {
+			return err
+		}
+
+		serverShares := strings.Split(shares, ",")
+		serverProofs := strings.Split(remoteProofs, ",")
+		if len(serverShares) != len(serverProofs) || len(serverShares) > maxAuthSecrets {
+			return c.rejectAuth("authentication failed: invalid key shares")
+		}
+
+		for i, share := range serverShares {
+			proof, expected, err := party.Proofs(share, binding)
+			if err != nil || !hmac.Equal([]byte(serverProofs[i]), []byte(expected)) {
+				continue
+			}
+
+			if err := c.SendMessage(Message{Type: MsgTypeAuth, Data: "PROOF|" + proof}); err != nil {
+				return fmt.Errorf("failed to send proof: %v", err)
+			}
+
+			c.authenticated = true
+			return nil
+		}
+
+		return c.rejectAuth("authentication failed: the peer could not prove it knows this secret (wrong secret or pairing code?)")
+	}
+
+	share, err := c.readAuthMessage("SHARE")
+	if err != nil {
+		return err
+	}
+
+	var shares, proofs, expected []string
+	for _, secret := range secrets {
+		party, err := newSpakeParty(secret, "server")
+		if err != nil {
+			return err
+		}
+
+		clientProof, serverProof, err := party.Proofs(share, binding)
+		if err != nil {
+			return c.rejectAuth(fmt.Sprintf("authentication failed: %v", err))
+		}
+
+		shares = append(shares, party.Share())
+		proofs = append(proofs, serverProof)
+		expected = append(expected, clientProof)
+	}
+
+	if err := c.SendMessage(Message{Type: MsgTypeAuth, Data: "SHARE|" + strings.Join(shares, ",")}); err != nil {
+		return fmt.Errorf("failed to send key share: %v", err)
+	}
+	if err := c.SendMessage(Message{Type: MsgTypeAuth, Data: "PROOF|" + strings.Join(proofs, ",")}); err != nil {
+		return fmt.Errorf("failed to send proof: %v", err)
+	}
+
+	remoteProof, err := c.readAuthMessage("PROOF")
+	if err != nil {
+		c.failPairing()
+		return err
+	}
+
+	for i := range secrets {
+		if !hmac.Equal([]byte(remoteProof), []byte(expected[i])) {
+			continue
+		}
+
+		if c.App.Config.Secret == "" || i > 0 {
+			next := c.App.Pairing.Consume()
+			c.App.Log.Info("Pairing code used by %s, new pairing code: %s", c.RemoteName, next)
+		}
+
+		c.authenticated = true
+		return nil
+	}
+
+	c.failPairing()
+	return c.rejectAuth("authentication failed: wrong secret or pairing code")
+}
+
+func (c *Connection) failPairing() {
+	if c.App.Pairing == nil {
+		return
+	}
+
+	if next, rotated := c.App.Pairing.Fail(); rotated {
+		c.App.Log.Warn("Too many failed pairing attempts, new pairing code: %s", next)
+	}
+}
@@ -0,0 +1,199 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"local-file-sharer/internal/config"
+	"strings"
+	"testing"
+)
+
+func TestSpakeProofs(t *testing.T) {
+	binding := []byte("tls session")
+
+	tests := []struct {
+		name         string
+		clientSecret string
+		serverSecret string
+		binding      []byte
+		wantMatch    bool
+	}{
+		{name: "same secret", clientSecret: "hunter2", serverSecret: "hunter2", binding: binding, wantMatch: true},
+		{name: "pairing code spelling", clientSecret: "abcd-efgh", serverSecret: "ABCDEFGH", binding: binding, wantMatch: true},
+		{name: "different secret", clientSecret: "hunter2", serverSecret: "hunter3", binding: binding},
+		{name: "different TLS session", clientSecret: "hunter2", serverSecret: "hunter2", binding: []byte("other session")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newSpakeParty(tt.clientSecret, "client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := newSpakeParty(tt.serverSecret, "server")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientProof, serverProof, err := client.Proofs(server.Share(), binding)
+			if err != nil {
+				t.Fatalf("client: %v", err)
+			}
+			expectedClient, expectedServer, err := server.Proofs(client.Share(), tt.binding)
+			if err != nil {
+				t.Fatalf("server: %v", err)
+			}
+
+			if (clientProof == expectedClient) != tt.wantMatch || (serverProof == expectedServer) != tt.wantMatch {
+				t.Errorf("proofs match = %v/%v, want %v", clientProof == expectedClient, serverProof == expectedServer, tt.wantMatch)
+			}
+			if clientProof == serverProof {
+				t.Errorf("client and server proofs are identical")
+			}
+		})
+	}
+
+	party, _ := newSpakeParty("hunter2", "client")
+	other, _ := newSpakeParty("hunter2", "client")
+	if party.Share() == other.Share() {
+		t.Errorf("two key shares for the same secret are identical")
+	}
+
+	for _, share := range []string{"", "zz", "04" + strings.Repeat("00", 64), party.Share()[:20]} {
+		if _, _, err := party.Proofs(share, binding); err == nil {
+			t.Errorf("Proofs accepted the invalid key share %q", share)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientSecret string
+		serverSecret string
+		pair         bool
+		usePairing   bool
+		wantOK       bool
+	}{
+		{name: "no secrets", wantOK: true},
+		{name: "shared secret", clientSecret: "correct horse", serverSecret: "correct horse", wantOK: true},
+		{name: "wrong secret", clientSecret: "wrong horse", serverSecret: "correct horse"},
+		{name: "client without secret", serverSecret: "correct horse"},
+		{name: "server without secret", clientSecret: "correct horse"},
+		{name: "pairing code", pair: true, usePairing: true, wantOK: true},
+		{name: "pairing code next to a secret", serverSecret: "correct horse", pair: true, usePairing: true, wantOK: true},
+		{name: "wrong pairing code", clientSecret: "AAAA-AAAA", pair: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverApp := newTestApp(t, "srv", func(cfg *config.Config) {
+				cfg.Secret = tt.serverSecret
+				cfg.Pair = tt.pair
+			})
+
+			clientSecret := tt.clientSecret
+			var code string
+			if tt.usePairing {
+				code = serverApp.Pairing.Code()
+				clientSecret = strings.ToLower(code)
+			}
+			clientApp := newTestApp(t, "cli", func(cfg *config.Config) { cfg.Secret = clientSecret })
+
+			client, server, clientErr, serverErr := connectApps(t, clientApp, serverApp)
+			if tt.wantOK {
+				if clientErr != nil || serverErr != nil {
+					t.Fatalf("authentication failed: client %v, server %v", clientErr, serverErr)
+				}
+				if !client.authenticated || !server.authenticated {
+					t.Errorf("authenticated = %v/%v", client.authenticated, server.authenticated)
+				}
+			} else {
+				if clientErr == nil || serverErr == nil {
+					t.Fatalf("authentication succeeded: client %v, server %v", clientErr, serverErr)
+				}
+				if client.authenticated || server.authenticated {
+					t.Errorf("authenticated = %v/%v after a failure", client.authenticated, server.authenticated)
+				}
+			}
+
+			if tt.usePairing && serverApp.Pairing.Code() == code {
+				t.Errorf("pairing code was not rotated after use")
+			}
+		})
+	}
+}
+
+func TestAuthenticateServerProvesFirst(t *testing.T) {
+	clientApp := newTestApp(t, "cli", func(cfg *config.Config) {
+		cfg.TLS = false
+		cfg.Secret = "ABCD-EFGH"
+	})
+
+	clientConn, peerConn := dialPair(t)
+	client := NewConnection(clientConn, clientApp, true)
+
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- client.Handshake()
+	}()
+
+	send := func(msg Message) {
+		data, _ := json.Marshal(msg)
+		if _, err := peerConn.Write(append(data, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := bufio.NewReader(peerConn)
+	read := func() Message {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	hello, _ := json.Marshal(Hello{ProtocolVersion: ProtocolVersion, MinProtocolVersion: MinProtocolVersion, NodeID: "rogue", Name: "rogue", Auth: true})
+	send(Message{Type: MsgTypeHandshake, Data: string(hello)})
+	if msg := read(); msg.Type != MsgTypeHandshake {
+		t.Fatalf("expected the client's handshake, got %s", msg.Type)
+	}
+
+	msg := read()
+	share, ok := strings.CutPrefix(msg.Data, "SHARE|")
+	if msg.Type != MsgTypeAuth || !ok {
+		t.Fatalf("expected the client's key share, got %+v", msg)
+	}
+
+	guess, _ := newSpakeParty("AAAA-AAAA", "server")
+	_, proof, err := guess.Proofs(share, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(Message{Type: MsgTypeAuth, Data: "SHARE|" + guess.Share()})
+	send(Message{Type: MsgTypeAuth, Data: "PROOF|" + proof})
+
+	if msg := read(); msg.Type != MsgTypeError {
+		t.Errorf("client answered a server with the wrong secret with %+v, want an error", msg)
+	}
+	if err := <-clientErr; err == nil || client.authenticated {
+		t.Errorf("client authenticated a server with the wrong secret")
+	}
+}
+
+func TestAuthenticateRejectsOldPeers(t *testing.T) {
+	for _, isClient := range []bool{true, false} {
+		app := newTestApp(t, "node", func(cfg *config.Config) { cfg.Secret = "hunter2" })
+		a, _ := dialPair(t)
+
+		conn := NewConnection(a, app, isClient)
+		conn.ProtocolVersion = AuthProtocolVersion - 1
+		if err := conn.authenticate(true); err == nil || conn.authenticated {
+			t.Errorf("isClient=%v: authenticated a protocol %d peer", isClient, conn.ProtocolVersion)
+		}
+	}
+}
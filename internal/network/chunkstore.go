@@ -0,0 +1,665 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"local-file-sharer/internal/util"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dedupMode          = "dedup"
+	dedupMinFileSize   = chunkMinSize
+	dedupMaxFileSize   = 8 * 1024 * 1024 * 1024
+	dedupRangeSize     = 16 * rangeChunkSize
+	dedupAnswerTimeout = 5 * time.Minute
+	chunkMinSize       = 16 * 1024
+	chunkMaxSize       = 256 * 1024
+	chunkMaskBits      = 16
+	chunkHashSize      = 16
+	chunkEntrySize     = 4 + chunkHashSize
+	chunkIndexFileName = "chunks.json"
+	chunkIndexInterval = 10 * time.Minute
+)
+
+type chunkHash [chunkHashSize]byte
+
+type fileChunk struct {
+	Offset int64
+	Length int64
+	Hash   chunkHash
+}
+
+type chunkLocation struct {
+	Path   string
+	Offset int64
+}
+
+type indexedFile struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Chunks  string `json:"chunks"`
+
+	chunks []fileChunk
+}
+
+type chunkIndex struct {
+	Files map[string]*indexedFile `json:"files"`
+}
+
+type ChunkStore struct {
+	app    *App
+	path   string
+	mu     sync.Mutex
+	files  map[string]*indexedFile
+	chunks map[chunkHash]chunkLocation
+	dirty  bool
+}
+
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x5f3759df)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+func chunkBoundary(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+
+	const mask = uint64(1<<chunkMaskBits-1) << (64 - chunkMaskBits)
+	end := min(len(data), chunkMaxSize)
+
+	var h uint64
+	for i := chunkMinSize; i < end; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+func splitChunks(r io.Reader) ([]fileChunk, error) {
+	buf := make([]byte, deltaReadBuffer)
+	var chunks []fileChunk
+	var offset int64
+	var start, end int
+	eof := false
+
+	for {
+		if end-start < chunkMaxSize && !eof {
+			end = copy(buf, buf[start:end])
+			start = 0
+
+			for end < len(buf) && !eof {
+				n, err := r.Read(buf[end:])
+				end += n
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if start == end {
+			return chunks, nil
+		}
+
+		n := chunkBoundary(buf[start:end])
+		chunk := fileChunk{Offset: offset, Length: int64(n)}
+		sum := sha256.Sum256(buf[start : start+n])
+		copy(chunk.Hash[:], sum[:])
+
+		chunks = append(chunks, chunk)
+		offset += int64(n)
+		start += n
+	}
+}
+
+func chunkFile(path string) ([]fileChunk, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return splitChunks(file)
+}
+
+func encodeChunks(chunks []fileChunk) string {
+	packed := make([]byte, 0, len(chunks)*chunkEntrySize)
+	for _, chunk := range chunks {
+		packed = binary.BigEndian.AppendUint32(packed, uint32(chunk.Length))
+		packed = append(packed, chunk.Hash[:]...)
+	}
+	return base64.StdEncoding.EncodeToString(packed)
+}
+
+func parseChunks(s string, size int64) ([]fileChunk, error) {
+	packed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(packed)%chunkEntrySize != 0 {
+		return nil, fmt.Errorf("invalid chunk list")
+	}
+
+	chunks := make([]fileChunk, 0, len(packed)/chunkEntrySize)
+	var offset int64
+	for len(packed) > 0 {
+		length := int64(binary.BigEndian.Uint32(packed))
+		if length <= 0 || length > chunkMaxSize {
+			return nil, fmt.Errorf("invalid chunk length %d at offset %d", length, offset)
+		}
+
+		chunk := fileChunk{Offset: offset, Length: length}
+		copy(chunk.Hash[:], packed[4:chunkEntrySize])
+		chunks = append(chunks, chunk)
+		offset += length
+		packed = packed[chunkEntrySize:]
+	}
+
+	if offset != size {
+		return nil, fmt.Errorf("chunks cover %d of %d bytes", offset, size)
+	}
+	return chunks, nil
+}
+
+func encodeIndexes(indexes []int) string {
+	var parts []string
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+
+		if i == j {
+			parts = append(parts, strconv.Itoa(indexes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indexes[i], indexes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseIndexes(s string, count int) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var indexes []int
+	next := 0
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk index %q", part)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil || from < next || to < from || to >= count {
+			return nil, fmt.Errorf("invalid chunk index %q", part)
+		}
+
+		for i := from; i <= to; i++ {
+			indexes = append(indexes, i)
+		}
+		next = to + 1
+	}
+	return indexes, nil
+}
+
+func chunkRanges(chunks []fileChunk, need []int) []*fileRange {
+	var ranges []*fileRange
+	for _, i := range need {
+		chunk := chunks[i]
+		if n := len(ranges); n > 0 && ranges[n-1].End == chunk.Offset && ranges[n-1].Len()+chunk.Length <= dedupRangeSize {
+			ranges[n-1].End += chunk.Length
+			continue
+		}
+		ranges = append(ranges, &fileRange{Start: chunk.Offset, End: chunk.Offset + chunk.Length, Hash: sha256.New()})
+	}
+	return ranges
+}
+
+func allRanges(size int64) []*fileRange {
+	return splitRanges(size, int((size+dedupRangeSize-1)/dedupRangeSize))
+}
+
+func rangesLen(ranges []*fileRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.Len()
+	}
+	return total
+}
+
+func (c *Connection) wantsDedup(size int64) bool {
+	return c.App.Config.Dedup && c.HasCapability(CapDedup) && size >= dedupMinFileSize && size <= dedupMaxFileSize
+}
+
+func (c *Connection) sendChunkList(transfer *FileTransfer, ackID string, needChan chan string) error {
+	reader := io.TeeReader(io.NewSectionReader(transfer.File, 0, math.MaxInt64), transfer.Hash)
+	chunks, err := splitChunks(reader)
+	if err != nil {
+		return fmt.Errorf("failed to split into chunks: %v", err)
+	}
+
+	var size int64
+	if n := len(chunks); n > 0 {
+		size = chunks[n-1].Offset + chunks[n-1].Length
+	}
+	if size != transfer.TotalSize {
+		return fmt.Errorf("file changed while sending")
+	}
+
+	data := encodeChunks(chunks)
+	if len(data) > maxMessageData {
+		c.Log.Info("Chunk list of %s is too large to advertise, sending it in full", transfer.Name)
+		transfer.Ranges = allRanges(transfer.TotalSize)
+		return c.SendReliableMessage(Message{
+			Type:       MsgTypeChunks,
+			ID:         ackID,
+			TransferID: transfer.WireID,
+		})
+	}
+
+	c.Log.Debug("Advertising %d chunks of %s", len(chunks), transfer.Name)
+	err = c.SendReliableMessage(Message{
+		Type:       MsgTypeChunks,
+		Data:       data,
+		ID:         ackID,
+		TransferID: transfer.WireID,
+	})
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.Now().Add(dedupAnswerTimeout)
+
+	var answer string
+	for answer == "" {
+		select {
+		case answer = <-needChan:
+		case <-ticker.C:
+			if transfer.Status == TransferStatusFailed {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("peer did not answer which chunks it needs")
+			}
+		}
+	}
+
+	need, err := parseIndexes(strings.TrimPrefix(answer, AckNeed+"|"), len(chunks))
+	if err != nil {
+		return err
+	}
+
+	transfer.Ranges = chunkRanges(chunks, need)
+	transfer.DeltaCopied = transfer.TotalSize - rangesLen(transfer.Ranges)
+	transfer.BytesTransferred = transfer.DeltaCopied
+
+	if transfer.DeltaCopied > 0 {
+		c.Log.Info("Sending %s: %s of %s already present on %s",
+			transfer.Name, util.FormatFileSize(transfer.DeltaCopied), util.FormatFileSize(transfer.TotalSize), c.RemoteName)
+	}
+	return nil
+}
+
+func (c *Connection) handleChunks(msg Message) {
+	transfer := c.App.FindTransfer(c, TransferTypeReceive, msg.TransferID)
+	if transfer == nil {
+		if c.wasSkipped(msg.TransferID) {
+			return
+		}
+		c.sendTransferError(msg, fmt.Sprintf("No active file transfer with ID %d", msg.TransferID))
+		return
+	}
+
+	if !transfer.Dedup || transfer.DeltaApplied {
+		c.sendTransferError(msg, fmt.Sprintf("Unexpected chunk list for %s", transfer.Name))
+		return
+	}
+
+	if msg.Data == "" {
+		transfer.Ranges = allRanges(transfer.TotalSize)
+		transfer.DeltaApplied = true
+		c.Log.Debug("Peer sends %s in full without a chunk list", transfer.Name)
+		return
+	}
+
+	chunks, err := parseChunks(msg.Data, transfer.TotalSize)
+	var filter *util.IgnoreList
+	if err == nil {
+		filter, err = c.shareFilter()
+	}
+	var need []int
+	var copied int64
+	if err == nil {
+		need, copied, err = c.App.Chunks.Fill(transfer.File, chunks, filter)
+	}
+	if err != nil {
+		transfer.Status = TransferStatusFailed
+		transfer.CloseFile()
+		c.Log.Error("Failed to reuse local chunks for %s: %v", transfer.Name, err)
+		c.sendTransferError(msg, fmt.Sprintf("Failed to reuse local chunks for %s: %v", transfer.Name, err))
+		c.App.RemoveTransfer(transfer)
+		return
+	}
+
+	transfer.Chunks = chunks
+	transfer.Ranges = chunkRanges(chunks, need)
+	transfer.DeltaCopied = copied
+	transfer.DeltaApplied = true
+	transfer.BytesTransferred = copied
+
+	if copied > 0 {
+		c.Log.Info("Found %d of %d chunks of %s locally (%s), requesting the rest",
+			len(chunks)-len(need), len(chunks), transfer.Name, util.FormatFileSize(copied))
+	}
+
+	c.SendMessage(Message{
+		Type:       MsgTypeACK,
+		Data:       fmt.Sprintf("%s|%s", AckNeed, encodeIndexes(need)),
+		ID:         msg.ID,
+		TransferID: transfer.WireID,
+	})
+}
+
+func NewChunkStore(app *App) *ChunkStore {
+	return &ChunkStore{
+		app:    app,
+		path:   filepath.Join(app.StateDir, chunkIndexFileName),
+		files:  make(map[string]*indexedFile),
+		chunks: make(map[chunkHash]chunkLocation),
+	}
+}
+
+func (s *ChunkStore) Run() {
+	if err := s.load(); err != nil {
+		s.app.Log.Warn("Failed to read chunk index, rebuilding it: %v", err)
+	}
+
+	for {
+		s.Refresh()
+		time.Sleep(chunkIndexInterval)
+	}
+}
+
+func (s *ChunkStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var index chunkIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("invalid chunk index: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for rel, file := range index.Files {
+		chunks, err := parseChunks(file.Chunks, file.Size)
+		if err != nil {
+			continue
+		}
+		file.chunks = chunks
+		s.files[rel] = file
+		s.addChunks(rel, chunks)
+	}
+	return nil
+}
+
+func (s *ChunkStore) Refresh() {
+	started := time.Now()
+	seen := make(map[string]bool)
+	var indexed, total int64
+
+	filepath.WalkDir(s.app.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.IsDir() {
+			if path == s.app.StateDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !entry.Type().IsRegular() || isPartFile(path) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.app.Root, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		if s.current(rel, info) {
+			return nil
+		}
+
+		chunks, err := chunkFile(path)
+		if err != nil {
+			s.app.Log.Debug("Failed to index %s: %v", rel, err)
+			return nil
+		}
+
+		s.store(rel, info, chunks)
+		indexed++
+		total += info.Size()
+		return nil
+	})
+
+	s.mu.Lock()
+	for rel := range s.files {
+		if seen[rel] {
+			continue
+		}
+		if info, err := os.Lstat(filepath.Join(s.app.Root, filepath.FromSlash(rel))); err == nil && info.Mode().IsRegular() {
+			continue
+		}
+		delete(s.files, rel)
+		s.dirty = true
+	}
+
+	if s.dirty {
+		s.chunks = make(map[chunkHash]chunkLocation)
+		for rel, file := range s.files {
+			s.addChunks(rel, file.chunks)
+		}
+	}
+	s.mu.Unlock()
+
+	if indexed > 0 {
+		s.app.Log.Info("Indexed %d files (%s) for deduplicated transfers in %v",
+			indexed, util.FormatFileSize(total), time.Since(started).Round(time.Millisecond))
+	}
+
+	s.save()
+}
+
+func (s *ChunkStore) current(rel string, info os.FileInfo) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[rel]
+	return ok && file.Size == info.Size() && file.ModTime == info.ModTime().UnixNano()
+}
+
+func (s *ChunkStore) store(rel string, info os.FileInfo, chunks []fileChunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[rel] = &indexedFile{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		chunks:  chunks,
+	}
+	s.addChunks(rel, chunks)
+	s.dirty = true
+}
+
+func (s *ChunkStore) addChunks(rel string, chunks []fileChunk) {
+	for _, chunk := range chunks {
+		s.chunks[chunk.Hash] = chunkLocation{Path: rel, Offset: chunk.Offset}
+	}
+}
+
+func (s *ChunkStore) Add(path string, chunks []fileChunk) {
+	rel, err := filepath.Rel(s.app.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return
+	}
+
+	if chunks == nil {
+		chunks, err = chunkFile(path)
+		if err != nil {
+			s.app.Log.Debug("Failed to index %s: %v", rel, err)
+			return
+		}
+	}
+
+	s.store(filepath.ToSlash(rel), info, chunks)
+}
+
+func (s *ChunkStore) lookup(hash chunkHash) (chunkLocation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loc, ok := s.chunks[hash]
+	return loc, ok
+}
+
+func (s *ChunkStore) Fill(dst *os.File, chunks []fileChunk, filter *util.IgnoreList) ([]int, int64, error) {
+	sources := make(map[string]*os.File)
+	defer func() {
+		for _, file := range sources {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+
+	shared := make(map[string]bool)
+	buf := make([]byte, chunkMaxSize)
+	var need []int
+	var copied int64
+
+	for i, chunk := range chunks {
+		loc, ok := s.lookup(chunk.Hash)
+		if ok {
+			allowed, seen := shared[loc.Path]
+			if !seen {
+				allowed = !filter.ShouldIgnore(loc.Path, false)
+				shared[loc.Path] = allowed
+			}
+			ok = allowed
+		}
+		if !ok || !s.readChunk(sources, loc, chunk, buf[:chunk.Length]) {
+			need = append(need, i)
+			continue
+		}
+
+		if _, err := dst.WriteAt(buf[:chunk.Length], chunk.Offset); err != nil {
+			return nil, 0, err
+		}
+		copied += chunk.Length
+	}
+
+	return need, copied, nil
+}
+
+func (s *ChunkStore) readChunk(sources map[string]*os.File, loc chunkLocation, chunk fileChunk, buf []byte) bool {
+	file, ok := sources[loc.Path]
+	if !ok {
+		file, _ = os.Open(filepath.Join(s.app.Root, filepath.FromSlash(loc.Path)))
+		sources[loc.Path] = file
+	}
+	if file == nil {
+		return false
+	}
+
+	if _, err := file.ReadAt(buf, loc.Offset); err != nil {
+		return false
+	}
+
+	sum := sha256.Sum256(buf)
+	return [chunkHashSize]byte(sum[:chunkHashSize]) == chunk.Hash
+}
+
+func (s *ChunkStore) save() {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+
+	index := chunkIndex{Files: make(map[string]*indexedFile, len(s.files))}
+	for rel, file := range s.files {
+		if file.Chunks == "" {
+			file.Chunks = encodeChunks(file.chunks)
+		}
+		index.Files[rel] = file
+	}
+	data, err := json.Marshal(index)
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	}
+	if err == nil {
+		tmp := s.path + ".tmp"
+		err = os.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+
+	if err != nil {
+		s.app.Log.Warn("Failed to save chunk index: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSplitChunks(t *testing.T) {
+	data := randomBytes(5, deltaReadBuffer+deltaReadBuffer/2)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantChunks int
+	}{
+		{name: "empty", data: nil, wantChunks: 0},
+		{name: "one byte", data: []byte{1}, wantChunks: 1},
+		{name: "below minimum", data: data[:chunkMinSize-1], wantChunks: 1},
+		{name: "exactly minimum", data: data[:chunkMinSize], wantChunks: 1},
+		{name: "zeros", data: make([]byte, 4*chunkMaxSize+10), wantChunks: 5},
+		{name: "random", data: data[:1024*1024], wantChunks: -1},
+		{name: "larger than the read buffer", data: data, wantChunks: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := splitChunks(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("splitChunks: %v", err)
+			}
+
+			if tt.wantChunks >= 0 && len(chunks) != tt.wantChunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), tt.wantChunks)
+			}
+
+			var offset int64
+			for i, chunk := range chunks {
+				if chunk.Offset != offset {
+					t.Fatalf("chunk %d starts at %d, want %d", i, chunk.Offset, offset)
+				}
+				if chunk.Length <= 0 || chunk.Length > chunkMaxSize || (chunk.Length < chunkMinSize && i < len(chunks)-1) {
+					t.Errorf("chunk %d has length %d", i, chunk.Length)
+				}
+
+				sum := sha256.Sum256(tt.data[chunk.Offset : chunk.Offset+chunk.Length])
+				if [chunkHashSize]byte(sum[:chunkHashSize]) != chunk.Hash {
+					t.Errorf("chunk %d has the wrong hash", i)
+				}
+				offset += chunk.Length
+			}
+			if offset != int64(len(tt.data)) {
+				t.Errorf("chunks cover %d of %d bytes", offset, len(tt.data))
+			}
+
+			for _, reader := range []io.Reader{iotest.OneByteReader(bytes.NewReader(tt.data)), iotest.HalfReader(bytes.NewReader(tt.data))} {
+				again, err := splitChunks(reader)
+				if err != nil {
+					t.Fatalf("splitChunks with short reads: %v", err)
+				}
+				if len(again) != len(chunks) {
+					t.Fatalf("short reads gave %d chunks, want %d", len(again), len(chunks))
+				}
+				for i := range again {
+					if again[i] != chunks[i] {
+						t.Fatalf("short reads gave chunk %d = %+v, want %+v", i, again[i], chunks[i])
+					}
+				}
+			}
+
+			parsed, err := parseChunks(encodeChunks(chunks), int64(len(tt.data)))
+			if len(chunks) > 0 && (err != nil || len(parsed) != len(chunks)) {
+				t.Fatalf("parseChunks(encodeChunks) = %d chunks, %v, want %d", len(parsed), err, len(chunks))
+			}
+		})
+	}
+}
+
+func TestSplitChunksAfterEdit(t *testing.T) {
+	data := randomBytes(6, 2*1024*1024)
+
+	tests := []struct {
+		name   string
+		edited []byte
+	}{
+		{name: "prepended", edited: concat([]byte("prefix"), data)},
+		{name: "inserted", edited: concat(data[:len(data)/2], []byte("inserted"), data[len(data)/2:])},
+		{name: "removed", edited: concat(data[:len(data)/3], data[len(data)/3+1000:])},
+		{name: "appended", edited: concat(data, []byte("suffix"))},
+	}
+
+	original, err := splitChunks(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited, err := splitChunks(bytes.NewReader(tt.edited))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			known := make(map[chunkHash]bool)
+			for _, chunk := range original {
+				known[chunk.Hash] = true
+			}
+
+			shared := 0
+			for _, chunk := range edited {
+				if known[chunk.Hash] {
+					shared++
+				}
+			}
+
+			if share := float64(shared) / float64(len(original)); share < 0.9 {
+				t.Errorf("only %d of %d chunks survived the edit", shared, len(original))
+			}
+		})
+	}
+}
@@ -1,27 +1,46 @@
 package network
 
 import (
+	"crypto/tls"
+	"fmt"
 	"local-file-sharer/internal/util"
 	"net"
+	"time"
 )
 
 func StartDial(app *App) {
 	log := util.NewLogger(app.Config.Verbose, "Client")
 
+	app.StartDiscovery()
+
 	log.Info("Connecting to %s", app.Config.TargetAddr)
 
-	conn, err := net.Dial("tcp", app.Config.TargetAddr)
-	if err != nil {
+	if _, err := app.Connect(app.Config.TargetAddr); err != nil {
 		log.Fatal("Failed to connect: %v", err)
 		return
 	}
 
 	log.Info("Connected to %s", app.Config.TargetAddr)
 
-	connection := NewConnection(conn, app, true)
-	app.AddConnection(connection)
+	StartCommandInterface(app)
+}
+
+func (a *App) Connect(addr string) (*Connection, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+
+	if a.Config.TLS {
+		conn = tls.Client(conn, a.TLSConfig(true))
+	}
+
+	connection := NewConnection(conn, a, true)
+	connection.dialAddr = addr
+	connection.SessionID = newSessionID()
+	a.AddConnection(connection)
 
 	go connection.Start()
 
-	StartCommandInterface(app)
+	return connection, nil
 }
@@ -6,7 +6,9 @@ import (
 	"local-file-sharer/internal/util"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -32,7 +34,9 @@ func ParseCommand(cmdStr string) *Command {
 }
 
 type CommandParser struct {
-	App *App
+	App          *App
+	activePeer   *Connection
+	peerOverride *Connection
 }
 
 func NewCommandParser(app *App) *CommandParser {
@@ -60,17 +64,21 @@ func StartCommandInterface(app *App) {
 		}
 
 		input := strings.TrimSpace(scanner.Text())
+		if app.answerPrompt(input) {
+			continue
+		}
+
 		if input == "" {
 			continue
 		}
 
-		if app.IsActiveTransferInProgress() {
+		if app.IsActiveTransferInProgress() && !isTransferControlCommand(input) {
 			fmt.Println("Cannot execute commands while transfers are in progress.")
 			continue
 		}
 
-		if !app.HasConnections() && !strings.EqualFold(input, "exit") && !strings.EqualFold(input, "quit") {
-			fmt.Println("No active connections. Only EXIT or QUIT commands are available.")
+		if !app.HasConnections() && !isOfflineCommand(input) {
+			fmt.Println("No active connections. Use DISCOVER to find peers and CONNECT <peer> to connect.")
 			continue
 		}
 
@@ -80,6 +88,80 @@ func StartCommandInterface(app *App) {
 	}
 }
 
+type pendingPrompt struct {
+	choices []string
+	answer  chan string
+}
+
+func (a *App) Prompt(question string, choices []string, timeout time.Duration) (string, bool) {
+	a.promptMu.Lock()
+	defer a.promptMu.Unlock()
+
+	answer := make(chan string, 1)
+	a.mu.Lock()
+	a.prompt = &pendingPrompt{choices: choices, answer: answer}
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.prompt = nil
+		a.mu.Unlock()
+	}()
+
+	fmt.Printf("\n%s ", question)
+
+	select {
+	case line := <-answer:
+		return line, true
+	case <-time.After(timeout):
+		fmt.Println()
+		return "", false
+	}
+}
+
+func (a *App) answerPrompt(input string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.prompt == nil {
+		return false
+	}
+
+	choice := strings.ToLower(input)
+	for _, valid := range a.prompt.choices {
+		if choice == valid {
+			a.prompt.answer <- choice
+			a.prompt = nil
+			return true
+		}
+	}
+
+	fmt.Printf("Please answer %s: ", strings.Join(a.prompt.choices, ", "))
+	return true
+}
+
+func isOfflineCommand(input string) bool {
+	switch strings.ToUpper(strings.Fields(input)[0]) {
+	case "LS", "LIST", "CD", "PWD", "INFO", "HELP", "QUIT", "EXIT", "PEERS", "DISCOVER", "CONNECT", "WATCH", "UNWATCH", "CHECKIGNORE":
+		return true
+	}
+	return false
+}
+
+func isTransferControlCommand(input string) bool {
+	fields := strings.Fields(input)
+	if strings.HasPrefix(fields[0], "@") && len(fields) > 1 {
+		fields = fields[1:]
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "STATUS", "PAUSE", "RESUME", "CANCEL", "LIMIT", "PEERS", "HELP",
+		"GET", "PUT", "GETM", "PUTM", "GETDIR", "PUTDIR", "SYNC", "WATCH", "UNWATCH", "QUEUE", "PRIORITY", "CLEAR":
+		return true
+	}
+	return false
+}
+
 func setupGracefulShutdown(app *App) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -88,14 +170,7 @@ func setupGracefulShutdown(app *App) {
 		<-c
 		fmt.Println("\nShutting down gracefully...")
 
-		app.mu.Lock()
-		for _, conn := range app.Connections {
-			conn.Conn.Close()
-		}
-		app.Connections = make(map[string]*Connection)
-		app.mu.Unlock()
-
-		app.Ready = false
+		app.Shutdown()
 
 		time.Sleep(500 * time.Millisecond)
 
@@ -110,6 +185,21 @@ func (p *CommandParser) Execute(input string) error {
 		return nil
 	}
 
+	if strings.HasPrefix(parts[0], "@") {
+		conn, err := p.App.FindConnection(strings.TrimPrefix(parts[0], "@"))
+		if err != nil {
+			return err
+		}
+
+		if len(parts) < 2 {
+			return fmt.Errorf("%s requires a command", parts[0])
+		}
+
+		p.peerOverride = conn
+		defer func() { p.peerOverride = nil }()
+		parts = parts[1:]
+	}
+
 	cmdName := strings.ToUpper(parts[0])
 	args := parts[1:]
 
@@ -128,6 +218,8 @@ func (p *CommandParser) Execute(input string) error {
 		err = p.handleQuit()
 	case "PWD":
 		err = p.handlePWD()
+	case "CHECKIGNORE":
+		err = p.handleCheckIgnore(args)
 	case "LSR", "LISTREMOTE":
 		err = p.handleRemoteLS(args)
 	case "CDR":
@@ -144,6 +236,20 @@ func (p *CommandParser) Execute(input string) error {
 		err = p.handleGetMultiple(args)
 	case "PUTM":
 		err = p.handlePutMultiple(args)
+	case "SYNC":
+		err = p.handleSync(args)
+	case "WATCH":
+		err = p.handleWatch(args)
+	case "UNWATCH":
+		err = p.handleUnwatch(args)
+	case "PEERS":
+		err = p.handlePeers()
+	case "DISCOVER":
+		err = p.handleDiscover()
+	case "CONNECT":
+		err = p.handleConnect(args)
+	case "USE":
+		err = p.handleUse(args)
 	case "STATUS":
 		err = p.handleStatus()
 	case "MSG":
@@ -154,6 +260,14 @@ func (p *CommandParser) Execute(input string) error {
 		err = p.handleResumeTransfer(args)
 	case "CANCEL":
 		err = p.handleCancelTransfer(args)
+	case "LIMIT":
+		err = p.handleLimit(args)
+	case "QUEUE":
+		err = p.handleQueue()
+	case "PRIORITY":
+		err = p.handlePriority(args)
+	case "CLEAR":
+		err = p.handleClear(args)
 	default:
 		return fmt.Errorf("unknown command: %s", cmdName)
 	}
@@ -176,6 +290,10 @@ func (p *CommandParser) handleLS(args []string) error {
 
 		fmt.Printf("Contents of .:\n")
 		for _, entry := range entries {
+			if isPartFile(entry.Name()) {
+				continue
+			}
+
 			if entry.IsDir() {
 				fmt.Printf("%s/\n", entry.Name())
 			} else {
@@ -219,6 +337,10 @@ func (p *CommandParser) handleLS(args []string) error {
 
 	fmt.Printf("Contents of %s:\n", normalizedPath)
 	for _, entry := range entries {
+		if isPartFile(entry.Name()) {
+			continue
+		}
+
 		if entry.IsDir() {
 			fmt.Printf("%s/\n", entry.Name())
 		} else {
@@ -301,11 +423,20 @@ func (p *CommandParser) handleRemoteCD(args []string) error {
 		return fmt.Errorf("CDR requires a directory path")
 	}
 
-	result, err := p.executeRemoteCommand("CDR", args[0])
+	conn, err := p.targetConnection()
 	if err != nil {
 		return err
 	}
 
+	result, err := conn.ExecuteCommand("CDR", args[0])
+	if err != nil {
+		return err
+	}
+
+	if dir, ok := strings.CutPrefix(result, "Changed to /"); ok {
+		conn.remoteCwd = dir
+	}
+
 	fmt.Println(result)
 	return nil
 }
@@ -313,12 +444,7 @@ func (p *CommandParser) handleRemoteCD(args []string) error {
 func (p *CommandParser) handleQuit() error {
 	fmt.Println("Shutting down gracefully...")
 
-	p.App.mu.Lock()
-	for _, conn := range p.App.Connections {
-		conn.Conn.Close()
-	}
-	p.App.Connections = make(map[string]*Connection)
-	p.App.mu.Unlock()
+	p.App.Shutdown()
 
 	time.Sleep(500 * time.Millisecond)
 
@@ -335,25 +461,56 @@ Available Commands:
     CD <path>          - Change local directory
     PWD                - Show current working directory
     INFO               - Show information about this node
+    CHECKIGNORE <path> [peer] - Show whether a local path is shared (with a peer) and which rule decides it
     HELP               - Show this help message
     QUIT, EXIT         - Exit the application
 
+  Peers:
+    PEERS              - List connected peers
+    USE <peer>         - Select the peer that remote commands go to
+    @<peer> <command>  - Run a single command against a specific peer
+    DISCOVER           - List peers announced on the local network
+    CONNECT <peer>     - Connect to a discovered peer by name, or to an ip:port
+
   Remote Commands:
     LSR, LISTREMOTE [path] - List files in remote directory
     CDR <path>         - Change remote directory
-    GET <file>         - Download a file from remote peer
-    PUT <file>         - Upload a file to remote peer
-    GETDIR [dir]       - Download a directory from remote peer (current dir if omitted)
-    PUTDIR [dir]       - Upload a directory to remote peer (current dir if omitted)
-    GETM <file1> <file2> ... - Download multiple files
-    PUTM <file1> <file2> ... - Upload multiple files
+    GET <file>         - Queue a download from remote peer
+    PUT <file>         - Queue an upload to remote peer
+    GETDIR [dir] [--tree] - Queue every file of a remote directory (current dir if omitted),
+                         --tree also recreates empty directories and symlinks
+    PUTDIR [dir]       - Queue every file of a local directory (current dir if omitted)
+    GETM <file1> <file2> ... - Queue multiple downloads
+    PUTM <file1> <file2> ... - Queue multiple uploads
+    SYNC <dir> [push|pull|both] [--dry-run] [--delete]
+                       - Transfer only the differences between a local and a remote
+                         directory (both ways if omitted), --dry-run prints the plan only,
+                         --delete also propagates deletions
+    WATCH <dir> [peer] - Push files created or modified under a local directory to a peer
+                         (every connected peer if omitted) as soon as they stop changing
+    WATCH              - List watched directories
+    UNWATCH <dir>      - Stop watching a directory
     STATUS             - Show active transfers
     MSG <message>      - Send a message to the remote peer
+
+    GET, GETDIR and GETM accept --overwrite=<policy> to choose what happens when the file
+    already exists here: rename, overwrite, skip, newer, ask or backup
+    PUT, PUTDIR, PUTM and WATCH accept --overwrite=skip, rename or backup, which keep the
+    peer's existing copy; otherwise the peer's own policy applies (WATCH defaults to --overwrite)
     
   Transfer Control:
     PAUSE <id>         - Pause a file transfer
     RESUME <id>        - Resume a paused transfer
+    RESUME <file>      - Resume an interrupted download from its partial file
     CANCEL <id>        - Cancel an active transfer
+    LIMIT              - Show the current rate limits
+    LIMIT <rate> [peer|id] - Limit uploads in total, to a peer or for one transfer (e.g. 500K, 2M, 0 = unlimited)
+    LIMIT IN <rate> [peer] - Limit downloads in total or from a peer
+
+  Queue:
+    QUEUE              - List queued transfers
+    PRIORITY <id> <n>  - Change the priority of a queued transfer (higher runs first)
+    CLEAR [id]         - Remove waiting and failed transfers from the queue
 `
 	fmt.Println(help)
 	return nil
@@ -361,6 +518,11 @@ Available Commands:
 
 func (p *CommandParser) handleInfo() error {
 	fmt.Printf("Node: %s\n", p.App.Config.Name)
+	fmt.Printf("Node ID: %s\n", p.App.NodeID)
+	fmt.Printf("Version: %s (protocol %d)\n", SoftwareVersion, ProtocolVersion)
+	if p.App.Fingerprint != "" {
+		fmt.Printf("Fingerprint: %s\n", p.App.Fingerprint)
+	}
 	fmt.Printf("Folder: %s\n", p.App.Config.Folder)
 	fmt.Printf("Read-only: %t\n", p.App.Config.ReadOnly)
 	fmt.Printf("Write-only: %t\n", p.App.Config.WriteOnly)
@@ -370,9 +532,75 @@ func (p *CommandParser) handleInfo() error {
 		fmt.Println("Max file size: Unlimited")
 	}
 	fmt.Printf("Verify transfers: %t\n", p.App.Config.Verify)
+	fmt.Printf("Overwrite policy: %s\n", p.App.Config.Overwrite)
+	return nil
+}
+
+func (p *CommandParser) handleCheckIgnore(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("CHECKIGNORE requires a path")
+	}
+
+	fullPath, err := filepath.Abs(filepath.Join(p.App.Config.Folder, util.NormalizePath(args[0])))
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %v", err)
+	}
+
+	rel, err := filepath.Rel(p.App.Root, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("access denied: %s is outside the shared folder", args[0])
+	}
+	rel = filepath.ToSlash(rel)
+
+	isDir := strings.HasSuffix(args[0], "/")
+	if info, err := os.Stat(fullPath); err == nil {
+		isDir = info.IsDir()
+	}
+
+	conn := p.peerOverride
+	if len(args) > 1 {
+		if conn, err = p.App.FindConnection(args[1]); err != nil {
+			return err
+		}
+	}
+
+	var ignoreList *util.IgnoreList
+	if conn != nil {
+		ignoreList, err = conn.shareFilter()
+	} else {
+		ignoreList, err = util.LoadIgnoreFile(p.App.Root)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read share filters: %v", err)
+	}
+
+	match := ignoreList.Match(rel, isDir)
+	switch {
+	case match.NotIncluded && match.Pattern == nil:
+		fmt.Printf("%s is not shared: no include rule matches\n", rel)
+	case match.NotIncluded:
+		fmt.Printf("%s is not shared: include rules exclude it with %s\n", rel, describeIgnoreRule(match.Pattern))
+	case match.Pattern == nil:
+		fmt.Printf("%s is not ignored: no rule matches\n", rel)
+	case match.Pattern.Include:
+		fmt.Printf("%s is shared: included by %s\n", rel, describeIgnoreRule(match.Pattern))
+	case match.Ignored && match.Path != rel:
+		fmt.Printf("%s is ignored: its directory %s is excluded by %s\n", rel, match.Path, describeIgnoreRule(match.Pattern))
+	case match.Ignored:
+		fmt.Printf("%s is ignored by %s\n", rel, describeIgnoreRule(match.Pattern))
+	default:
+		fmt.Printf("%s is not ignored: re-included by %s\n", rel, describeIgnoreRule(match.Pattern))
+	}
 	return nil
 }
 
+func describeIgnoreRule(pattern *util.IgnorePattern) string {
+	if pattern.Line == 0 {
+		return fmt.Sprintf("%s rule %s", pattern.Source, pattern.Text)
+	}
+	return fmt.Sprintf("%s:%d: %s", pattern.Source, pattern.Line, pattern.Text)
+}
+
 func (p *CommandParser) handleRemoteLS(args []string) error {
 	path := "."
 	if len(args) > 0 {
@@ -389,6 +617,11 @@ func (p *CommandParser) handleRemoteLS(args []string) error {
 }
 
 func (p *CommandParser) handleGet(args []string) error {
+	args, overwrite, err := parseOverwriteFlag(args)
+	if err != nil {
+		return err
+	}
+
 	if len(args) == 0 {
 		return fmt.Errorf("GET requires a file path")
 	}
@@ -398,11 +631,19 @@ func (p *CommandParser) handleGet(args []string) error {
 		return fmt.Errorf("invalid path: %s", filePath)
 	}
 
-	_, err := p.executeRemoteCommand("GET", filePath)
-	return err
+	if isPartFile(filePath) {
+		return fmt.Errorf("%s is an incomplete download", filePath)
+	}
+
+	return p.enqueue(QueueItem{Op: QueueOpGet, Path: filePath, Overwrite: overwrite})
 }
 
 func (p *CommandParser) handlePut(args []string) error {
+	args, overwrite, err := parseUploadOverwriteFlag(args)
+	if err != nil {
+		return err
+	}
+
 	if len(args) == 0 {
 		return fmt.Errorf("PUT requires a file path")
 	}
@@ -413,57 +654,85 @@ func (p *CommandParser) handlePut(args []string) error {
 		return fmt.Errorf("cannot PUT the entire directory, use PUTDIR instead")
 	}
 
+	relPath, err := p.localFilePath(filePath)
+	if err != nil {
+		return err
+	}
+
+	return p.enqueue(QueueItem{Op: QueueOpPut, Path: relPath, Overwrite: overwrite})
+}
+
+func (p *CommandParser) localFilePath(filePath string) (string, error) {
 	normalizedPath := util.NormalizePath(filePath)
 
 	resolvedPath, err := filepath.Abs(filepath.Join(p.App.Config.Folder, normalizedPath))
 	if err != nil {
-		return fmt.Errorf("failed to resolve path: %v", err)
+		return "", fmt.Errorf("failed to resolve path: %v", err)
 	}
 
 	absBase, _ := filepath.Abs(p.App.Config.Folder)
 	if !strings.HasPrefix(resolvedPath, absBase) {
-		return fmt.Errorf("access denied: path is outside the shared folder")
+		return "", fmt.Errorf("access denied: %s is outside the shared folder", filePath)
 	}
 
 	fileInfo, err := os.Stat(resolvedPath)
 	if err != nil {
-		return fmt.Errorf("file not found: %s", filePath)
+		return "", fmt.Errorf("file not found: %s", filePath)
 	}
 
 	if fileInfo.IsDir() {
-		return fmt.Errorf("this is a dir, not a file")
+		return "", fmt.Errorf("%s is a directory, use PUTDIR instead", filePath)
+	}
+
+	if isPartFile(resolvedPath) {
+		return "", fmt.Errorf("%s is an incomplete download", filePath)
 	}
 
-	relPath, err := filepath.Rel(p.App.Config.Folder, resolvedPath)
+	relPath, err := filepath.Rel(absBase, resolvedPath)
 	if err != nil {
-		return fmt.Errorf("failed to get relative path: %v", err)
+		return "", fmt.Errorf("failed to get relative path: %v", err)
 	}
 
-	relPath = util.NormalizePath(relPath)
+	return util.NormalizePath(relPath), nil
+}
 
-	result, err := p.executeRemoteCommand("PUT", relPath)
+func (p *CommandParser) enqueue(request QueueItem) error {
+	conn, err := p.targetConnection()
 	if err != nil {
 		return err
 	}
 
-	if strings.Contains(result, "Ready to receive") {
-		conn := p.getFirstConnection()
-		if conn == nil {
-			return fmt.Errorf("no active connection")
-		}
+	if err := conn.checkTransferProtocol(); err != nil {
+		return err
+	}
 
-		getCmd := &Command{
-			Name: "GET",
-			Args: []string{relPath},
+	if request.Dir == "" {
+		if request.Dir, err = filepath.Abs(p.App.Config.Folder); err != nil {
+			return fmt.Errorf("failed to resolve current folder path: %v", err)
 		}
+	}
+	if request.RemoteDir == "" {
+		request.RemoteDir = "/" + conn.remoteCwd
+	}
 
-		conn.handleGetCommand(getCmd)
+	item, added := p.App.Queue.Add(conn, request)
+	if !added {
+		fmt.Printf("Already queued [%d] %s %s (%s)\n", item.ID, item.Op, item.Path, item.Status)
+		return nil
 	}
 
+	fmt.Printf("Queued [%d] %s %s (peer %s)\n", item.ID, item.Op, item.Path, conn.PeerLabel())
 	return nil
 }
 
 func (p *CommandParser) handleGetDir(args []string) error {
+	args, overwrite, err := parseOverwriteFlag(args)
+	if err != nil {
+		return err
+	}
+
+	args, tree := takeFlag(args, "--tree")
+
 	path := "."
 	if len(args) > 0 {
 		path = args[0]
@@ -473,89 +742,176 @@ func (p *CommandParser) handleGetDir(args []string) error {
 		return fmt.Errorf("invalid path: %s", path)
 	}
 
-	_, err := p.executeRemoteCommand("GETDIR", path)
-	return err
-}
+	remoteArgs := []string{path}
+	if tree {
+		conn, err := p.targetConnection()
+		if err != nil {
+			return err
+		}
+		if !conn.HasCapability(CapMetadata) {
+			return fmt.Errorf("peer %s does not support GETDIR --tree", conn.RemoteName)
+		}
+		remoteArgs = append(remoteArgs, "--tree")
+	}
 
-func (p *CommandParser) handlePutDir(args []string) error {
-	path := "."
-	if len(args) > 0 {
-		path = args[0]
+	result, err := p.executeRemoteCommand("GETDIR", remoteArgs...)
+	if err != nil {
+		return err
 	}
 
-	if path == "." {
-		result, err := p.executeRemoteCommand("PUTDIR", ".")
-		if err != nil {
+	files := strings.Split(strings.TrimSpace(result), "\n")
+	if tree {
+		files = p.createTree(files)
+	}
+
+	batch := p.App.Queue.NewBatch("GETDIR " + path)
+	defer p.App.Queue.CloseBatch(batch)
+
+	for _, file := range files {
+		if err := p.enqueue(QueueItem{Op: QueueOpGet, Path: file, Overwrite: overwrite, Batch: batch}); err != nil {
 			return err
 		}
+	}
 
-		if strings.Contains(result, "Ready to receive") {
-			conn := p.getFirstConnection()
-			if conn == nil {
-				return fmt.Errorf("no active connection")
-			}
+	fmt.Printf("Queued %d files from %s\n", len(files), path)
+	return nil
+}
 
-			cmd := &Command{
-				Name: "GETDIR",
-				Args: []string{"."},
-			}
+func takeFlag(args []string, flag string) ([]string, bool) {
+	var rest []string
+	found := false
+	for _, arg := range args {
+		if arg == flag {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
 
-			conn.handleGetDirCommand(cmd)
+func (p *CommandParser) createTree(entries []string) []string {
+	var files []string
+	dirs, links := 0, 0
+
+	for _, entry := range entries {
+		link, target, isLink := strings.Cut(entry, symlinkSeparator)
+		relPath := strings.TrimSuffix(link, "/")
+
+		if !util.IsValidRelativePath(relPath) || !isPathSafe(relPath, p.App.Config.Folder) {
+			fmt.Printf("Skipping %s: invalid path\n", entry)
+			continue
 		}
 
-		return nil
+		fullPath := filepath.Join(p.App.Config.Folder, relPath)
+		if p.App.reservedPath(fullPath) || (isLink && p.App.reservedPath(filepath.Dir(fullPath)+string(filepath.Separator)+filepath.FromSlash(target))) {
+			fmt.Printf("Skipping %s: reserved path\n", entry)
+			continue
+		}
+
+		switch {
+		case isLink:
+			if err := createSymlink(p.App.Root, fullPath, target); err != nil {
+				fmt.Printf("Skipping symlink %s: %v\n", relPath, err)
+				continue
+			}
+			links++
+		case strings.HasSuffix(entry, "/"):
+			dir, err := filepath.Abs(fullPath)
+			if err == nil && !withinRoot(p.App.Root, dir) {
+				err = fmt.Errorf("it points outside the shared folder")
+			}
+			if err == nil {
+				err = os.MkdirAll(dir, 0755)
+			}
+			if err != nil {
+				fmt.Printf("Skipping directory %s: %v\n", relPath, err)
+				continue
+			}
+			dirs++
+		default:
+			files = append(files, entry)
+		}
 	}
 
-	normalizedPath := util.NormalizePath(path)
-	resolvedPath, err := filepath.Abs(filepath.Join(p.App.Config.Folder, normalizedPath))
+	fmt.Printf("Created %d directories and %d symlinks\n", dirs, links)
+	return files
+}
+
+func (p *CommandParser) handlePutDir(args []string) error {
+	args, overwrite, err := parseUploadOverwriteFlag(args)
 	if err != nil {
-		return fmt.Errorf("failed to resolve path: %v", err)
+		return err
 	}
 
-	absBase, _ := filepath.Abs(p.App.Config.Folder)
-	if !strings.HasPrefix(resolvedPath, absBase) {
-		return fmt.Errorf("access denied: path is outside the shared folder")
+	path := "."
+	if len(args) > 0 {
+		path = args[0]
 	}
 
-	info, err := os.Stat(resolvedPath)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("directory not found: %s", path)
-	}
+	relPath := "."
+	if path != "." {
+		normalizedPath := util.NormalizePath(path)
+		resolvedPath, err := filepath.Abs(filepath.Join(p.App.Config.Folder, normalizedPath))
+		if err != nil {
+			return fmt.Errorf("failed to resolve path: %v", err)
+		}
 
-	if !info.IsDir() {
-		return fmt.Errorf("not a directory: %s", path)
+		absBase, _ := filepath.Abs(p.App.Config.Folder)
+		if !strings.HasPrefix(resolvedPath, absBase) {
+			return fmt.Errorf("access denied: path is outside the shared folder")
+		}
+
+		info, err := os.Stat(resolvedPath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("directory not found: %s", path)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("not a directory: %s", path)
+		}
+
+		relPath, err = filepath.Rel(absBase, resolvedPath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %v", err)
+		}
+
+		relPath = util.NormalizePath(relPath)
 	}
 
-	relPath, err := filepath.Rel(p.App.Config.Folder, resolvedPath)
+	conn, err := p.targetConnection()
 	if err != nil {
-		return fmt.Errorf("failed to get relative path: %v", err)
+		return err
 	}
 
-	relPath = util.NormalizePath(relPath)
-
-	result, err := p.executeRemoteCommand("PUTDIR", relPath)
+	files, err := conn.listDirectory(p.App.Config.Folder, relPath, false)
 	if err != nil {
 		return err
 	}
 
-	if strings.Contains(result, "Ready to receive") {
-		conn := p.getFirstConnection()
-		if conn == nil {
-			return fmt.Errorf("no active connection")
-		}
+	if _, err := p.executeRemoteCommand("PUTDIR", relPath); err != nil {
+		return err
+	}
 
-		cmd := &Command{
-			Name: "GETDIR",
-			Args: []string{relPath},
-		}
+	batch := p.App.Queue.NewBatch("PUTDIR " + path)
+	defer p.App.Queue.CloseBatch(batch)
 
-		conn.handleGetDirCommand(cmd)
+	for _, file := range files {
+		if err := p.enqueue(QueueItem{Op: QueueOpPut, Path: file, Overwrite: overwrite, Batch: batch}); err != nil {
+			return err
+		}
 	}
 
+	fmt.Printf("Queued %d files from %s\n", len(files), path)
 	return nil
 }
 
 func (p *CommandParser) handleGetMultiple(args []string) error {
+	args, overwrite, err := parseOverwriteFlag(args)
+	if err != nil {
+		return err
+	}
+
 	if len(args) == 0 {
 		return fmt.Errorf("GETM requires at least one file")
 	}
@@ -566,102 +922,213 @@ func (p *CommandParser) handleGetMultiple(args []string) error {
 		}
 	}
 
-	conn := p.getFirstConnection()
-	if conn == nil {
-		return fmt.Errorf("no active connection")
+	batch := p.App.Queue.NewBatch(fmt.Sprintf("GETM of %d files", len(args)))
+	defer p.App.Queue.CloseBatch(batch)
+
+	for _, file := range args {
+		if err := p.enqueue(QueueItem{Op: QueueOpGet, Path: file, Overwrite: overwrite, Batch: batch}); err != nil {
+			return err
+		}
 	}
 
-	fmt.Printf("Starting sequential download of %d files...\n", len(args))
+	return nil
+}
 
-	for i, file := range args {
-		fmt.Printf("Downloading file %d of %d: %s\n", i+1, len(args), file)
+func (p *CommandParser) handlePutMultiple(args []string) error {
+	args, overwrite, err := parseUploadOverwriteFlag(args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("PUTM requires at least one file")
+	}
 
-		result, err := p.executeRemoteCommand("GET", file)
+	if _, err := p.targetConnection(); err != nil {
+		return err
+	}
+
+	batch := p.App.Queue.NewBatch(fmt.Sprintf("PUTM of %d files", len(args)))
+	defer p.App.Queue.CloseBatch(batch)
+
+	for _, filePath := range args {
+		relPath, err := p.localFilePath(filePath)
 		if err != nil {
-			fmt.Printf("Failed to get file %s: %v\n", file, err)
+			fmt.Printf("Skipping %s: %v\n", filePath, err)
 			continue
 		}
 
-		if strings.Contains(result, "Starting file transfer") {
-			for p.App.IsActiveTransferInProgress() {
-				time.Sleep(500 * time.Millisecond)
-			}
+		if err := p.enqueue(QueueItem{Op: QueueOpPut, Path: relPath, Overwrite: overwrite, Batch: batch}); err != nil {
+			return err
 		}
 	}
 
-	fmt.Println("Sequential download completed.")
 	return nil
 }
 
-func (p *CommandParser) handlePutMultiple(args []string) error {
+func (p *CommandParser) handleSync(args []string) error {
+	args, dryRun := takeFlag(args, "--dry-run")
+	args, deletes := takeFlag(args, "--delete")
+
 	if len(args) == 0 {
-		return fmt.Errorf("PUTM requires at least one file")
+		return fmt.Errorf("SYNC requires a directory")
+	}
+
+	dir := path.Clean(util.NormalizePath(args[0]))
+	if !util.IsValidRelativePath(dir) {
+		return fmt.Errorf("invalid path: %s", args[0])
+	}
+
+	mode := SyncBoth
+	if len(args) > 1 {
+		mode = strings.ToLower(args[1])
+	}
+	if mode != SyncPush && mode != SyncPull && mode != SyncBoth {
+		return fmt.Errorf("invalid sync direction %s, use push, pull or both", args[1])
 	}
 
-	conn := p.getFirstConnection()
-	if conn == nil {
-		return fmt.Errorf("no active connection")
+	conn, err := p.targetConnection()
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Starting sequential upload of %d files...\n", len(args))
+	if !conn.HasCapability(CapSync) {
+		return fmt.Errorf("peer %s does not support SYNC", conn.RemoteName)
+	}
 
-	for i, filePath := range args {
-		fmt.Printf("Uploading file %d of %d: %s\n", i+1, len(args), filePath)
+	return p.syncDirectory(conn, dir, mode, dryRun, deletes)
+}
 
-		normalizedPath := util.NormalizePath(filePath)
+func (p *CommandParser) handleWatch(args []string) error {
+	args, overwrite, err := parseUploadOverwriteFlag(args)
+	if err != nil {
+		return err
+	}
 
-		resolvedPath, err := filepath.Abs(filepath.Join(p.App.Config.Folder, normalizedPath))
-		if err != nil {
-			fmt.Printf("Failed to resolve path for %s: %v\n", filePath, err)
-			continue
+	if len(args) == 0 {
+		watches := p.App.Watches()
+		if len(watches) == 0 {
+			fmt.Println("No directories are being watched")
+			return nil
 		}
 
-		absBase, _ := filepath.Abs(p.App.Config.Folder)
-		if !strings.HasPrefix(resolvedPath, absBase) {
-			fmt.Printf("Access denied: %s is outside the shared folder\n", filePath)
-			continue
+		fmt.Printf("Watched directories: %d\n", len(watches))
+		for _, w := range watches {
+			peer := "every connected peer"
+			if w.PeerID != "" {
+				peer = w.PeerName
+			}
+
+			method := "notifications"
+			if w.Polling {
+				method = "polling"
+			}
+			fmt.Printf("  %-30s -> %s (%s, %s)\n", w.Dir, peer, w.Overwrite, method)
 		}
+		return nil
+	}
 
-		fileInfo, err := os.Stat(resolvedPath)
+	var conn *Connection
+	if len(args) > 1 {
+		conn, err = p.App.FindConnection(args[1])
 		if err != nil {
-			fmt.Printf("File not found: %s\n", filePath)
-			continue
+			return err
 		}
+	} else if p.peerOverride != nil {
+		conn = p.peerOverride
+	}
 
-		if fileInfo.IsDir() {
-			fmt.Printf("%s is a directory, skipping\n", filePath)
-			continue
+	w, err := p.App.StartWatch(args[0], conn, overwrite)
+	if err != nil {
+		return err
+	}
+
+	peer := "every connected peer"
+	if conn != nil {
+		peer = conn.PeerLabel()
+	}
+	fmt.Printf("Watching %s, changes are pushed to %s\n", w.Dir, peer)
+	return nil
+}
+
+func (p *CommandParser) handleUnwatch(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("UNWATCH requires a directory")
+	}
+
+	if _, err := p.App.StopWatch(args[0]); err != nil {
+		return err
+	}
+
+	fmt.Printf("Stopped watching %s\n", args[0])
+	return nil
+}
+
+func (p *CommandParser) handleQueue() error {
+	items := p.App.Queue.Items()
+	if len(items) == 0 {
+		fmt.Println("Transfer queue is empty")
+		return nil
+	}
+
+	fmt.Printf("Queued transfers: %d (running up to %d at a time)\n", len(items), max(1, p.App.Config.Concurrent))
+	for _, item := range items {
+		direction := "from"
+		if item.Op == QueueOpPut {
+			direction = "to"
 		}
 
-		relPath, err := filepath.Rel(p.App.Config.Folder, resolvedPath)
-		if err != nil {
-			fmt.Printf("Failed to get relative path for %s: %v\n", filePath, err)
-			continue
+		status := item.Status
+		if item.Error != "" {
+			status += ": " + item.Error
 		}
 
-		relPath = util.NormalizePath(relPath)
+		fmt.Printf("[%d] %s %s %s %s, priority %d - %s\n",
+			item.ID, item.Op, item.Path, direction, item.PeerName, item.Priority, status)
+	}
 
-		result, err := p.executeRemoteCommand("PUT", relPath)
-		if err != nil {
-			fmt.Printf("Failed to put file %s: %v\n", relPath, err)
-			continue
-		}
+	return nil
+}
 
-		if strings.Contains(result, "Ready to receive") {
-			getCmd := &Command{
-				Name: "GET",
-				Args: []string{relPath},
-			}
+func (p *CommandParser) handlePriority(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("PRIORITY requires a queue ID and a priority")
+	}
 
-			conn.handleGetCommand(getCmd)
+	id, err := util.ParseInt64(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid queue ID: %v", err)
+	}
 
-			for p.App.IsActiveTransferInProgress() {
-				time.Sleep(500 * time.Millisecond)
-			}
+	priority, err := util.ParseInt64(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid priority: %v", err)
+	}
+
+	if err := p.App.Queue.SetPriority(int(id), int(priority)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Queued transfer %d now has priority %d\n", id, priority)
+	return nil
+}
+
+func (p *CommandParser) handleClear(args []string) error {
+	var id int64
+	if len(args) > 0 {
+		var err error
+		id, err = util.ParseInt64(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid queue ID: %v", err)
 		}
 	}
 
-	fmt.Println("Sequential upload completed.")
+	removed, err := p.App.Queue.Clear(int(id))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d transfers from the queue\n", removed)
 	return nil
 }
 
@@ -673,12 +1140,18 @@ func (p *CommandParser) handleStatus() error {
 		return nil
 	}
 
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].ID < transfers[j].ID
+	})
+
 	fmt.Printf("Active transfers: %d\n", len(transfers))
 	for _, t := range transfers {
 		pct := float64(t.BytesTransferred) / float64(t.TotalSize) * 100
 		typeStr := "Receiving"
+		direction := "from"
 		if t.Type == TransferTypeSend {
 			typeStr = "Sending"
+			direction = "to"
 		}
 
 		statusStr := "In Progress"
@@ -693,10 +1166,142 @@ func (p *CommandParser) handleStatus() error {
 			statusStr = "Failed"
 		}
 
-		fmt.Printf("[%d] %s %s: %.1f%% complete (%.2f KB/s) - %s\n",
-			t.ID, typeStr, t.Name, pct, t.Speed, statusStr)
+		if t.Compressed {
+			statusStr += fmt.Sprintf(", %s wire / %s data", util.FormatFileSize(t.WireBytes), util.FormatFileSize(t.BytesTransferred-t.Offset))
+		}
+
+		if t.Window != nil {
+			window, rtt := t.Window.Stats()
+			statusStr += fmt.Sprintf(", window %d, RTT %v", window, rtt.Round(time.Millisecond))
+		}
+
+		fmt.Printf("[%d] %s %s %s %s: %.1f%% complete (%.2f KB/s) - %s\n",
+			t.ID, typeStr, t.Name, direction, t.Conn.PeerLabel(), pct, t.Speed, statusStr)
+	}
+
+	return nil
+}
+
+func (p *CommandParser) handlePeers() error {
+	conns := p.App.GetActiveConnections()
+
+	if len(conns) == 0 {
+		fmt.Println("No connected peers")
+		return nil
+	}
+
+	active, _ := p.targetConnection()
+
+	fmt.Printf("Connected peers: %d\n", len(conns))
+	for _, conn := range conns {
+		marker := " "
+		if conn == active {
+			marker = "*"
+		}
+
+		name := conn.RemoteName
+		if name == "" {
+			name = "(connecting)"
+		}
+
+		nodeID, version := "-", "-"
+		if conn.RemoteNodeID != "" {
+			nodeID = conn.RemoteNodeID[:min(8, len(conn.RemoteNodeID))]
+		}
+		if conn.RemoteVersion != "" {
+			version = "v" + conn.RemoteVersion
+		}
+		if conn.Reconnecting() {
+			version += " (reconnecting)"
+		}
+
+		fmt.Printf("%s [%d] %-20s %-22s node %-8s %s\n",
+			marker, conn.PeerID, name, conn.ID, nodeID, version)
+	}
+
+	return nil
+}
+
+func (p *CommandParser) handleDiscover() error {
+	discovery := p.App.Discovery
+	if discovery == nil {
+		return fmt.Errorf("peer discovery is not running")
+	}
+
+	peers := discovery.Peers()
+	if len(peers) == 0 {
+		if wait := announceInterval + time.Second - time.Since(discovery.Started); wait > 0 {
+			fmt.Println("Listening for peer announcements...")
+			time.Sleep(wait)
+			peers = discovery.Peers()
+		}
+	}
+
+	if len(peers) == 0 {
+		fmt.Println("No peers discovered on the local network")
+		return nil
+	}
+
+	fmt.Printf("Discovered peers: %d\n", len(peers))
+	for _, peer := range peers {
+		fmt.Printf("  %-20s %-22s node %-8s seen %s ago\n",
+			peer.Name, peer.Addr, peer.NodeID[:min(8, len(peer.NodeID))],
+			time.Since(peer.LastSeen).Round(time.Second))
+	}
+	fmt.Println("Use CONNECT <name> to connect to a peer")
+
+	return nil
+}
+
+func (p *CommandParser) handleConnect(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("CONNECT requires a peer name or address")
+	}
+
+	addr := args[0]
+	if p.App.Discovery != nil {
+		peer, err := p.App.Discovery.Lookup(args[0])
+		if err == nil {
+			for _, conn := range p.App.GetActiveConnections() {
+				if conn.RemoteNodeID == peer.NodeID {
+					return fmt.Errorf("already connected to %s as peer %d", peer.Name, conn.PeerID)
+				}
+			}
+
+			if peer.TLS != p.App.Config.TLS {
+				return fmt.Errorf("%s has TLS set to %t, restart with --tls=%t to connect", peer.Name, peer.TLS, peer.TLS)
+			}
+
+			addr = peer.Addr
+		} else if !strings.Contains(addr, ":") {
+			return err
+		}
+	} else if !strings.Contains(addr, ":") {
+		return fmt.Errorf("peer discovery is not running, connect with an ip:port address")
+	}
+
+	conn, err := p.App.Connect(addr)
+	if err != nil {
+		return err
 	}
 
+	p.activePeer = conn
+	fmt.Printf("Connecting to %s as peer %d\n", addr, conn.PeerID)
+	return nil
+}
+
+func (p *CommandParser) handleUse(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("USE requires a peer ID or name")
+	}
+
+	conn, err := p.App.FindConnection(args[0])
+	if err != nil {
+		return err
+	}
+
+	p.activePeer = conn
+	fmt.Printf("Using peer %s\n", conn.PeerLabel())
 	return nil
 }
 
@@ -707,9 +1312,9 @@ func (p *CommandParser) handleMessage(args []string) error {
 
 	message := strings.Join(args, " ")
 
-	conn := p.getFirstConnection()
-	if conn == nil {
-		return fmt.Errorf("no active connection")
+	conn, err := p.targetConnection()
+	if err != nil {
+		return err
 	}
 
 	msgObj := Message{
@@ -734,48 +1339,63 @@ func (p *CommandParser) handlePauseTransfer(args []string) error {
 		return fmt.Errorf("invalid transfer ID: %v", err)
 	}
 
-	found := false
-	for _, transfer := range p.App.GetTransfers() {
-		if transfer.ID == int(id) {
-			transfer.Pause()
-			found = true
-			break
-		}
-	}
-
-	if !found {
+	transfer := p.App.GetTransfer(int(id))
+	if transfer == nil {
 		return fmt.Errorf("no active transfer with ID %d", id)
 	}
 
+	transfer.Pause()
 	return nil
 }
 
 func (p *CommandParser) handleResumeTransfer(args []string) error {
 	if len(args) == 0 {
-		return fmt.Errorf("RESUME requires a transfer ID")
+		return fmt.Errorf("RESUME requires a transfer ID or file path")
 	}
 
 	id, err := util.ParseInt64(args[0])
 	if err != nil {
-		return fmt.Errorf("invalid transfer ID: %v", err)
+		return p.resumeDownload(args[0])
 	}
 
-	found := false
-	for _, transfer := range p.App.GetTransfers() {
-		if transfer.ID == int(id) {
-			transfer.Resume()
-			found = true
-			break
-		}
-	}
-
-	if !found {
+	transfer := p.App.GetTransfer(int(id))
+	if transfer == nil {
 		return fmt.Errorf("no paused transfer with ID %d", id)
 	}
 
+	transfer.Resume()
+	if transfer.Type == TransferTypeReceive {
+		transfer.Conn.requestRetransmit(transfer)
+	}
 	return nil
 }
 
+func (p *CommandParser) resumeDownload(filePath string) error {
+	if !util.IsValidRelativePath(filePath) {
+		return fmt.Errorf("invalid path: %s", filePath)
+	}
+
+	conn, err := p.targetConnection()
+	if err != nil {
+		return err
+	}
+
+	if !conn.HasCapability(CapResume) {
+		return fmt.Errorf("peer %s does not support resuming transfers", conn.RemoteName)
+	}
+
+	normalizedPath := util.NormalizePath(filePath)
+	partPath := partFilePath(filepath.Join(p.App.Config.Folder, normalizedPath))
+
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return fmt.Errorf("no partial download found for %s", filePath)
+	}
+
+	fmt.Printf("Resuming %s from %s\n", normalizedPath, util.FormatFileSize(info.Size()))
+	return p.enqueue(QueueItem{Op: QueueOpGet, Path: normalizedPath})
+}
+
 func (p *CommandParser) handleCancelTransfer(args []string) error {
 	if len(args) == 0 {
 		return fmt.Errorf("CANCEL requires a transfer ID")
@@ -786,34 +1406,126 @@ func (p *CommandParser) handleCancelTransfer(args []string) error {
 		return fmt.Errorf("invalid transfer ID: %v", err)
 	}
 
-	found := false
-	for _, transfer := range p.App.GetTransfers() {
-		if transfer.ID == int(id) {
-			transfer.Status = TransferStatusFailed
-			if transfer.File != nil {
-				transfer.File.Close()
-				transfer.File = nil
+	transfer := p.App.GetTransfer(int(id))
+	if transfer == nil {
+		return fmt.Errorf("no active transfer with ID %d", id)
+	}
+
+	transfer.Status = TransferStatusFailed
+	transfer.CloseFile()
+	p.App.Queue.transferCanceled(transfer)
+	p.App.RemoveTransfer(transfer)
+	fmt.Printf("Transfer %d canceled\n", id)
+
+	if transfer.Type == TransferTypeReceive {
+		if transfer.AckID != "" {
+			transfer.Conn.SendMessage(Message{
+				Type:       MsgTypeError,
+				Data:       "Transfer canceled by receiver",
+				ID:         transfer.AckID,
+				TransferID: transfer.WireID,
+			})
+		}
+		fmt.Printf("Partial download kept, use RESUME %s to continue\n", transfer.Name)
+	}
+
+	return nil
+}
+
+func (p *CommandParser) handleLimit(args []string) error {
+	if len(args) == 0 {
+		p.printLimits()
+		return nil
+	}
+
+	inbound := strings.EqualFold(args[0], "IN")
+	if inbound {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("LIMIT requires a rate, e.g. LIMIT 500K")
+	}
+
+	rate, err := util.ParseRate(args[0])
+	if err != nil {
+		return err
+	}
+
+	direction := "upload"
+	if inbound {
+		direction = "download"
+	}
+
+	conn := p.peerOverride
+	if len(args) > 1 {
+		target := args[1]
+		if id, err := util.ParseInt64(target); err == nil {
+			if transfer := p.App.GetTransfer(int(id)); transfer != nil {
+				transfer.Limiter.SetRate(rate)
+				fmt.Printf("Transfer [%d] %s limited to %s\n", transfer.ID, transfer.Name, util.FormatRate(rate))
+				return nil
 			}
-			p.App.RemoveTransfer(transfer)
-			found = true
-			fmt.Printf("Transfer %d canceled\n", id)
-			break
+		}
+
+		conn, err = p.App.FindConnection(strings.TrimPrefix(target, "@"))
+		if err != nil {
+			return err
 		}
 	}
 
-	if !found {
-		return fmt.Errorf("no active transfer with ID %d", id)
+	if conn != nil {
+		conn.limiter(inbound).SetRate(rate)
+		fmt.Printf("%s rate for peer %s limited to %s\n", strings.ToUpper(direction[:1])+direction[1:], conn.PeerLabel(), util.FormatRate(rate))
+		return nil
 	}
 
+	p.App.limiter(inbound).SetRate(rate)
+	fmt.Printf("Total %s rate limited to %s\n", direction, util.FormatRate(rate))
 	return nil
 }
 
+func (p *CommandParser) printLimits() {
+	fmt.Printf("Total: upload %s, download %s\n",
+		util.FormatRate(p.App.sendLimiter.Rate()), util.FormatRate(p.App.recvLimiter.Rate()))
+
+	for _, conn := range p.App.GetActiveConnections() {
+		up, down := conn.sendLimiter.Rate(), conn.recvLimiter.Rate()
+		if up > 0 || down > 0 {
+			fmt.Printf("Peer %s: upload %s, download %s\n", conn.PeerLabel(), util.FormatRate(up), util.FormatRate(down))
+		}
+	}
+
+	transfers := p.App.GetCurrentTransfers()
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].ID < transfers[j].ID
+	})
+
+	for _, t := range transfers {
+		if rate := t.Limiter.Rate(); rate > 0 {
+			fmt.Printf("Transfer [%d] %s: %s\n", t.ID, t.Name, util.FormatRate(rate))
+		}
+	}
+}
+
 type MessageHandler func(messageStr string)
 
 func (p *CommandParser) executeRemoteCommand(cmdName string, args ...string) (string, error) {
-	conn := p.getFirstConnection()
-	if conn == nil {
-		return "", fmt.Errorf("no active connection")
+	conn, err := p.targetConnection()
+	if err != nil {
+		return "", err
+	}
+
+	return conn.ExecuteCommand(cmdName, args...)
+}
+
+func (c *Connection) ExecuteCommand(cmdName string, args ...string) (string, error) {
+	return c.executeCommand(10*time.Second, cmdName, args...)
+}
+
+func (c *Connection) executeCommand(timeout time.Duration, cmdName string, args ...string) (string, error) {
+	if c.Reconnecting() {
+		return "", fmt.Errorf("peer %s is reconnecting, try again shortly", c.PeerLabel())
 	}
 
 	cmdStr := cmdName
@@ -827,15 +1539,15 @@ func (p *CommandParser) executeRemoteCommand(cmdName string, args ...string) (st
 	errChan := make(chan error, 1)
 
 	responseMsgID := fmt.Sprintf("cmd-%d", time.Now().UnixNano())
-	conn.RegisterResponseHandler(responseMsgID, func(msg Message) {
+	c.RegisterResponseHandler(responseMsgID, func(msg Message) {
 		switch msg.Type {
 		case MsgTypeCommandResult:
 			respChan <- msg.Data
 		case MsgTypeError:
-			errChan <- fmt.Errorf("remote error: %s", msg.Data)
+			errChan <- &commandError{Code: msg.Code, Message: "remote error: " + msg.Data}
 		}
 	})
-	defer conn.UnregisterResponseHandler(responseMsgID)
+	defer c.UnregisterResponseHandler(responseMsgID)
 
 	msg := Message{
 		Type: MsgTypeCommand,
@@ -843,7 +1555,7 @@ func (p *CommandParser) executeRemoteCommand(cmdName string, args ...string) (st
 		ID:   responseMsgID,
 	}
 
-	if err := conn.SendReliableMessage(msg); err != nil {
+	if err := c.SendReliableMessage(msg); err != nil {
 		return "", fmt.Errorf("failed to send command: %v", err)
 	}
 
@@ -852,18 +1564,33 @@ func (p *CommandParser) executeRemoteCommand(cmdName string, args ...string) (st
 		return resp, nil
 	case err := <-errChan:
 		return "", err
-	case <-time.After(10 * time.Second):
+	case <-time.After(timeout):
 		return "", fmt.Errorf("command timed out")
 	}
 }
 
-func (p *CommandParser) getFirstConnection() *Connection {
-	p.App.mu.Lock()
-	defer p.App.mu.Unlock()
+func (p *CommandParser) targetConnection() (*Connection, error) {
+	if p.peerOverride != nil {
+		return p.peerOverride, nil
+	}
+
+	conns := p.App.GetActiveConnections()
 
-	for _, conn := range p.App.Connections {
-		return conn
+	if p.activePeer != nil {
+		for _, conn := range conns {
+			if conn == p.activePeer {
+				return conn, nil
+			}
+		}
+		p.activePeer = nil
 	}
 
-	return nil
+	switch len(conns) {
+	case 0:
+		return nil, fmt.Errorf("no active connection")
+	case 1:
+		return conns[0], nil
+	}
+
+	return nil, fmt.Errorf("multiple peers connected, select one with USE <peer> or prefix the command with @<peer>")
 }
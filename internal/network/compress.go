@@ -0,0 +1,100 @@
+package network
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CompressionGzip = "gzip"
+
+	minCompressSize    = 4096
+	compressSampleSize = 256 * 1024
+	maxCompressRatio   = 0.9
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+func compressChunk(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func decompressChunk(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxFramePayload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxFramePayload {
+		return nil, fmt.Errorf("decompressed chunk exceeds %d bytes", maxFramePayload)
+	}
+	return out, nil
+}
+
+func (c *Connection) shouldCompress(file *os.File, offset, size int64) bool {
+	if !c.HasCapability(CapCompression) || size-offset < minCompressSize {
+		return false
+	}
+
+	sample := make([]byte, min(compressSampleSize, size-offset))
+	n, err := file.ReadAt(sample, offset)
+	if n == 0 || (err != nil && err != io.EOF) {
+		return false
+	}
+
+	compressed := compressChunk(sample[:n])
+	return compressed != nil && float64(len(compressed)) < float64(n)*maxCompressRatio
+}
+
+func (c *Connection) sendData(transfer *FileTransfer, ackID string, offset int64, data []byte) error {
+	dataMsg := NewBinaryMessage(MsgTypeFileData, data)
+	if transfer.Compressed {
+		if compressed := compressChunk(data); compressed != nil && len(compressed) < len(data) {
+			dataMsg = NewBinaryMessage(MsgTypeFileData, compressed)
+			dataMsg.Compressed = true
+		}
+	}
+
+	dataMsg.ID = ackID
+	dataMsg.TransferID = transfer.WireID
+	dataMsg.Offset = offset
+
+	if delay := reserveAll(len(dataMsg.Data), c.sendLimiters(transfer)...); delay > 0 {
+		time.Sleep(delay)
+		transfer.Window.Sent(offset)
+	}
+
+	if err := c.SendMessage(dataMsg); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&transfer.WireBytes, int64(len(dataMsg.Data)))
+	return nil
+}
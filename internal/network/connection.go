@@ -2,14 +2,17 @@ package network
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"local-file-sharer/internal/util"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -39,6 +42,7 @@ func isPathSafe(requestedPath, baseFolder string) bool {
 
 type Connection struct {
 	ID                string
+	PeerID            int
 	Conn              net.Conn
 	Name              string
 	RemoteName        string
@@ -51,37 +55,76 @@ type Connection struct {
 	responseHandlerMu sync.Mutex
 	sendMutex         sync.Mutex
 	ignoreList        *util.IgnoreList
+	binaryFraming     bool
+	RemoteNodeID      string
+	RemoteVersion     string
+	ProtocolVersion   int
+	Capabilities      map[string]bool
+	RemoteFingerprint string
+	authenticated     bool
+	cwd               string
+	expectedUploads   map[string]expectedUpload
+	uploadsMu         sync.Mutex
+	expectedDownloads map[string]expectedDownload
+	downloadsMu       sync.Mutex
+	remoteCwd         string
+	SessionID         string
+	dialAddr          string
+	established       bool
+	reconnecting      bool
+	closed            bool
+	sendLimiter       *rateLimiter
+	recvLimiter       *rateLimiter
+	skipped           sync.Map
 }
 
 func NewConnection(conn net.Conn, app *App, isClient bool) *Connection {
 	id := conn.RemoteAddr().String()
 
 	c := &Connection{
-		ID:               id,
-		Conn:             conn,
-		App:              app,
-		Log:              util.NewLogger(app.Config.Verbose, fmt.Sprintf("Conn-%s", id)),
-		Reader:           bufio.NewReader(conn),
-		Writer:           bufio.NewWriter(conn),
-		Name:             app.Config.Name,
-		isClient:         isClient,
-		responseHandlers: make(map[string]func(Message)),
-		ignoreList:       &util.IgnoreList{Patterns: []util.IgnorePattern{}},
+		ID:                id,
+		Conn:              conn,
+		App:               app,
+		Log:               util.NewLogger(app.Config.Verbose, fmt.Sprintf("Conn-%s", id)),
+		Reader:            bufio.NewReader(conn),
+		Writer:            bufio.NewWriter(conn),
+		Name:              app.Config.Name,
+		isClient:          isClient,
+		responseHandlers:  make(map[string]func(Message)),
+		ignoreList:        &util.IgnoreList{Patterns: []util.IgnorePattern{}},
+		Capabilities:      make(map[string]bool),
+		expectedUploads:   make(map[string]expectedUpload),
+		expectedDownloads: make(map[string]expectedDownload),
+		sendLimiter:       newRateLimiter(0),
+		recvLimiter:       newRateLimiter(0),
 	}
 	return c
 }
 
 func (c *Connection) loadIgnoreList() *util.IgnoreList {
-	ignoreList, err := util.LoadIgnoreFile(c.App.Config.Folder)
+	ignoreList, err := c.shareFilter()
 	if err != nil {
-		c.Log.Warn("Failed to load .p2pignore: %v", err)
-		return &util.IgnoreList{Patterns: []util.IgnorePattern{}}
+		c.Log.Warn("Failed to load share filters, hiding all files from %s: %v", c.PeerLabel(), err)
+		c.ignoreList = util.DenyAllIgnoreList("unreadable share filters")
+		return c.ignoreList
 	}
 
 	c.ignoreList = ignoreList
 	return ignoreList
 }
 
+func (c *Connection) attach(conn net.Conn) {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	c.Conn = conn
+	c.Reader = bufio.NewReader(conn)
+	c.Writer = bufio.NewWriter(conn)
+	c.binaryFraming = false
+	c.authenticated = false
+	c.Capabilities = make(map[string]bool)
+}
+
 func (c *Connection) RegisterResponseHandler(id string, handler func(Message)) {
 	c.responseHandlerMu.Lock()
 	defer c.responseHandlerMu.Unlock()
@@ -95,10 +138,9 @@ func (c *Connection) UnregisterResponseHandler(id string) {
 }
 
 func (c *Connection) Start() {
-	defer c.Close()
-
 	if err := c.Handshake(); err != nil {
 		c.Log.Error("Handshake failed: %v", err)
+		c.Close()
 		return
 	}
 
@@ -108,23 +150,93 @@ func (c *Connection) Start() {
 		c.Log.Info("Client connected: %s (%s)", c.RemoteName, c.ID)
 	}
 
+	c.run()
+}
+
+func (c *Connection) run() {
+	defer c.Close()
+
 	for {
-		line, err := c.Reader.ReadString('\n')
+		msg, err := c.readMessage()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !c.closed {
 				c.Log.Error("Read error: %v", err)
 			}
 			break
 		}
 
-		c.handleMessage(strings.TrimSpace(line))
+		if msg != nil {
+			c.handleMessage(*msg)
+		}
 	}
 }
 
+func (c *Connection) readMessage() (*Message, error) {
+	if c.binaryFraming {
+		frame, err := ReadFrame(c.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := DecodeMessageFrame(frame)
+		if err != nil {
+			c.Log.Error("Invalid frame: %v", err)
+			return nil, nil
+		}
+		return msg, nil
+	}
+
+	line, err := c.Reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := Unmarshal([]byte(strings.TrimSpace(line)))
+	if err != nil {
+		c.Log.Error("Invalid message format: %v", err)
+		return nil, nil
+	}
+	return msg, nil
+}
+
 func (c *Connection) Handshake() error {
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			return fmt.Errorf("TLS handshake failed: %v", err)
+		}
+
+		peerCerts := tlsConn.ConnectionState().PeerCertificates
+		if len(peerCerts) == 0 {
+			return fmt.Errorf("peer did not present a certificate")
+		}
+		c.RemoteFingerprint = CertificateFingerprint(peerCerts[0].Raw)
+	}
+
+	hello := Hello{
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		SoftwareVersion:    SoftwareVersion,
+		NodeID:             c.App.NodeID,
+		Name:               c.Name,
+		Capabilities:       c.localCapabilities(),
+		Auth:               len(c.authSecrets()) > 0,
+	}
+
+	if c.isClient {
+		hello.SessionID = c.SessionID
+	}
+
+	helloData, err := json.Marshal(hello)
+	if err != nil {
+		return fmt.Errorf("failed to encode handshake: %v", err)
+	}
+
 	handshake := Message{
 		Type: MsgTypeHandshake,
-		Data: c.Name,
+		Data: string(helloData),
 	}
 
 	if err := c.SendMessage(handshake); err != nil {
@@ -141,26 +253,158 @@ func (c *Connection) Handshake() error {
 		return fmt.Errorf("invalid handshake format: %v", err)
 	}
 
+	if response.Type == MsgTypeError {
+		return fmt.Errorf("rejected by peer: %s", response.Data)
+	}
+
 	if response.Type != MsgTypeHandshake {
 		return fmt.Errorf("expected handshake, got %s", response.Type)
 	}
 
-	c.RemoteName = response.Data
+	remote := ParseHello(response.Data)
+	c.RemoteName = remote.Name
+	c.RemoteNodeID = remote.NodeID
+	c.RemoteVersion = remote.SoftwareVersion
+
+	if err := remote.CheckCompatibility(); err != nil {
+		c.SendMessage(Message{
+			Type: MsgTypeError,
+			Data: err.Error(),
+		})
+		return err
+	}
+
+	c.ProtocolVersion = min(ProtocolVersion, remote.ProtocolVersion)
+	c.Capabilities = NegotiateCapabilities(c.localCapabilities(), remote.Capabilities)
+	c.binaryFraming = c.HasCapability(CapBinaryFraming)
+
+	if c.RemoteFingerprint != "" {
+		if err := c.verifyPeerIdentity(); err != nil {
+			c.SendMessage(Message{
+				Type: MsgTypeError,
+				Data: "peer identity verification failed",
+			})
+			return err
+		}
+	}
+
+	if err := c.authenticate(remote.Auth); err != nil {
+		return err
+	}
+
+	c.established = true
+
+	if !c.isClient {
+		c.SessionID = remote.SessionID
+		if c.App.attachSession(c) {
+			c.Log.Info("Peer %s resumed its session in /%s", c.RemoteName, c.cwd)
+		}
+	}
+
+	c.Log.Debug("Peer %s runs version %s (protocol %d, node %s)",
+		c.RemoteName, c.RemoteVersion, remote.ProtocolVersion, c.RemoteNodeID)
+	c.Log.Debug("Negotiated capabilities: %s", strings.Join(c.CapabilityList(), ", "))
+	return nil
+}
+
+func (c *Connection) verifyPeerIdentity() error {
+	if c.RemoteNodeID == "" {
+		return fmt.Errorf("peer did not send a node ID")
+	}
+
+	trust, previous, err := c.App.KnownPeers.Check(c.RemoteNodeID, c.RemoteName, c.dialAddr, c.RemoteFingerprint)
+	if err != nil {
+		c.Log.Warn("Failed to update known peers: %v", err)
+	}
+
+	switch trust {
+	case PeerTrustKnown:
+		c.Log.Debug("Peer %s matches pinned fingerprint %s", c.RemoteName, c.RemoteFingerprint)
+	case PeerTrustNew:
+		c.Log.Warn("Permanently added peer %s (%s) with fingerprint %s to known peers",
+			c.RemoteName, c.RemoteNodeID, c.RemoteFingerprint)
+	case PeerTrustChanged:
+		c.Log.Error("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+		c.Log.Error("@    WARNING: PEER IDENTIFICATION HAS CHANGED!            @")
+		c.Log.Error("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+		c.Log.Error("Someone could be eavesdropping on you right now (man-in-the-middle attack)!")
+		c.Log.Error("It is also possible that peer %s simply regenerated its certificate.", c.RemoteName)
+		c.Log.Error("Node ID:              %s", c.RemoteNodeID)
+		if previous.NodeID != c.RemoteNodeID {
+			c.Log.Error("Pinned node ID:       %s (same name or address)", previous.NodeID)
+		}
+		c.Log.Error("Pinned fingerprint:   %s", previous.Fingerprint)
+		c.Log.Error("Received fingerprint: %s", c.RemoteFingerprint)
+		c.Log.Error("If this change is expected, remove the line for node %s from %s",
+			previous.NodeID, c.App.KnownPeers.path)
+		return fmt.Errorf("fingerprint mismatch for peer %s", c.RemoteName)
+	}
+
+	return nil
+}
+
+func (c *Connection) PeerLabel() string {
+	if c.RemoteName == "" {
+		return fmt.Sprintf("[%d] %s", c.PeerID, c.ID)
+	}
+	return fmt.Sprintf("[%d] %s", c.PeerID, c.RemoteName)
+}
+
+func (c *Connection) checkTransferProtocol() error {
+	if c.ProtocolVersion < TransferProtocolVersion {
+		return refusedf("peer %s speaks protocol %d, file transfers need protocol %d or newer",
+			c.RemoteName, c.ProtocolVersion, TransferProtocolVersion)
+	}
 	return nil
 }
 
+func (c *Connection) HasCapability(name string) bool {
+	return c.Capabilities[name]
+}
+
+func (c *Connection) localCapabilities() []string {
+	var caps []string
+	for _, name := range SupportedCapabilities {
+		if name == CapCompression && !c.App.Config.Compress {
+			continue
+		}
+		if name == CapDedup && !c.App.Config.Dedup {
+			continue
+		}
+		caps = append(caps, name)
+	}
+	return caps
+}
+
+func (c *Connection) CapabilityList() []string {
+	var caps []string
+	for _, name := range SupportedCapabilities {
+		if c.Capabilities[name] {
+			caps = append(caps, name)
+		}
+	}
+	return caps
+}
+
 func (c *Connection) Close() {
 	c.Conn.Close()
-	c.App.RemoveConnection(c)
-	c.Log.Info("Connection closed")
+	interrupted := c.App.AbortTransfers(c)
 
-	if c.isClient {
-		c.Log.Error("Lost connection to server, exiting...")
-		fmt.Println("\nDisconnected from server. Press Enter to exit.")
+	if c.canReconnect() {
+		c.Log.Warn("Lost connection to %s, reconnecting...", c.RemoteName)
+		go c.reconnect(interrupted)
+		return
+	}
 
-		time.Sleep(500 * time.Millisecond)
+	c.App.RemoveConnection(c)
+	c.App.detachSession(c)
+	c.Log.Info("Connection closed")
 
-		os.Exit(1)
+	for _, t := range interrupted {
+		if t.Type == TransferTypeReceive {
+			c.Log.Warn("Transfer of %s interrupted at %s, use RESUME %s to continue",
+				t.Name, util.FormatFileSize(t.BytesTransferred), t.Name)
+		}
 	}
 }
 
@@ -168,22 +412,29 @@ func (c *Connection) SendMessage(msg Message) error {
 	c.sendMutex.Lock()
 	defer c.sendMutex.Unlock()
 
-	data, err := msg.Marshal()
-	if err != nil {
-		return err
-	}
-
 	c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 	defer c.Conn.SetWriteDeadline(time.Time{})
 
-	_, err = c.Writer.WriteString(string(data) + "\n")
-	if err != nil {
-		c.Log.Error("Failed to send message: %v", err)
-
-		if c.isClient {
-			c.Close()
+	var err error
+	if c.binaryFraming {
+		var frame Frame
+		frame, err = EncodeMessageFrame(msg)
+		if err != nil {
+			return err
 		}
+		err = WriteFrame(c.Writer, frame)
+	} else {
+		var data []byte
+		data, err = msg.Marshal()
+		if err != nil {
+			return err
+		}
+		_, err = c.Writer.WriteString(string(data) + "\n")
+	}
 
+	if err != nil {
+		c.Log.Error("Failed to send message: %v", err)
+		c.Conn.Close()
 		return err
 	}
 
@@ -209,13 +460,7 @@ func (c *Connection) SendReliableMessage(msg Message) error {
 	return fmt.Errorf("failed to send message after %d attempts: %v", maxRetries, err)
 }
 
-func (c *Connection) handleMessage(messageStr string) {
-	var msg Message
-	if err := json.Unmarshal([]byte(messageStr), &msg); err != nil {
-		c.Log.Error("Invalid message format: %v", err)
-		return
-	}
-
+func (c *Connection) handleMessage(msg Message) {
 	if msg.ID != "" {
 		c.responseHandlerMu.Lock()
 		handler, exists := c.responseHandlers[msg.ID]
@@ -236,6 +481,12 @@ func (c *Connection) handleMessage(messageStr string) {
 		c.handleFileData(msg)
 	case MsgTypeFileEnd:
 		c.handleFileEnd(msg)
+	case MsgTypeRangeEnd:
+		c.handleRangeEnd(msg)
+	case MsgTypeDelta:
+		c.handleDelta(msg)
+	case MsgTypeChunks:
+		c.handleChunks(msg)
 	case MsgTypeProgress:
 		c.handleProgress(msg)
 	case MsgTypeACK:
@@ -252,6 +503,12 @@ func (c *Connection) handleMessage(messageStr string) {
 }
 
 func (c *Connection) handleCommand(msg Message) {
+	if !c.authenticated {
+		c.Log.Warn("Dropping command from unauthenticated peer")
+		c.Conn.Close()
+		return
+	}
+
 	cmd := ParseCommand(msg.Data)
 	if cmd == nil {
 		errorMsg := Message{
@@ -267,6 +524,16 @@ func (c *Connection) handleCommand(msg Message) {
 
 	var response Message
 
+	switch cmd.Name {
+	case "GET", "PUT", "GETDIR", "PUTDIR", "GETM", "PUTM":
+		if err := c.checkTransferProtocol(); err != nil {
+			response = errorMessage(err)
+			response.ID = msg.ID
+			c.SendMessage(response)
+			return
+		}
+	}
+
 	switch cmd.Name {
 	case "LS", "LIST", "LSR":
 		response = c.handleListCommand(cmd)
@@ -288,6 +555,16 @@ func (c *Connection) handleCommand(msg Message) {
 		response = c.handlePutMultipleCommand(cmd)
 	case "STATUS":
 		response = c.handleStatusCommand(cmd)
+	case "MANIFEST":
+		baseDir := c.sessionDir()
+		go func() {
+			response := c.handleManifestCommand(baseDir, cmd)
+			response.ID = msg.ID
+			c.SendMessage(response)
+		}()
+		return
+	case "REMOVE":
+		response = c.handleRemoveCommand(cmd)
 	default:
 		response = Message{
 			Type: MsgTypeError,
@@ -307,6 +584,15 @@ func (c *Connection) SendError(errorMsg string) error {
 	return c.SendMessage(msg)
 }
 
+func (c *Connection) sendTransferError(msg Message, errorMsg string) error {
+	return c.SendMessage(Message{
+		Type:       MsgTypeError,
+		Data:       errorMsg,
+		ID:         msg.ID,
+		TransferID: msg.TransferID,
+	})
+}
+
 func (c *Connection) handleCDCommand(cmd *Command) Message {
 	if len(cmd.Args) < 1 {
 		return Message{
@@ -317,15 +603,14 @@ func (c *Connection) handleCDCommand(cmd *Command) Message {
 
 	path := cmd.Args[0]
 
-	if !isPathSafe(path, c.App.Config.Folder) {
+	relPath, fullPath, err := c.resolveSessionPath(path)
+	if err != nil {
 		return Message{
 			Type: MsgTypeError,
 			Data: "Access denied: path is outside the shared folder",
 		}
 	}
 
-	fullPath := filepath.Join(c.App.Config.Folder, path)
-
 	info, err := os.Stat(fullPath)
 	if os.IsNotExist(err) {
 		return Message{
@@ -334,23 +619,18 @@ func (c *Connection) handleCDCommand(cmd *Command) Message {
 		}
 	}
 
-	if !info.IsDir() {
+	if err != nil || !info.IsDir() {
 		return Message{
 			Type: MsgTypeError,
 			Data: fmt.Sprintf("Not a directory: %s", path),
 		}
 	}
 
-	c.App.Config.Folder = fullPath
-
-	ignoreList, _ := util.LoadIgnoreFile(c.App.Config.Folder)
-	if ignoreList != nil {
-		c.ignoreList = ignoreList
-	}
+	c.cwd = relPath
 
 	return Message{
 		Type: MsgTypeCommandResult,
-		Data: fmt.Sprintf("Changed to %s", path),
+		Data: fmt.Sprintf("Changed to /%s", relPath),
 	}
 }
 
@@ -361,111 +641,25 @@ func (c *Connection) handleListCommand(cmd *Command) Message {
 		path = cmd.Args[0]
 	}
 
-	c.Log.Debug("Listing files for path: '%s', base folder: '%s'", path, c.App.Config.Folder)
-
-	if path == "." || path == "" {
-		c.Log.Debug("Using base folder directly: %s", c.App.Config.Folder)
-
-		files, err := os.ReadDir(c.App.Config.Folder)
-		if err != nil {
-			return Message{
-				Type: MsgTypeError,
-				Data: fmt.Sprintf("Failed to list base directory: %v", err),
-			}
-		}
-
-		c.loadIgnoreList()
-
-		var resultFiles []string
-		recursive := cmd.Name == "LSR"
-
-		for _, entry := range files {
-			name := entry.Name()
-
-			if name == ".p2pignore" {
-				continue
-			}
-
-			if !c.ignoreList.ShouldIgnore(name, entry.IsDir()) {
-				if entry.IsDir() {
-					resultFiles = append(resultFiles, name+"/")
-				} else {
-					info, err := entry.Info()
-					if err == nil {
-						size := util.FormatFileSize(info.Size())
-						resultFiles = append(resultFiles, fmt.Sprintf("%-40s %10s", name, size))
-					} else {
-						resultFiles = append(resultFiles, name)
-					}
-				}
-
-				if recursive && entry.IsDir() {
-					subpath := filepath.Join(c.App.Config.Folder, name)
-					subfiles, err := util.ListFilesRecursive(subpath)
-					if err != nil {
-						continue
-					}
-
-					for _, subfile := range subfiles {
-						relPath, err := filepath.Rel(c.App.Config.Folder, subfile)
-						if err != nil {
-							continue
-						}
-
-						if filepath.Base(subfile) == ".p2pignore" {
-							continue
-						}
-
-						if !c.ignoreList.ShouldIgnore(relPath, false) {
-							info, err := os.Stat(subfile)
-							if err == nil && !info.IsDir() {
-								size := util.FormatFileSize(info.Size())
-								resultFiles = append(resultFiles, fmt.Sprintf("%-40s %10s", relPath, size))
-							}
-						}
-					}
-				}
-			}
-		}
-
-		if len(resultFiles) == 0 {
-			return Message{
-				Type: MsgTypeCommandResult,
-				Data: "Contents of .: (empty or all files are ignored)",
-			}
-		}
-
-		result := fmt.Sprintf("Contents of .:\n%s", strings.Join(resultFiles, "\n"))
+	relDir, targetPath, err := c.resolveSessionPath(path)
+	if err != nil {
 		return Message{
-			Type: MsgTypeCommandResult,
-			Data: result,
+			Type: MsgTypeError,
+			Data: "Access denied: path is outside the shared folder",
 		}
 	}
 
-	normalizedPath := util.NormalizePath(path)
-	c.Log.Debug("Normalized path: '%s'", normalizedPath)
+	displayPath := "/" + relDir
 
-	targetPath := filepath.Join(c.App.Config.Folder, normalizedPath)
-	targetPath = filepath.Clean(targetPath)
-	c.Log.Debug("Target path: '%s'", targetPath)
+	c.Log.Debug("Listing files for path: '%s', share root: '%s'", relDir, c.App.Root)
 
-	_, err := os.Stat(targetPath)
-	if err != nil {
+	if _, err := os.Stat(targetPath); err != nil {
 		return Message{
 			Type: MsgTypeError,
 			Data: fmt.Sprintf("Path not found: %v", err),
 		}
 	}
 
-	absBase, _ := filepath.Abs(c.App.Config.Folder)
-	absTarget, _ := filepath.Abs(targetPath)
-	if !strings.HasPrefix(absTarget, absBase) {
-		return Message{
-			Type: MsgTypeError,
-			Data: "Access denied: path is outside the shared folder",
-		}
-	}
-
 	fileEntries, err := os.ReadDir(targetPath)
 	if err != nil {
 		return Message{
@@ -476,76 +670,69 @@ func (c *Connection) handleListCommand(cmd *Command) Message {
 
 	c.loadIgnoreList()
 
+	recursive := cmd.Name == "LSR"
+
 	var filteredFiles []string
 	for _, entry := range fileEntries {
 		name := entry.Name()
 
-		if name == ".p2pignore" {
+		if name == ".p2pignore" || isPartFile(name) {
 			continue
 		}
 
-		relativePath := filepath.Join(normalizedPath, name)
 		isDir := entry.IsDir()
+		if c.ignoreList.ShouldIgnore(c.rootRelative(filepath.Join(targetPath, name)), isDir) {
+			continue
+		}
 
-		if !c.ignoreList.ShouldIgnore(relativePath, isDir) {
-			if isDir {
-				filteredFiles = append(filteredFiles, name+"/")
+		if isDir {
+			filteredFiles = append(filteredFiles, name+"/")
+		} else {
+			info, err := entry.Info()
+			if err == nil {
+				size := util.FormatFileSize(info.Size())
+				filteredFiles = append(filteredFiles, fmt.Sprintf("%-40s %10s", name, size))
 			} else {
-				info, err := entry.Info()
-				if err == nil {
-					size := util.FormatFileSize(info.Size())
-					filteredFiles = append(filteredFiles, fmt.Sprintf("%-40s %10s", name, size))
-				} else {
-					filteredFiles = append(filteredFiles, name)
-				}
+				filteredFiles = append(filteredFiles, name)
 			}
 		}
-	}
 
-	recursive := cmd.Name == "LSR"
-	if recursive {
-		for _, entry := range fileEntries {
-			if !entry.IsDir() {
+		if !recursive || !isDir {
+			continue
+		}
+
+		subfiles, err := util.ListFilesRecursive(filepath.Join(targetPath, name))
+		if err != nil {
+			continue
+		}
+
+		for _, subfile := range subfiles {
+			if filepath.Base(subfile) == ".p2pignore" || isPartFile(subfile) {
 				continue
 			}
 
-			subpath := filepath.Join(targetPath, entry.Name())
-			subfiles, err := util.ListFilesRecursive(subpath)
-			if err != nil {
+			if c.ignoreList.ShouldIgnore(c.rootRelative(subfile), false) {
 				continue
 			}
 
-			for _, subfile := range subfiles {
-				relPath, err := filepath.Rel(c.App.Config.Folder, subfile)
-				if err != nil {
-					continue
-				}
-
-				if filepath.Base(subfile) == ".p2pignore" {
-					continue
-				}
-
-				if !c.ignoreList.ShouldIgnore(relPath, false) {
-					info, err := os.Stat(subfile)
-					if err == nil && !info.IsDir() {
-						subRelPath, _ := filepath.Rel(targetPath, subfile)
-						size := util.FormatFileSize(info.Size())
-						filteredFiles = append(filteredFiles, fmt.Sprintf("%-40s %10s", subRelPath, size))
-					}
-				}
+			info, err := os.Stat(subfile)
+			if err == nil && !info.IsDir() {
+				subRelPath, _ := filepath.Rel(targetPath, subfile)
+				size := util.FormatFileSize(info.Size())
+				filteredFiles = append(filteredFiles, fmt.Sprintf("%-40s %10s", subRelPath, size))
 			}
 		}
 	}
 
 	if len(filteredFiles) == 0 {
-		result := fmt.Sprintf("Contents of %s: (empty or all files are ignored)", normalizedPath)
+		result := fmt.Sprintf("Contents of %s: (empty or all files are ignored)", displayPath)
 		return Message{
 			Type: MsgTypeCommandResult,
 			Data: result,
 		}
 	}
 
-	result := fmt.Sprintf("Contents of %s:\n%s", normalizedPath, strings.Join(filteredFiles, "\n"))
+	result := fmt.Sprintf("Contents of %s:\n%s", displayPath, strings.Join(filteredFiles, "\n"))
 	return Message{
 		Type: MsgTypeCommandResult,
 		Data: result,
@@ -563,85 +750,98 @@ func (c *Connection) canInitiateTransfer() bool {
 		}
 	}
 
-	return activeCount < 3
+	return activeCount < max(1, c.App.Config.Concurrent)
 }
 
 func (c *Connection) handleGetCommand(cmd *Command) Message {
-	if len(cmd.Args) < 1 {
-		return Message{
-			Type: MsgTypeError,
-			Data: "GET requires a file path",
-		}
+	args, dir, err := c.parseDirFlag(cmd.Args)
+	if err != nil {
+		return errorMessage(err)
 	}
 
+	return c.sendFile(filepath.Join(c.App.Root, filepath.FromSlash(dir)), &Command{Name: cmd.Name, Args: args})
+}
+
+func (c *Connection) validateSend(baseDir, name string) (string, string, os.FileInfo, error) {
 	if !c.canInitiateTransfer() {
-		return Message{
-			Type: MsgTypeError,
-			Data: "Too many active transfers, please wait for current transfers to complete",
-		}
+		return "", "", nil, &commandError{Code: ErrCodeBusy, Message: "Too many active transfers, please wait for current transfers to complete"}
 	}
 
-	filePath := util.NormalizePath(cmd.Args[0])
+	filePath := util.NormalizePath(name)
 
 	if !util.IsValidRelativePath(filePath) {
-		return Message{
-			Type: MsgTypeError,
-			Data: fmt.Sprintf("Invalid path: %s (contains invalid characters or points to a parent directory)", filePath),
-		}
+		return "", "", nil, refusedf("Invalid path: %s (contains invalid characters or points to a parent directory)", filePath)
 	}
 
-	if !isPathSafe(filePath, c.App.Config.Folder) {
-		return Message{
-			Type: MsgTypeError,
-			Data: "Access denied: path is outside the shared folder",
-		}
+	if !isPathSafe(filePath, baseDir) {
+		return "", "", nil, refusedf("Access denied: path is outside the shared folder")
 	}
 
 	if c.App.Config.ReadOnly {
-		return Message{
-			Type: MsgTypeError,
-			Data: "This node is in read-only mode and cannot send files",
-		}
+		return "", "", nil, refusedf("This node is in read-only mode and cannot send files")
 	}
 
 	if filepath.Base(filePath) == ".p2pignore" {
-		return Message{
-			Type: MsgTypeError,
-			Data: "The .p2pignore file cannot be transferred",
-		}
+		return "", "", nil, refusedf("The .p2pignore file cannot be transferred")
+	}
+
+	if isPartFile(filePath) {
+		return "", "", nil, refusedf("%s is an incomplete download and cannot be transferred", filePath)
 	}
 
-	fullPath := filepath.Join(c.App.Config.Folder, filePath)
+	fullPath := filepath.Join(baseDir, filePath)
 
 	c.loadIgnoreList()
 
 	fileInfo, err := os.Stat(fullPath)
-	if err == nil && c.ignoreList.ShouldIgnore(filePath, fileInfo.IsDir()) {
-		return Message{
-			Type: MsgTypeError,
-			Data: fmt.Sprintf("File %s is in .p2pignore list and cannot be transferred", filePath),
-		}
+	if err == nil && c.ignoreList.ShouldIgnore(c.rootRelative(fullPath), fileInfo.IsDir()) {
+		return "", "", nil, refusedf("File %s is excluded by the share filters and cannot be transferred", filePath)
 	}
 
 	info, err := os.Stat(fullPath)
 	if err != nil {
-		return Message{
-			Type: MsgTypeError,
-			Data: fmt.Sprintf("File not found: %v", err),
-		}
+		return "", "", nil, refusedf("File not found: %v", err)
 	}
 
 	if info.IsDir() {
-		return Message{
-			Type: MsgTypeError,
-			Data: "GET cannot transfer directories, use GETDIR instead",
-		}
+		return "", "", nil, refusedf("GET cannot transfer directories, use GETDIR instead")
+	}
+
+	if _, ok := resolveWithin(c.App.Root, fullPath); !ok {
+		return "", "", nil, refusedf("Access denied: %s points outside the shared folder", filePath)
 	}
 
 	if c.App.Config.MaxSize > 0 && info.Size() > int64(c.App.Config.MaxSize*1024*1024) {
+		return "", "", nil, refusedf("File size exceeds maximum allowed size of %d MB", c.App.Config.MaxSize)
+	}
+
+	return filePath, fullPath, info, nil
+}
+
+func (c *Connection) sendFile(baseDir string, cmd *Command) Message {
+	args, signature := parseDeltaFlag(cmd.Args)
+	cmd = &Command{Name: cmd.Name, Args: args}
+
+	if len(cmd.Args) < 1 {
 		return Message{
 			Type: MsgTypeError,
-			Data: fmt.Sprintf("File size exceeds maximum allowed size of %d MB", c.App.Config.MaxSize),
+			Data: "GET requires a file path",
+		}
+	}
+
+	filePath, fullPath, info, err := c.validateSend(baseDir, cmd.Args[0])
+	if err != nil {
+		return errorMessage(err)
+	}
+
+	var offset int64
+	if len(cmd.Args) >= 3 {
+		offset, err = util.ParseInt64(cmd.Args[1])
+		if err != nil || offset < 0 || offset > info.Size() {
+			return Message{
+				Type: MsgTypeError,
+				Data: fmt.Sprintf("Invalid resume offset: %s", cmd.Args[1]),
+			}
 		}
 	}
 
@@ -655,14 +855,117 @@ func (c *Connection) handleGetCommand(cmd *Command) Message {
 
 	transfer := NewFileTransfer(filePath, info.Size(), TransferTypeSend, c)
 	transfer.File = file
-	c.App.AddTransfer(transfer)
+	transfer.BaseDir = baseDir
+	transfer.Window = newFlowWindow()
+
+	if offset > 0 {
+		_, err := io.CopyN(transfer.Hash, file, offset)
+		if err != nil || fmt.Sprintf("%x", transfer.Hash.Sum(nil)) != cmd.Args[2] {
+			c.Log.Warn("Partial copy of %s does not match, restarting from the beginning", filePath)
+			offset = 0
+			transfer.Hash.Reset()
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				file.Close()
+				return Message{
+					Type: MsgTypeError,
+					Data: fmt.Sprintf("Failed to rewind file: %v", err),
+				}
+			}
+		} else {
+			c.Log.Info("Resuming %s from %s", filePath, util.FormatFileSize(offset))
+		}
+	}
+
+	var sig *blockSignature
+	if signature != "" && offset == 0 && c.HasCapability(CapDelta) {
+		sig, err = parseSignature(signature)
+		if err != nil {
+			c.Log.Warn("Ignoring invalid delta request for %s: %v", filePath, err)
+		}
+	}
+
+	transfer.Offset = offset
+	transfer.BytesTransferred = offset
+	transfer.Dedup = sig == nil && offset == 0 && c.wantsDedup(info.Size())
+	transfer.Delta = sig != nil || transfer.Dedup
+	if count := c.transferRanges(info.Size(), offset); count > 1 && !transfer.Delta {
+		transfer.Ranges = splitRanges(info.Size(), count)
+	}
+	transfer.Compressed = c.shouldCompress(file, offset, info.Size())
+	if err := c.App.AddTransfer(transfer); err != nil {
+		file.Close()
+		return Message{
+			Type: MsgTypeError,
+			Data: err.Error(),
+		}
+	}
+
+	ackChan := make(chan bool, 1)
+	failChan := make(chan string, 1)
+	needChan := make(chan string, 1)
+	ackID := fmt.Sprintf("ack-%d-%d", transfer.WireID, time.Now().UnixNano())
+
+	c.RegisterResponseHandler(ackID, func(msg Message) {
+		if msg.TransferID != transfer.WireID {
+			return
+		}
+
+		switch {
+		case msg.Type == MsgTypeACK && strings.HasPrefix(msg.Data, AckChunk+"|"):
+			if offset, err := util.ParseInt64(strings.TrimPrefix(msg.Data, AckChunk+"|")); err == nil {
+				transfer.Window.Ack(offset)
+			}
+		case msg.Type == MsgTypeACK && strings.HasPrefix(msg.Data, AckDone+"|"):
+			select {
+			case ackChan <- true:
+			default:
+			}
+		case msg.Type == MsgTypeACK && strings.HasPrefix(msg.Data, AckResume+"|"):
+			transfer.Window.Rewind()
+		case msg.Type == MsgTypeACK && strings.HasPrefix(msg.Data, AckNeed+"|"):
+			select {
+			case needChan <- msg.Data:
+			default:
+			}
+		case msg.Type == MsgTypeACK && strings.HasPrefix(msg.Data, AckSkip+"|"):
+			transfer.Skipped = skipReason(msg.Data)
+			transfer.Status = TransferStatusFailed
+			select {
+			case failChan <- transfer.Skipped:
+			default:
+			}
+		case msg.Type == MsgTypeError:
+			transfer.Status = TransferStatusFailed
+			select {
+			case failChan <- msg.Data:
+			default:
+			}
+		}
+	})
+
+	var compression string
+	if transfer.Compressed {
+		compression = CompressionGzip
+		c.Log.Debug("Compressing %s with %s", filePath, CompressionGzip)
+	}
+
+	var mode string
+	if transfer.Dedup {
+		mode = dedupMode
+	} else if transfer.Delta {
+		mode = deltaMode
+	}
 
 	startMsg := Message{
 		Type: MsgTypeFileStart,
-		Data: fmt.Sprintf("%s|%d", filePath, info.Size()),
+		Data: fmt.Sprintf("%s|%d|%d|%d|%s|%s|%s|%s", filePath, info.Size(), offset, max(1, len(transfer.Ranges)),
+			compression, readMetadata(fullPath, info, c.App.Config.Xattrs).encode(), transfer.Overwrite, mode),
+		ID:         ackID,
+		TransferID: transfer.WireID,
 	}
 	if err := c.SendReliableMessage(startMsg); err != nil {
 		file.Close()
+		c.UnregisterResponseHandler(ackID)
 		c.App.RemoveTransfer(transfer)
 		return Message{
 			Type: MsgTypeError,
@@ -673,99 +976,56 @@ func (c *Connection) handleGetCommand(cmd *Command) Message {
 	go func() {
 		defer c.App.RemoveTransfer(transfer)
 		defer file.Close()
-
-		buffer := make([]byte, 1048576)
-		totalSent := int64(0)
-		startTime := time.Now()
-		lastProgressUpdate := startTime
-		lastProgressBytes := int64(0)
-
-		ackChan := make(chan bool, 1)
-		ackID := fmt.Sprintf("ack-%s-%d", filePath, time.Now().UnixNano())
-
-		c.RegisterResponseHandler(ackID, func(msg Message) {
-			if msg.Type == MsgTypeACK && msg.Data == filePath {
-				select {
-				case ackChan <- true:
-				default:
-				}
-			}
-		})
 		defer c.UnregisterResponseHandler(ackID)
 
-		chunkCount := 0
-		for {
-			if transfer.Status == TransferStatusPaused {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-
-			if transfer.Status == TransferStatusFailed {
-				return
-			}
+		stopRetransmit := make(chan struct{})
+		defer close(stopRetransmit)
+		go c.retransmitLoop(transfer, ackID, stopRetransmit)
 
-			n, err := file.Read(buffer)
-			if err != nil && err != io.EOF {
+		if transfer.Dedup {
+			if err := c.sendChunkList(transfer, ackID, needChan); err != nil {
 				transfer.Status = TransferStatusFailed
-				c.SendError(fmt.Sprintf("Failed to read file: %v", err))
+				transfer.Window.Close()
+				c.Log.Error("Failed to send chunk list of %s: %v", filePath, err)
+				c.SendError(fmt.Sprintf("Failed to send %s: %v", filePath, err))
 				return
 			}
-
-			if n == 0 {
-				break
-			}
-
-			dataMsg := NewBinaryMessage(MsgTypeFileData, buffer[:n])
-			dataMsg.ID = ackID
-			if err := c.SendMessage(dataMsg); err != nil {
+		} else if transfer.Delta {
+			if err := c.sendDelta(transfer, sig, ackID); err != nil {
 				transfer.Status = TransferStatusFailed
-				c.Log.Error("Failed to send file data: %v", err)
+				transfer.Window.Close()
+				c.Log.Error("Failed to send delta of %s: %v", filePath, err)
+				c.SendError(fmt.Sprintf("Failed to send %s: %v", filePath, err))
 				return
 			}
+		}
 
-			totalSent += int64(n)
-			transfer.BytesTransferred = totalSent
-			chunkCount++
-
-			currentTime := time.Now()
-			timeSinceLastUpdate := currentTime.Sub(lastProgressUpdate).Seconds()
-
-			if timeSinceLastUpdate >= 1.0 || totalSent == info.Size() {
-				elapsedTime := currentTime.Sub(startTime).Seconds()
-				var currentSpeed float64
-
-				if timeSinceLastUpdate > 0 {
-					bytesThisInterval := totalSent - lastProgressBytes
-					currentSpeed = float64(bytesThisInterval) / timeSinceLastUpdate / 1024
-				} else if elapsedTime > 0 {
-					currentSpeed = float64(totalSent) / elapsedTime / 1024
-				}
-
-				if currentSpeed < 0 {
-					currentSpeed = 0
-				}
-
-				transfer.UpdateProgress(totalSent, currentSpeed)
-				lastProgressUpdate = currentTime
-				lastProgressBytes = totalSent
-
-				progMsg := Message{
-					Type: MsgTypeProgress,
-					Data: fmt.Sprintf("%s|%d|%d|%.2f", filePath, totalSent, info.Size(), currentSpeed),
-					ID:   ackID,
-				}
-				c.SendMessage(progMsg)
-			}
+		var ok bool
+		if len(transfer.Ranges) > 0 || transfer.Delta {
+			ok = c.streamRanges(transfer, ackID, failChan)
+		} else {
+			ok = c.streamFile(transfer, ackID, failChan)
+		}
 
-			if chunkCount%10 == 0 {
-				time.Sleep(1 * time.Millisecond)
+		if !ok {
+			transfer.Window.Close()
+			if transfer.Skipped != "" {
+				transfer.Status = TransferStatusSkipped
 			}
+			return
 		}
 
+		window, rtt := transfer.Window.Stats()
+		c.Log.Debug("Flow window for %s settled at %d chunks (RTT %v)", filePath, window, rtt.Round(time.Millisecond))
+
 		endMsg := Message{
-			Type: MsgTypeFileEnd,
-			Data: filePath,
-			ID:   ackID,
+			Type:       MsgTypeFileEnd,
+			Data:       filePath,
+			ID:         ackID,
+			TransferID: transfer.WireID,
+		}
+		if c.HasCapability(CapChecksum) && (len(transfer.Ranges) == 0 || transfer.Delta) {
+			endMsg.Data = fmt.Sprintf("%s|%x", filePath, transfer.Hash.Sum(nil))
 		}
 		if err := c.SendReliableMessage(endMsg); err != nil {
 			transfer.Status = TransferStatusFailed
@@ -780,6 +1040,15 @@ func (c *Connection) handleGetCommand(cmd *Command) Message {
 			transfer.Status = TransferStatusComplete
 			fmt.Printf("\n")
 			c.Log.Success("Transfer completed and acknowledged: %s", filePath)
+		case reason := <-failChan:
+			fmt.Printf("\n")
+			if transfer.Skipped != "" {
+				transfer.Status = TransferStatusSkipped
+				c.Log.Info("%s skipped %s: %s", c.RemoteName, filePath, transfer.Skipped)
+				return
+			}
+			transfer.Status = TransferStatusFailed
+			c.Log.Error("Transfer rejected by receiver: %s (%s)", filePath, reason)
 		case <-time.After(30 * time.Second):
 			transfer.Status = TransferStatusFailed
 			fmt.Printf("\n")
@@ -793,6 +1062,104 @@ func (c *Connection) handleGetCommand(cmd *Command) Message {
 	}
 }
 
+func (c *Connection) streamFile(transfer *FileTransfer, ackID string, failChan chan string) bool {
+	buffer := make([]byte, 1048576)
+	totalSent := transfer.Offset
+	startTime := time.Now()
+	lastProgressUpdate := startTime
+	lastProgressBytes := transfer.Offset
+
+	for {
+		if transfer.Status == TransferStatusPaused {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if transfer.Status == TransferStatusFailed {
+			c.reportStopped(transfer, failChan)
+			return false
+		}
+
+		n, err := transfer.File.Read(buffer)
+		if err != nil && err != io.EOF {
+			transfer.Status = TransferStatusFailed
+			c.SendError(fmt.Sprintf("Failed to read file: %v", err))
+			return false
+		}
+
+		if n == 0 {
+			break
+		}
+
+		transfer.Hash.Write(buffer[:n])
+
+		if !transfer.Window.Acquire(totalSent, n) {
+			c.reportStopped(transfer, failChan)
+			return false
+		}
+
+		if err := c.sendData(transfer, ackID, totalSent, buffer[:n]); err != nil {
+			transfer.Status = TransferStatusFailed
+			c.Log.Error("Failed to send file data: %v", err)
+			return false
+		}
+
+		totalSent += int64(n)
+		transfer.BytesTransferred = totalSent
+
+		currentTime := time.Now()
+		timeSinceLastUpdate := currentTime.Sub(lastProgressUpdate).Seconds()
+
+		if timeSinceLastUpdate >= 1.0 || totalSent == transfer.TotalSize {
+			elapsedTime := currentTime.Sub(startTime).Seconds()
+			var currentSpeed float64
+
+			if timeSinceLastUpdate > 0 {
+				bytesThisInterval := totalSent - lastProgressBytes
+				currentSpeed = float64(bytesThisInterval) / timeSinceLastUpdate / 1024
+			} else if elapsedTime > 0 {
+				currentSpeed = float64(totalSent-transfer.Offset) / elapsedTime / 1024
+			}
+
+			if currentSpeed < 0 {
+				currentSpeed = 0
+			}
+
+			transfer.UpdateProgress(totalSent, currentSpeed)
+			lastProgressUpdate = currentTime
+			lastProgressBytes = totalSent
+
+			progMsg := Message{
+				Type:       MsgTypeProgress,
+				Data:       fmt.Sprintf("%s|%d|%d|%.2f", transfer.Name, totalSent, transfer.TotalSize, currentSpeed),
+				ID:         ackID,
+				TransferID: transfer.WireID,
+			}
+			c.SendMessage(progMsg)
+		}
+	}
+
+	if !transfer.Window.Drain() {
+		c.reportStopped(transfer, failChan)
+		return false
+	}
+
+	return true
+}
+
+func (c *Connection) reportStopped(transfer *FileTransfer, failChan chan string) {
+	select {
+	case reason := <-failChan:
+		fmt.Printf("\n")
+		if transfer.Skipped != "" {
+			c.Log.Info("%s skipped %s: %s", c.RemoteName, transfer.Name, transfer.Skipped)
+			return
+		}
+		c.Log.Warn("Transfer stopped by receiver: %s (%s)", transfer.Name, reason)
+	default:
+	}
+}
+
 func (c *Connection) handlePutCommand(cmd *Command) Message {
 	if len(cmd.Args) < 1 {
 		return Message{
@@ -802,27 +1169,35 @@ func (c *Connection) handlePutCommand(cmd *Command) Message {
 	}
 
 	if c.App.Config.WriteOnly {
-		return Message{
-			Type: MsgTypeError,
-			Data: "This node is in write-only mode and cannot receive files",
-		}
+		return errorMessage(refusedf("This node is in write-only mode and cannot receive files"))
 	}
 
 	if !c.canInitiateTransfer() {
+		return errorMessage(&commandError{Code: ErrCodeBusy, Message: "Too many active transfers, please wait for current transfers to complete"})
+	}
+
+	args, dir, err := c.parseDirFlag(cmd.Args)
+	if err != nil {
+		return errorMessage(err)
+	}
+	if len(args) < 1 {
 		return Message{
 			Type: MsgTypeError,
-			Data: "Too many active transfers, please wait for current transfers to complete",
+			Data: "PUT requires a file path",
 		}
 	}
 
-	filePath := cmd.Args[0]
+	filePath := args[0]
 	if !util.IsValidRelativePath(filePath) {
-		return Message{
-			Type: MsgTypeError,
-			Data: "Invalid path: path contains invalid characters or points to a parent directory",
-		}
+		return errorMessage(refusedf("Invalid path: path contains invalid characters or points to a parent directory"))
+	}
+
+	if c.App.reservedPath(filepath.Join(c.App.Root, filepath.FromSlash(dir), filePath)) {
+		return errorMessage(refusedf("%s is reserved for this node's own files and cannot be received", filePath))
 	}
 
+	c.expectUploadIn(dir, filePath, false)
+
 	return Message{
 		Type: MsgTypeCommandResult,
 		Data: "Ready to receive file",
@@ -831,7 +1206,9 @@ func (c *Connection) handlePutCommand(cmd *Command) Message {
 
 func (c *Connection) handleInfoCommand(_ *Command) Message {
 	info := fmt.Sprintf("Node: %s\n", c.Name)
-	info += fmt.Sprintf("Folder: %s\n", c.App.Config.Folder)
+	info += fmt.Sprintf("Node ID: %s\n", c.App.NodeID)
+	info += fmt.Sprintf("Version: %s (protocol %d)\n", SoftwareVersion, ProtocolVersion)
+	info += fmt.Sprintf("Folder: %s\n", c.sessionDir())
 	info += fmt.Sprintf("Read-only: %t\n", c.App.Config.ReadOnly)
 	info += fmt.Sprintf("Write-only: %t\n", c.App.Config.WriteOnly)
 	if c.App.Config.MaxSize > 0 {
@@ -840,14 +1217,19 @@ func (c *Connection) handleInfoCommand(_ *Command) Message {
 		info += "Max file size: Unlimited\n"
 	}
 
+	c.loadIgnoreList()
+
 	if len(c.ignoreList.Patterns) > 0 {
 		info += fmt.Sprintf("\nIgnore patterns (%d):\n", len(c.ignoreList.Patterns))
 		for _, pattern := range c.ignoreList.Patterns {
-			if pattern.IsDir {
-				info += fmt.Sprintf("  %s/ (directory)\n", pattern.Pattern)
-			} else {
-				info += fmt.Sprintf("  %s\n", pattern.Pattern)
-			}
+			info += fmt.Sprintf("  %s\n", describeIgnorePattern(pattern))
+		}
+	}
+
+	if len(c.ignoreList.PeerPatterns) > 0 {
+		info += fmt.Sprintf("\nFilter patterns for %s (%d):\n", c.RemoteName, len(c.ignoreList.PeerPatterns))
+		for _, pattern := range c.ignoreList.PeerPatterns {
+			info += fmt.Sprintf("  %s\n", describeIgnorePattern(pattern))
 		}
 	}
 
@@ -861,23 +1243,7 @@ func (c *Connection) handleGetDirCommand(cmd *Command) Message {
 	if len(cmd.Args) < 1 {
 		return Message{
 			Type: MsgTypeError,
-			Data: "GETDIR requires a directory path",
-		}
-	}
-
-	dirPath := util.NormalizePath(cmd.Args[0])
-
-	if !util.IsValidRelativePath(dirPath) {
-		return Message{
-			Type: MsgTypeError,
-			Data: fmt.Sprintf("Invalid path: %s (contains invalid characters or points to a parent directory)", dirPath),
-		}
-	}
-
-	if !isPathSafe(dirPath, c.App.Config.Folder) {
-		return Message{
-			Type: MsgTypeError,
-			Data: "Access denied: path is outside the shared folder",
+			Data: "GETDIR requires a directory path",
 		}
 	}
 
@@ -888,101 +1254,118 @@ func (c *Connection) handleGetDirCommand(cmd *Command) Message {
 		}
 	}
 
-	fullPath := filepath.Join(c.App.Config.Folder, dirPath)
+	tree := len(cmd.Args) > 1 && cmd.Args[1] == "--tree"
 
-	info, err := os.Stat(fullPath)
+	files, err := c.listDirectory(c.sessionDir(), cmd.Args[0], tree)
 	if err != nil {
 		return Message{
 			Type: MsgTypeError,
-			Data: fmt.Sprintf("Directory not found: %v", err),
+			Data: err.Error(),
 		}
 	}
 
-	if !info.IsDir() {
-		return Message{
-			Type: MsgTypeError,
-			Data: "GETDIR can only transfer directories, use GET for files",
-		}
+	return Message{
+		Type: MsgTypeCommandResult,
+		Data: strings.Join(files, "\n"),
 	}
+}
 
-	c.loadIgnoreList()
+func (c *Connection) listDirectory(baseDir, dir string, tree bool) ([]string, error) {
+	dirPath := util.NormalizePath(dir)
 
-	allFiles, err := util.ListFilesRecursive(fullPath)
-	if err != nil {
-		return Message{
-			Type: MsgTypeError,
-			Data: fmt.Sprintf("Failed to list directory: %v", err),
-		}
+	if !util.IsValidRelativePath(dirPath) {
+		return nil, fmt.Errorf("Invalid path: %s (contains invalid characters or points to a parent directory)", dirPath)
 	}
 
-	var files []string
-	for _, file := range allFiles {
-		relPath := strings.TrimPrefix(file, c.App.Config.Folder)
-		relPath = strings.TrimPrefix(relPath, "/")
-		relPath = strings.TrimPrefix(relPath, "\\")
-
-		relPath = util.NormalizePath(relPath)
+	if !isPathSafe(dirPath, baseDir) {
+		return nil, fmt.Errorf("Access denied: path is outside the shared folder")
+	}
 
-		fileInfo, err := os.Stat(file)
-		if err != nil || fileInfo.IsDir() {
-			continue
-		}
+	fullPath := filepath.Join(baseDir, dirPath)
 
-		if filepath.Base(file) == ".p2pignore" {
-			continue
-		}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("Directory not found: %v", err)
+	}
 
-		if !c.ignoreList.ShouldIgnore(relPath, false) {
-			files = append(files, file)
-		}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("GETDIR can only transfer directories, use GET for files")
 	}
 
-	if len(files) == 0 {
-		return Message{
-			Type: MsgTypeCommandResult,
-			Data: fmt.Sprintf("No transferable files found in directory %s (empty or all files ignored)", dirPath),
-		}
+	entries, err := c.walkDirectory(baseDir, fullPath, tree)
+	if err != nil {
+		return nil, err
 	}
 
-	var includedFilesList []string
-	for _, file := range files {
-		relPath := strings.TrimPrefix(file, c.App.Config.Folder)
-		relPath = strings.TrimPrefix(relPath, "/")
-		relPath = strings.TrimPrefix(relPath, "\\")
-		relPath = util.NormalizePath(relPath)
-		includedFilesList = append(includedFilesList, relPath)
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("No transferable files found in directory %s (empty or all files ignored)", dirPath)
 	}
 
-	dirMsg := Message{
-		Type: MsgTypeCommandResult,
-		Data: strings.Join(includedFilesList, "\n"),
+	return entries, nil
+}
+
+func (c *Connection) walkDirectory(baseDir, fullPath string, tree bool) ([]string, error) {
+	ignoreList, err := c.shareFilter()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load share filters: %v", err)
 	}
-	c.SendMessage(dirMsg)
 
-	for _, file := range files {
-		relPath := strings.TrimPrefix(file, c.App.Config.Folder)
-		relPath = strings.TrimPrefix(relPath, "/")
-		relPath = strings.TrimPrefix(relPath, "\\")
+	var entries []string
+	err = filepath.WalkDir(fullPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return nil
+		}
 		relPath = util.NormalizePath(relPath)
 
-		info, err := os.Stat(file)
-		if err != nil || info.IsDir() {
-			continue
+		if entry.IsDir() {
+			if path == fullPath {
+				return nil
+			}
+			if ignoreList.ShouldIgnore(c.rootRelative(path), true) {
+				return filepath.SkipDir
+			}
+			if tree {
+				entries = append(entries, relPath+"/")
+			}
+			return nil
 		}
 
-		getCmd := &Command{
-			Name: "GET",
-			Args: []string{relPath},
+		if entry.Name() == ".p2pignore" || isPartFile(path) || ignoreList.ShouldIgnore(c.rootRelative(path), false) {
+			return nil
 		}
-		c.handleGetCommand(getCmd)
 
-		time.Sleep(500 * time.Millisecond)
-	}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if tree {
+				if target, ok := c.App.symlinkTarget(path); ok {
+					entries = append(entries, relPath+symlinkSeparator+target)
+				}
+				return nil
+			}
 
-	return Message{
-		Type: MsgTypeCommandResult,
-		Data: fmt.Sprintf("Sending directory: %s (%d files)", dirPath, len(files)),
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if _, ok := resolveWithin(c.App.Root, path); !ok {
+				return nil
+			}
+		} else if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		entries = append(entries, relPath)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list directory: %v", err)
 	}
+
+	return entries, nil
 }
 
 func (c *Connection) handlePutDirCommand(cmd *Command) Message {
@@ -1002,7 +1385,7 @@ func (c *Connection) handlePutDirCommand(cmd *Command) Message {
 		}
 	}
 
-	if !isPathSafe(dirPath, c.App.Config.Folder) {
+	if !isPathSafe(dirPath, c.sessionDir()) {
 		return Message{
 			Type: MsgTypeError,
 			Data: "Access denied: path is outside the shared folder",
@@ -1016,7 +1399,18 @@ func (c *Connection) handlePutDirCommand(cmd *Command) Message {
 		}
 	}
 
-	fullPath := filepath.Join(c.App.Config.Folder, dirPath)
+	fullPath := filepath.Join(c.sessionDir(), dirPath)
+
+	if c.App.reservedPath(fullPath) {
+		return errorMessage(refusedf("%s is reserved for this node's own files and cannot be received", dirPath))
+	}
+
+	if absPath, err := filepath.Abs(fullPath); err != nil || !withinRoot(c.App.Root, absPath) {
+		return Message{
+			Type: MsgTypeError,
+			Data: "Access denied: path points outside the shared folder",
+		}
+	}
 
 	if err := os.MkdirAll(fullPath, 0755); err != nil {
 		return Message{
@@ -1039,6 +1433,8 @@ func (c *Connection) handlePutDirCommand(cmd *Command) Message {
 		_ = os.WriteFile(ignoreFilePath, []byte(defaultIgnore), 0644)
 	}
 
+	c.expectUpload(dirPath, true)
+
 	return Message{
 		Type: MsgTypeCommandResult,
 		Data: fmt.Sprintf("Ready to receive directory files into %s", dirPath),
@@ -1067,7 +1463,12 @@ func (c *Connection) handleGetMultipleCommand(cmd *Command) Message {
 	var notFoundFiles []string
 
 	for _, filePath := range cmd.Args {
-		fullPath := filepath.Join(c.App.Config.Folder, filePath)
+		_, fullPath, err := c.resolveSessionPath(filePath)
+		if err != nil {
+			notFoundFiles = append(notFoundFiles, filePath)
+			continue
+		}
+
 		fileInfo, err := os.Stat(fullPath)
 
 		if err != nil {
@@ -1080,8 +1481,8 @@ func (c *Connection) handleGetMultipleCommand(cmd *Command) Message {
 			continue
 		}
 
-		if c.ignoreList.ShouldIgnore(filePath, fileInfo.IsDir()) {
-			ignoredFiles = append(ignoredFiles, filePath+" (in .p2pignore list)")
+		if c.ignoreList.ShouldIgnore(c.rootRelative(fullPath), fileInfo.IsDir()) {
+			ignoredFiles = append(ignoredFiles, filePath+" (excluded by the share filters)")
 			continue
 		}
 
@@ -1165,8 +1566,8 @@ func (c *Connection) handlePutMultipleCommand(cmd *Command) Message {
 			continue
 		}
 
-		if filepath.Base(file) == ".p2pignore" {
-			invalidFiles = append(invalidFiles, file+" (.p2pignore files cannot be transferred)")
+		if c.App.reservedPath(filepath.Join(c.sessionDir(), file)) {
+			invalidFiles = append(invalidFiles, file+" (reserved path)")
 			continue
 		}
 
@@ -1185,6 +1586,10 @@ func (c *Connection) handlePutMultipleCommand(cmd *Command) Message {
 		}
 	}
 
+	for _, file := range validFiles {
+		c.expectUpload(file, false)
+	}
+
 	if len(invalidFiles) > 0 {
 		return Message{
 			Type: MsgTypeCommandResult,
@@ -1200,7 +1605,12 @@ func (c *Connection) handlePutMultipleCommand(cmd *Command) Message {
 }
 
 func (c *Connection) handleStatusCommand(_ *Command) Message {
-	transfers := c.App.GetCurrentTransfers()
+	var transfers []*FileTransfer
+	for _, t := range c.App.GetCurrentTransfers() {
+		if t.Conn == c {
+			transfers = append(transfers, t)
+		}
+	}
 
 	if len(transfers) == 0 {
 		return Message{
@@ -1248,84 +1658,216 @@ func createUniqueFilename(path string) string {
 
 func (c *Connection) handleFileStart(msg Message) {
 	parts := strings.Split(msg.Data, "|")
-	if len(parts) != 2 {
-		c.SendError("Invalid file start format")
+	if len(parts) < 2 {
+		c.sendTransferError(msg, "Invalid file start format")
+		return
+	}
+
+	if msg.TransferID == 0 {
+		c.sendTransferError(msg, "File start is missing a transfer ID")
 		return
 	}
 
 	filePath := util.NormalizePath(parts[0])
 
 	if !util.IsValidRelativePath(filePath) {
-		c.SendError(fmt.Sprintf("Invalid path: %s (contains invalid characters or points to a parent directory)", filePath))
+		c.sendTransferError(msg, fmt.Sprintf("Invalid path: %s (contains invalid characters or points to a parent directory)", filePath))
 		return
 	}
 
-	if !isPathSafe(filePath, c.App.Config.Folder) {
-		c.SendError("Access denied: path is outside the shared folder")
+	baseDir := c.App.Config.Folder
+	download, requested := c.takeExpectedDownload(filePath)
+	if requested {
+		baseDir = download.Dir
+	} else if dir, ok := c.takeExpectedUpload(filePath); ok {
+		baseDir = dir
+	}
+
+	if !isPathSafe(filePath, baseDir) {
+		c.sendTransferError(msg, "Access denied: path is outside the shared folder")
 		return
 	}
 
 	fileSize, err := util.ParseInt64(parts[1])
 	if err != nil {
-		c.SendError("Invalid file size")
+		c.sendTransferError(msg, "Invalid file size")
+		return
+	}
+
+	var offset int64
+	if len(parts) > 2 {
+		offset, err = util.ParseInt64(parts[2])
+		if err != nil || offset < 0 || offset > fileSize {
+			c.sendTransferError(msg, "Invalid resume offset")
+			return
+		}
+	}
+
+	ranges := 1
+	if len(parts) > 3 {
+		ranges, err = strconv.Atoi(parts[3])
+		if err != nil || ranges < 1 || ranges > maxRanges || (ranges > 1 && offset > 0) {
+			c.sendTransferError(msg, "Invalid range count")
+			return
+		}
+	}
+
+	compressed := len(parts) > 4 && parts[4] != ""
+	if compressed && (parts[4] != CompressionGzip || !c.HasCapability(CapCompression)) {
+		c.sendTransferError(msg, fmt.Sprintf("Unsupported compression: %s", parts[4]))
+		return
+	}
+
+	var metadata fileMetadata
+	if len(parts) > 5 {
+		metadata, err = parseMetadata(parts[5])
+		if err != nil {
+			c.sendTransferError(msg, fmt.Sprintf("Invalid file metadata: %v", err))
+			return
+		}
+	}
+
+	var overwrite string
+	if len(parts) > 6 && parts[6] != "" {
+		overwrite, err = util.ParseOverwritePolicy(parts[6])
+		if err != nil {
+			c.sendTransferError(msg, err.Error())
+			return
+		}
+		if policy := peerOverwritePolicy(overwrite); policy != overwrite {
+			c.Log.Debug("Ignoring %s policy requested by %s for %s, using the local policy", overwrite, c.PeerLabel(), filePath)
+			overwrite = policy
+		}
+	}
+
+	delta := len(parts) > 7 && parts[7] == deltaMode
+	if delta && (!c.HasCapability(CapDelta) || !c.HasCapability(CapChecksum) || offset > 0 || ranges > 1) {
+		c.sendTransferError(msg, "Unsupported delta transfer")
+		return
+	}
+
+	dedup := len(parts) > 7 && parts[7] == dedupMode
+	if dedup && (!c.HasCapability(CapDedup) || !c.HasCapability(CapChecksum) || offset > 0 || ranges > 1) {
+		c.sendTransferError(msg, "Unsupported deduplicated transfer")
 		return
 	}
 
 	if c.App.Config.MaxSize > 0 && fileSize > int64(c.App.Config.MaxSize*1024*1024) {
-		c.SendError(fmt.Sprintf("File size exceeds maximum allowed size of %d MB", c.App.Config.MaxSize))
+		c.sendTransferError(msg, fmt.Sprintf("File size exceeds maximum allowed size of %d MB", c.App.Config.MaxSize))
 		return
 	}
 
 	if c.App.Config.WriteOnly {
-		c.SendError("This node is in write-only mode and cannot receive files")
+		c.sendTransferError(msg, "This node is in write-only mode and cannot receive files")
 		return
 	}
 
-	if filepath.Base(filePath) == ".p2pignore" {
-		c.SendError("The .p2pignore file cannot be transferred")
+	if c.App.reservedPath(filepath.Join(baseDir, filePath)) {
+		c.sendTransferError(msg, fmt.Sprintf("%s is reserved for this node's own files and cannot be received", filePath))
+		return
+	}
+
+	if isPartFile(filePath) {
+		c.sendTransferError(msg, "Incomplete download files cannot be transferred")
 		return
 	}
 
-	fullPath := filepath.Join(c.App.Config.Folder, filePath)
+	fullPath := filepath.Join(baseDir, filePath)
 
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		c.SendError(fmt.Sprintf("Failed to create directory: %v", err))
+	if absPath, err := filepath.Abs(fullPath); err != nil || !withinRoot(c.App.Root, absPath) {
+		c.sendTransferError(msg, fmt.Sprintf("Access denied: %s points outside the shared folder", filePath))
 		return
 	}
 
-	if _, err := os.Stat(fullPath); err == nil {
-		newPath := createUniqueFilename(fullPath)
-		c.Log.Info("File already exists, using unique name: %s", filepath.Base(newPath))
-		fullPath = newPath
+	if delta && !download.Delta {
+		c.sendTransferError(msg, fmt.Sprintf("Delta transfer of %s was not requested", filePath))
+		return
 	}
 
-	file, err := os.Create(fullPath)
-	if err != nil {
-		c.SendError(fmt.Sprintf("Failed to create file: %v", err))
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.sendTransferError(msg, fmt.Sprintf("Failed to create directory: %v", err))
 		return
 	}
 
 	transfer := NewFileTransfer(filePath, fileSize, TransferTypeReceive, c)
-	transfer.File = file
-	c.App.AddTransfer(transfer)
-
-	c.Log.Info("Starting to receive file %s (%d bytes)", filePath, fileSize)
-}
+	transfer.WireID = msg.TransferID
+	transfer.AckID = msg.ID
+	transfer.Path = fullPath
+	transfer.BaseDir = baseDir
+	transfer.Offset = offset
+	transfer.BytesTransferred = offset
+	transfer.Compressed = compressed
+	transfer.Metadata = metadata
+	transfer.Overwrite = overwrite
+	transfer.Delta = delta || dedup
+	transfer.Dedup = dedup
+	if ranges > 1 {
+		transfer.Ranges = splitRanges(fileSize, ranges)
+	}
+
+	partPath := partFilePath(fullPath)
+
+	var file *os.File
+	if offset > 0 {
+		file, err = os.OpenFile(partPath, os.O_RDWR, 0644)
+		if err != nil {
+			c.sendTransferError(msg, fmt.Sprintf("Failed to open partial file: %v", err))
+			return
+		}
 
-func (c *Connection) handleFileData(msg Message) {
-	transfers := c.App.GetTransfers()
-	var transfer *FileTransfer
+		if _, err := io.CopyN(transfer.Hash, file, offset); err != nil {
+			file.Close()
+			c.sendTransferError(msg, fmt.Sprintf("Partial file is shorter than resume offset: %v", err))
+			return
+		}
 
-	for _, t := range transfers {
-		if t.Conn == c && t.Type == TransferTypeReceive {
-			transfer = t
-			break
+		if err := file.Truncate(offset); err != nil {
+			file.Close()
+			c.sendTransferError(msg, fmt.Sprintf("Failed to truncate partial file: %v", err))
+			return
 		}
+	} else {
+		file, err = os.Create(partPath)
+		if err != nil {
+			c.sendTransferError(msg, fmt.Sprintf("Failed to create file: %v", err))
+			return
+		}
+	}
+
+	transfer.File = file
+	if err := c.App.AddTransfer(transfer); err != nil {
+		file.Close()
+		c.sendTransferError(msg, err.Error())
+		return
+	}
+
+	if !c.checkExisting(msg, transfer) {
+		return
+	}
+
+	if transfer.Status == TransferStatusPaused {
+		c.Log.Info("Waiting for a decision about existing file %s", filePath)
+	} else if offset > 0 {
+		c.Log.Info("Resuming file %s at %d of %d bytes", filePath, offset, fileSize)
+	} else if delta {
+		c.Log.Info("Starting to receive changes to file %s (%d bytes)", filePath, fileSize)
+	} else if dedup {
+		c.Log.Info("Starting to receive file %s (%d bytes, deduplicated)", filePath, fileSize)
+	} else if ranges > 1 {
+		c.Log.Info("Starting to receive file %s (%d bytes, %d ranges)", filePath, fileSize, ranges)
+	} else {
+		c.Log.Info("Starting to receive file %s (%d bytes)", filePath, fileSize)
 	}
+}
 
+func (c *Connection) handleFileData(msg Message) {
+	transfer := c.App.FindTransfer(c, TransferTypeReceive, msg.TransferID)
 	if transfer == nil {
-		c.SendError("No active file transfer")
+		if c.wasSkipped(msg.TransferID) {
+			return
+		}
+		c.sendTransferError(msg, fmt.Sprintf("No active file transfer with ID %d", msg.TransferID))
 		return
 	}
 
@@ -1334,7 +1876,33 @@ func (c *Connection) handleFileData(msg Message) {
 	}
 
 	if transfer.File == nil {
-		c.SendError("File not open for writing")
+		c.sendTransferError(msg, "File not open for writing")
+		return
+	}
+
+	if transfer.AckID == "" {
+		transfer.AckID = msg.ID
+	}
+
+	expected, ok := transfer.expectedOffset(msg.Offset)
+	if transfer.Delta && len(transfer.Ranges) == 0 {
+		ok = false
+	}
+	if !ok {
+		c.sendTransferError(msg, fmt.Sprintf("Unexpected data at offset %d", msg.Offset))
+		transfer.Status = TransferStatusFailed
+		return
+	}
+
+	if msg.Offset < expected {
+		if _, held := transfer.heldAcks.Load(msg.Offset); !held {
+			c.ackChunk(msg, transfer)
+		}
+		return
+	}
+
+	if msg.Offset > expected {
+		c.Log.Debug("Dropping out-of-order chunk of %s at offset %d (expected %d)", transfer.Name, msg.Offset, expected)
 		return
 	}
 
@@ -1349,81 +1917,196 @@ func (c *Connection) handleFileData(msg Message) {
 		}
 	}
 
-	n, err := transfer.File.Write(data)
+	transfer.WireBytes += int64(len(data))
+	delay := reserveAll(len(data), c.recvLimiters(transfer)...)
+
+	if msg.Compressed {
+		data, err = decompressChunk(data)
+		if err != nil {
+			c.sendTransferError(msg, fmt.Sprintf("Failed to decompress data at offset %d: %v", msg.Offset, err))
+			transfer.Status = TransferStatusFailed
+			return
+		}
+	}
+
+	if len(transfer.Ranges) > 0 {
+		err = c.writeRange(transfer, msg.Offset, data)
+	} else {
+		var n int
+		n, err = transfer.File.Write(data)
+		transfer.Hash.Write(data[:n])
+		transfer.BytesTransferred += int64(n)
+	}
+
 	if err != nil {
-		c.SendError(fmt.Sprintf("Failed to write file: %v", err))
+		c.sendTransferError(msg, fmt.Sprintf("Failed to write file: %v", err))
 		transfer.Status = TransferStatusFailed
 		return
 	}
 
-	transfer.BytesTransferred += int64(n)
-
 	if transfer.TotalSize > 0 {
 		progress := (transfer.BytesTransferred * 100) / transfer.TotalSize
 		if progress > transfer.LastProgress+4 {
 			elapsedTime := time.Since(transfer.StartTime).Seconds()
 			if elapsedTime > 0 {
-				speed := float64(transfer.BytesTransferred) / elapsedTime / 1024
+				speed := float64(transfer.BytesTransferred-transfer.Offset) / elapsedTime / 1024
 				transfer.LastProgress = progress
 				transfer.UpdateProgress(transfer.BytesTransferred, speed)
 			}
 		}
 	}
 
-	if msg.ID != "" {
-		ackMsg := Message{
-			Type: MsgTypeACK,
-			Data: transfer.Name,
-			ID:   msg.ID,
-		}
-		c.SendMessage(ackMsg)
+	if delay > 0 {
+		c.delayAck(msg, transfer, delay)
+		return
+	}
+
+	c.ackChunk(msg, transfer)
+}
+
+func (c *Connection) ackChunk(msg Message, transfer *FileTransfer) {
+	if msg.ID == "" {
+		return
+	}
+
+	ackMsg := Message{
+		Type:       MsgTypeACK,
+		Data:       fmt.Sprintf("%s|%d", AckChunk, msg.Offset),
+		ID:         msg.ID,
+		TransferID: transfer.WireID,
 	}
+	c.SendMessage(ackMsg)
 }
 
 func (c *Connection) handleFileEnd(msg Message) {
+	parts := strings.Split(msg.Data, "|")
+	filePath := util.NormalizePath(parts[0])
 
-	filePath := util.NormalizePath(msg.Data)
+	var expectedSum string
+	if len(parts) > 1 {
+		expectedSum = parts[1]
+	}
 
-	transfers := c.App.GetTransfers()
-	var transfer *FileTransfer
+	transfer := c.App.FindTransfer(c, TransferTypeReceive, msg.TransferID)
+	if transfer == nil || transfer.Name != filePath {
+		if c.wasSkipped(msg.TransferID) {
+			return
+		}
+		c.sendTransferError(msg, "No active file transfer for "+filePath)
+		return
+	}
 
-	for _, t := range transfers {
+	if transfer.Delta && !transfer.DeltaApplied {
+		transfer.Status = TransferStatusFailed
+		transfer.CloseFile()
+		c.sendTransferError(msg, fmt.Sprintf("Transfer of %s ended before its delta or chunk list arrived", filePath))
+		c.App.RemoveTransfer(transfer)
+		return
+	}
 
-		if t.Conn == c && t.Type == TransferTypeReceive &&
-			(t.Name == filePath || util.NormalizePath(t.Name) == filePath) {
-			transfer = t
-			break
+	if len(transfer.Ranges) > 0 {
+		if err := transfer.rangesVerified(c.App.Config.Verify && !transfer.Delta); err != nil {
+			transfer.Status = TransferStatusFailed
+			transfer.CloseFile()
+			c.Log.Error("Transfer of %s is incomplete: %v", filePath, err)
+			c.sendTransferError(msg, fmt.Sprintf("Transfer of %s is incomplete: %v", filePath, err))
+			c.App.RemoveTransfer(transfer)
+			return
 		}
 	}
 
-	if transfer == nil {
-		c.SendError("No active file transfer for " + filePath)
+	if err := transfer.SyncFile(); err != nil {
+		transfer.Status = TransferStatusFailed
+		transfer.CloseFile()
+		c.Log.Error("Failed to flush %s to disk: %v", filePath, err)
+		c.sendTransferError(msg, fmt.Sprintf("Failed to store %s: %v", filePath, err))
+		c.App.RemoveTransfer(transfer)
 		return
 	}
 
-	if transfer.File != nil {
-		transfer.File.Close()
-		transfer.File = nil
+	transfer.CloseFile()
+
+	if transfer.Delta && expectedSum == "" {
+		transfer.Status = TransferStatusFailed
+		os.Remove(partFilePath(transfer.Path))
+		c.Log.Error("Transfer of %s ended without the checksum needed to verify the rebuilt file", filePath)
+		c.sendTransferError(msg, fmt.Sprintf("Transfer of %s ended without a checksum", filePath))
+		c.App.RemoveTransfer(transfer)
+		return
 	}
 
-	ackMsg := Message{
-		Type: MsgTypeACK,
-		Data: filePath,
+	if transfer.Delta {
+		actualSum, err := util.HashFile(partFilePath(transfer.Path))
+		if err != nil || actualSum != expectedSum {
+			c.rejectCorruptTransfer(msg, transfer, fmt.Sprintf("rebuilt file expected %s, got %s", expectedSum, actualSum))
+			return
+		}
+
+		c.Log.Debug("Checksum verified for rebuilt %s: %s", filePath, actualSum)
+	} else if c.App.Config.Verify && expectedSum != "" {
+		actualSum := fmt.Sprintf("%x", transfer.Hash.Sum(nil))
+		if actualSum != expectedSum {
+			c.rejectCorruptTransfer(msg, transfer, fmt.Sprintf("expected %s, got %s", expectedSum, actualSum))
+			return
+		}
+
+		c.Log.Debug("Checksum verified for %s: %s", filePath, actualSum)
 	}
 
-	if msg.ID != "" {
-		ackMsg.ID = msg.ID
+	finalPath, err := c.placeDownload(transfer)
+	if err != nil {
+		transfer.Status = TransferStatusFailed
+		c.Log.Error("Failed to move %s into place: %v", filePath, err)
+		c.sendTransferError(msg, fmt.Sprintf("Failed to store %s: %v", filePath, err))
+		c.App.RemoveTransfer(transfer)
+		return
+	}
+
+	c.applyMetadata(finalPath, transfer.Metadata)
+	c.App.markReceived(finalPath)
+	if c.App.Config.Dedup {
+		go c.App.Chunks.Add(finalPath, transfer.Chunks)
 	}
 
-	for i := 0; i < 5; i++ {
-		c.SendReliableMessage(ackMsg)
-		time.Sleep(100 * time.Millisecond)
+	if err := syncDir(filepath.Dir(finalPath)); err != nil {
+		c.Log.Debug("Failed to sync directory of %s: %v", filePath, err)
 	}
 
 	transfer.Status = TransferStatusComplete
 	c.Log.Success("File transfer complete: %s", filePath)
 
 	c.App.RemoveTransfer(transfer)
+
+	ackMsg := Message{
+		Type:       MsgTypeACK,
+		Data:       fmt.Sprintf("%s|%s", AckDone, filePath),
+		ID:         msg.ID,
+		TransferID: transfer.WireID,
+	}
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			c.SendReliableMessage(ackMsg)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+}
+
+func (c *Connection) rejectCorruptTransfer(msg Message, transfer *FileTransfer, detail string) {
+	transfer.Status = TransferStatusFailed
+	transfer.CloseFile()
+	fmt.Printf("\n")
+	c.Log.Error("Checksum mismatch for %s: %s", transfer.Name, detail)
+
+	if quarantined, err := c.App.QuarantineFile(partFilePath(transfer.Path)); err != nil {
+		c.Log.Error("Failed to quarantine %s: %v", transfer.Path, err)
+	} else {
+		c.Log.Warn("Corrupted file moved to %s", quarantined)
+	}
+
+	c.sendTransferError(msg, fmt.Sprintf("Checksum mismatch for %s", transfer.Name))
+
+	c.App.RemoveTransfer(transfer)
 }
 
 func (c *Connection) handleProgress(msg Message) {
@@ -1432,42 +2115,23 @@ func (c *Connection) handleProgress(msg Message) {
 		return
 	}
 
-	filePath := parts[0]
-	received, _ := util.ParseInt64(parts[1])
-	totalSize, _ := util.ParseInt64(parts[2])
 	speed, _ := util.ParseFloat64(parts[3])
 
-	var transfer *FileTransfer
-	for _, t := range c.App.Transfers {
-		if t.Name == filePath && t.Conn == c {
-			transfer = t
-			break
-		}
-	}
-
-	if transfer != nil {
-		transfer.BytesTransferred = received
-		transfer.TotalSize = totalSize
+	transfer := c.App.FindTransfer(c, TransferTypeReceive, msg.TransferID)
+	if transfer != nil && transfer.Status == TransferStatusInProgress {
 		transfer.Speed = speed
-		transfer.UpdateProgress(received, speed)
+		transfer.UpdateProgress(transfer.BytesTransferred, speed)
 	}
 }
 
 func (c *Connection) handleAck(msg Message) {
-	filePath := msg.Data
-
-	var transfer *FileTransfer
-	for _, t := range c.App.Transfers {
-		if t.Name == filePath && t.Conn == c && (t.Status == TransferStatusWaitingAck || t.Status == TransferStatusInProgress) {
-			transfer = t
-			break
-		}
+	if !strings.HasPrefix(msg.Data, AckDone+"|") {
+		return
 	}
 
-	if transfer != nil {
-		if transfer.Status == TransferStatusWaitingAck {
-			transfer.Status = TransferStatusComplete
-			c.Log.Success("File transfer acknowledged: %s", filePath)
-		}
+	transfer := c.App.FindTransfer(c, TransferTypeSend, msg.TransferID)
+	if transfer != nil && transfer.Status == TransferStatusWaitingAck {
+		transfer.Status = TransferStatusComplete
+		c.Log.Success("File transfer acknowledged: %s", transfer.Name)
 	}
 }
@@ -0,0 +1,456 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"local-file-sharer/internal/util"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	deltaMode          = "delta"
+	deltaMinFileSize   = 64 * 1024
+	deltaMinBlockSize  = 2 * 1024
+	deltaMaxBlockSize  = 1024 * 1024
+	deltaStrongSize    = 8
+	deltaSignatureSize = 4 + deltaStrongSize
+	deltaReadBuffer    = 4 * 1024 * 1024
+)
+
+type blockSignature struct {
+	BlockSize int
+	Weak      []uint32
+	Strong    [][deltaStrongSize]byte
+}
+
+type deltaCopy struct {
+	Target int64
+	Source int64
+	Length int64
+}
+
+func deltaBlockSize(size int64) int {
+	block := int(math.Sqrt(float64(size)))
+	block = (block + 1023) / 1024 * 1024
+	return min(max(block, deltaMinBlockSize), deltaMaxBlockSize)
+}
+
+func rollingChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, x := range block {
+		a += uint32(x)
+		b += uint32(len(block)-i) * uint32(x)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func strongChecksum(block []byte) [deltaStrongSize]byte {
+	var strong [deltaStrongSize]byte
+	sum := sha256.Sum256(block)
+	copy(strong[:], sum[:])
+	return strong
+}
+
+func computeSignature(path string) (*blockSignature, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &blockSignature{BlockSize: deltaBlockSize(info.Size())}
+	reader := bufio.NewReaderSize(file, deltaReadBuffer)
+	block := make([]byte, sig.BlockSize)
+
+	for {
+		if _, err := io.ReadFull(reader, block); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		a, b := rollingChecksum(block)
+		sig.Weak = append(sig.Weak, a|b<<16)
+		sig.Strong = append(sig.Strong, strongChecksum(block))
+	}
+
+	return sig, nil
+}
+
+func (s *blockSignature) encode() string {
+	packed := make([]byte, 0, len(s.Weak)*deltaSignatureSize)
+	for i, weak := range s.Weak {
+		packed = binary.BigEndian.AppendUint32(packed, weak)
+		packed = append(packed, s.Strong[i][:]...)
+	}
+	return fmt.Sprintf("%d:%s", s.BlockSize, base64.StdEncoding.EncodeToString(packed))
+}
+
+func parseSignature(s string) (*blockSignature, error) {
+	size, encoded, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid block signature")
+	}
+
+	blockSize, err := util.ParseInt64(size)
+	if err != nil || blockSize < deltaMinBlockSize || blockSize > deltaMaxBlockSize {
+		return nil, fmt.Errorf("invalid block size %s", size)
+	}
+
+	packed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(packed)%deltaSignatureSize != 0 {
+		return nil, fmt.Errorf("invalid block signature")
+	}
+
+	sig := &blockSignature{BlockSize: int(blockSize)}
+	for len(packed) > 0 {
+		var strong [deltaStrongSize]byte
+		copy(strong[:], packed[4:deltaSignatureSize])
+		sig.Weak = append(sig.Weak, binary.BigEndian.Uint32(packed))
+		sig.Strong = append(sig.Strong, strong)
+		packed = packed[deltaSignatureSize:]
+	}
+
+	return sig, nil
+}
+
+func parseDeltaFlag(args []string) ([]string, string) {
+	var rest []string
+	var signature string
+
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "--delta="); ok {
+			signature = value
+			continue
+		}
+		rest = append(rest, arg)
+	}
+
+	return rest, signature
+}
+
+func computeDelta(file io.ReaderAt, sig *blockSignature, sum hash.Hash) ([]deltaCopy, error) {
+	blockSize := sig.BlockSize
+	blocks := make(map[uint32][]int, len(sig.Weak))
+	var filter [1 << 16]bool
+	for i, weak := range sig.Weak {
+		blocks[weak] = append(blocks[weak], i)
+		filter[(weak^weak>>16)&0xffff] = true
+	}
+
+	reader := io.TeeReader(io.NewSectionReader(file, 0, math.MaxInt64), sum)
+	buf := make([]byte, 0, max(deltaReadBuffer, 2*blockSize+1))
+	var base int64
+	var pos int
+	eof := false
+
+	fill := func() error {
+		if len(buf)-pos > blockSize || eof {
+			return nil
+		}
+
+		n := copy(buf[:cap(buf)], buf[pos:])
+		base += int64(pos)
+		buf = buf[:n]
+		pos = 0
+
+		for len(buf) < cap(buf) && !eof {
+			m, err := reader.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+m]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var copies []deltaCopy
+	var a, b uint32
+	rolling := false
+
+	for {
+		if err := fill(); err != nil {
+			return nil, err
+		}
+
+		if len(buf)-pos < blockSize {
+			break
+		}
+
+		if !rolling {
+			a, b = rollingChecksum(buf[pos : pos+blockSize])
+			rolling = true
+		}
+
+		weak := a | b<<16
+		if filter[(weak^weak>>16)&0xffff] {
+			if block, ok := sig.match(blocks[weak], buf[pos:pos+blockSize]); ok {
+				copies = appendCopy(copies, base+int64(pos), int64(block)*int64(blockSize), int64(blockSize))
+				pos += blockSize
+				rolling = false
+				continue
+			}
+		}
+
+		if len(buf)-pos == blockSize {
+			break
+		}
+
+		out, in := uint32(buf[pos]), uint32(buf[pos+blockSize])
+		a = (a - out + in) & 0xffff
+		b = (b - uint32(blockSize)*out + a) & 0xffff
+		pos++
+	}
+
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, err
+	}
+
+	return copies, nil
+}
+
+func (s *blockSignature) match(candidates []int, block []byte) (int, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	strong := strongChecksum(block)
+	for _, i := range candidates {
+		if bytes.Equal(s.Strong[i][:], strong[:]) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func appendCopy(copies []deltaCopy, target, source, length int64) []deltaCopy {
+	if n := len(copies); n > 0 {
+		last := &copies[n-1]
+		if last.Target+last.Length == target && last.Source+last.Length == source {
+			last.Length += length
+			return copies
+		}
+	}
+	return append(copies, deltaCopy{Target: target, Source: source, Length: length})
+}
+
+func encodeDelta(copies []deltaCopy) string {
+	parts := make([]string, len(copies))
+	for i, cp := range copies {
+		parts[i] = fmt.Sprintf("%d:%d:%d", cp.Target, cp.Source, cp.Length)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseDelta(s string) ([]deltaCopy, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var copies []deltaCopy
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid delta instruction %q", part)
+		}
+
+		var values [3]int64
+		for i, field := range fields {
+			value, err := util.ParseInt64(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delta instruction %q", part)
+			}
+			values[i] = value
+		}
+
+		copies = append(copies, deltaCopy{Target: values[0], Source: values[1], Length: values[2]})
+	}
+	return copies, nil
+}
+
+func literalRanges(copies []deltaCopy, size int64) []*fileRange {
+	var ranges []*fileRange
+	var pos int64
+
+	for _, cp := range copies {
+		if cp.Target > pos {
+			ranges = append(ranges, &fileRange{Start: pos, End: cp.Target, Hash: sha256.New()})
+		}
+		pos = cp.Target + cp.Length
+	}
+
+	if pos < size {
+		ranges = append(ranges, &fileRange{Start: pos, End: size, Hash: sha256.New()})
+	}
+
+	return ranges
+}
+
+func copiedBytes(copies []deltaCopy) int64 {
+	var total int64
+	for _, cp := range copies {
+		total += cp.Length
+	}
+	return total
+}
+
+func (t *FileTransfer) deltaPrefix() int64 {
+	if !t.DeltaApplied {
+		return 0
+	}
+
+	for _, r := range t.Ranges {
+		if !r.Complete() {
+			return r.Start + atomic.LoadInt64(&r.Done)
+		}
+	}
+	return t.TotalSize
+}
+
+func (c *Connection) wantsDelta(path, overwrite string) bool {
+	if !c.HasCapability(CapDelta) {
+		return false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < deltaMinFileSize {
+		return false
+	}
+
+	if c.hidesDeltaSource(path) {
+		return false
+	}
+
+	if overwrite == "" {
+		overwrite = c.App.Config.Overwrite
+	}
+
+	switch overwrite {
+	case util.OverwriteOverwrite, util.OverwriteBackup, util.OverwriteNewer:
+		return true
+	}
+	return false
+}
+
+func (c *Connection) sendDelta(transfer *FileTransfer, sig *blockSignature, ackID string) error {
+	copies, err := computeDelta(transfer.File, sig, transfer.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to compute delta: %v", err)
+	}
+
+	data := encodeDelta(copies)
+	if len(data) > maxMessageData {
+		c.Log.Info("Delta of %s has too many instructions, sending it in full", transfer.Name)
+		copies = nil
+		data = ""
+	} else {
+		c.Log.Info("Sending delta of %s: reusing %s of %s from the peer's copy",
+			transfer.Name, util.FormatFileSize(copiedBytes(copies)), util.FormatFileSize(transfer.TotalSize))
+	}
+
+	transfer.Ranges = literalRanges(copies, transfer.TotalSize)
+	transfer.DeltaCopied = copiedBytes(copies)
+	transfer.BytesTransferred = transfer.DeltaCopied
+
+	return c.SendReliableMessage(Message{
+		Type:       MsgTypeDelta,
+		Data:       data,
+		ID:         ackID,
+		TransferID: transfer.WireID,
+	})
+}
+
+func (c *Connection) handleDelta(msg Message) {
+	transfer := c.App.FindTransfer(c, TransferTypeReceive, msg.TransferID)
+	if transfer == nil {
+		if c.wasSkipped(msg.TransferID) {
+			return
+		}
+		c.sendTransferError(msg, fmt.Sprintf("No active file transfer with ID %d", msg.TransferID))
+		return
+	}
+
+	if !transfer.Delta || transfer.Dedup || transfer.DeltaApplied {
+		c.sendTransferError(msg, fmt.Sprintf("Unexpected delta for %s", transfer.Name))
+		return
+	}
+
+	copies, err := parseDelta(msg.Data)
+	if err == nil && len(copies) > 0 && c.hidesDeltaSource(transfer.Path) {
+		err = fmt.Errorf("the existing copy is not shared with %s", c.PeerLabel())
+	}
+	if err == nil {
+		err = applyDelta(transfer.File, transfer.Path, copies, transfer.TotalSize)
+	}
+	if err != nil {
+		transfer.Status = TransferStatusFailed
+		transfer.CloseFile()
+		c.Log.Error("Failed to apply delta for %s: %v", transfer.Name, err)
+		c.sendTransferError(msg, fmt.Sprintf("Failed to apply delta for %s: %v", transfer.Name, err))
+		c.App.RemoveTransfer(transfer)
+		return
+	}
+
+	transfer.Ranges = literalRanges(copies, transfer.TotalSize)
+	transfer.DeltaCopied = copiedBytes(copies)
+	transfer.DeltaApplied = true
+	transfer.BytesTransferred = transfer.DeltaCopied
+
+	c.Log.Info("Reusing %s of %s from the existing copy of %s",
+		util.FormatFileSize(transfer.DeltaCopied), util.FormatFileSize(transfer.TotalSize), transfer.Name)
+}
+
+func (c *Connection) hidesDeltaSource(path string) bool {
+	filter, err := c.shareFilter()
+	if err != nil {
+		return true
+	}
+	return c.App.reservedPath(path) || filter.ShouldIgnore(c.rootRelative(path), false)
+}
+
+func applyDelta(dst *os.File, srcPath string, copies []deltaCopy, size int64) error {
+	if len(copies) == 0 {
+		return nil
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	var end int64
+	for _, cp := range copies {
+		if cp.Target < end || cp.Length <= 0 || cp.Target+cp.Length > size || cp.Source < 0 || cp.Source+cp.Length > info.Size() {
+			return fmt.Errorf("invalid delta instruction at offset %d", cp.Target)
+		}
+
+		if _, err := io.Copy(io.NewOffsetWriter(dst, cp.Target), io.NewSectionReader(src, cp.Source, cp.Length)); err != nil {
+			return err
+		}
+		end = cp.Target + cp.Length
+	}
+
+	return nil
+}
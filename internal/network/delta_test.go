@@ -0,0 +1,111 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestComputeDelta(t *testing.T) {
+	const block = deltaMinBlockSize
+	old := randomBytes(1, 10*block)
+
+	changed := bytes.Clone(old)
+	changed[2*block+100] ^= 0xff
+
+	tests := []struct {
+		name       string
+		old        []byte
+		new        []byte
+		wantCopied int64
+		wantCopies int
+	}{
+		{name: "identical", old: old, new: old, wantCopied: 10 * block, wantCopies: 1},
+		{name: "empty original", old: nil, new: old, wantCopied: 0, wantCopies: 0},
+		{name: "empty new file", old: old, new: nil, wantCopied: 0, wantCopies: 0},
+		{name: "unrelated", old: old, new: randomBytes(2, 10*block), wantCopied: 0, wantCopies: 0},
+		{name: "byte changed", old: old, new: changed, wantCopied: 9 * block, wantCopies: 2},
+		{name: "prepended", old: old, new: concat([]byte("header"), old), wantCopied: 10 * block, wantCopies: 1},
+		{name: "appended", old: old, new: concat(old, randomBytes(3, 100)), wantCopied: 10 * block, wantCopies: 1},
+		{name: "inserted", old: old, new: concat(old[:5*block+7], randomBytes(4, 300), old[5*block+7:]), wantCopied: 9 * block, wantCopies: 2},
+		{name: "truncated", old: old, new: old[:10*block-100], wantCopied: 9 * block, wantCopies: 1},
+		{name: "blocks swapped", old: old, new: concat(old[block:2*block], old[:block], old[2*block:]), wantCopied: 10 * block, wantCopies: 3},
+		{name: "shorter than a block", old: old, new: old[:block-1], wantCopied: 0, wantCopies: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "old")
+			if err := os.WriteFile(path, tt.old, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			sig, err := computeSignature(path)
+			if err != nil {
+				t.Fatalf("computeSignature: %v", err)
+			}
+			if sig.BlockSize != block {
+				t.Fatalf("block size = %d, want %d", sig.BlockSize, block)
+			}
+
+			sum := sha256.New()
+			copies, err := computeDelta(bytes.NewReader(tt.new), sig, sum)
+			if err != nil {
+				t.Fatalf("computeDelta: %v", err)
+			}
+
+			if want := sha256.Sum256(tt.new); !bytes.Equal(sum.Sum(nil), want[:]) {
+				t.Errorf("hash of the new file is wrong")
+			}
+
+			var pos int64
+			for _, cp := range copies {
+				if cp.Target < pos || cp.Length <= 0 || cp.Target+cp.Length > int64(len(tt.new)) || cp.Source+cp.Length > int64(len(tt.old)) {
+					t.Fatalf("invalid copy instruction %+v in %+v", cp, copies)
+				}
+				if !bytes.Equal(tt.old[cp.Source:cp.Source+cp.Length], tt.new[cp.Target:cp.Target+cp.Length]) {
+					t.Errorf("copy %+v does not reproduce the new file", cp)
+				}
+				pos = cp.Target + cp.Length
+			}
+
+			if got := copiedBytes(copies); got != tt.wantCopied {
+				t.Errorf("copied %d bytes, want %d", got, tt.wantCopied)
+			}
+			if len(copies) != tt.wantCopies {
+				t.Errorf("got %d copy instructions, want %d: %+v", len(copies), tt.wantCopies, copies)
+			}
+
+			var literal int64
+			for _, r := range literalRanges(copies, int64(len(tt.new))) {
+				literal += r.Len()
+			}
+			if literal+tt.wantCopied != int64(len(tt.new)) {
+				t.Errorf("literal ranges cover %d bytes, want %d", literal, int64(len(tt.new))-tt.wantCopied)
+			}
+
+			parsed, err := parseDelta(encodeDelta(copies))
+			if err != nil || len(parsed) != len(copies) {
+				t.Fatalf("parseDelta(encodeDelta) = %+v, %v, want %+v", parsed, err, copies)
+			}
+			for i := range parsed {
+				if parsed[i] != copies[i] {
+					t.Errorf("parseDelta(encodeDelta)[%d] = %+v, want %+v", i, parsed[i], copies[i])
+				}
+			}
+		})
+	}
+}
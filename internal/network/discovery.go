@@ -0,0 +1,210 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-file-sharer/internal/util"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DiscoveryAddr = "239.255.77.77:47777"
+
+	announceMagic    = "p2p-file-sharer"
+	announceInterval = 5 * time.Second
+	peerExpiry       = 30 * time.Second
+	maxAnnounceSize  = 2048
+)
+
+type Announcement struct {
+	Magic           string   `json:"magic"`
+	ProtocolVersion int      `json:"protocol"`
+	NodeID          string   `json:"node_id"`
+	Name            string   `json:"name"`
+	Port            int      `json:"port"`
+	Capabilities    []string `json:"capabilities"`
+	TLS             bool     `json:"tls"`
+}
+
+type DiscoveredPeer struct {
+	Name            string
+	NodeID          string
+	Addr            string
+	ProtocolVersion int
+	Capabilities    []string
+	TLS             bool
+	LastSeen        time.Time
+}
+
+type Discovery struct {
+	App     *App
+	Log     *util.Logger
+	Started time.Time
+	peers   map[string]*DiscoveredPeer
+	mu      sync.Mutex
+}
+
+func NewDiscovery(app *App) *Discovery {
+	return &Discovery{
+		App:     app,
+		Log:     util.NewLogger(app.Config.Verbose, "Discovery"),
+		Started: time.Now(),
+		peers:   make(map[string]*DiscoveredPeer),
+	}
+}
+
+func (d *Discovery) Listen() error {
+	groupAddr, err := net.ResolveUDPAddr("udp4", DiscoveryAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return fmt.Errorf("failed to join discovery group: %v", err)
+	}
+
+	go func() {
+		defer conn.Close()
+
+		buf := make([]byte, maxAnnounceSize)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				d.Log.Error("Discovery read error: %v", err)
+				return
+			}
+
+			d.handleAnnouncement(buf[:n], src)
+		}
+	}()
+
+	return nil
+}
+
+func (d *Discovery) handleAnnouncement(data []byte, src *net.UDPAddr) {
+	var ann Announcement
+	if err := json.Unmarshal(data, &ann); err != nil || ann.Magic != announceMagic {
+		return
+	}
+
+	if ann.NodeID == "" || ann.NodeID == d.App.NodeID || ann.Port <= 0 {
+		return
+	}
+
+	addr := net.JoinHostPort(src.IP.String(), strconv.Itoa(ann.Port))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.peers[ann.NodeID]; !ok {
+		d.Log.Debug("Discovered peer %s at %s", ann.Name, addr)
+	}
+
+	d.peers[ann.NodeID] = &DiscoveredPeer{
+		Name:            ann.Name,
+		NodeID:          ann.NodeID,
+		Addr:            addr,
+		ProtocolVersion: ann.ProtocolVersion,
+		Capabilities:    ann.Capabilities,
+		TLS:             ann.TLS,
+		LastSeen:        time.Now(),
+	}
+}
+
+func (d *Discovery) Announce(port int) error {
+	groupAddr, err := net.ResolveUDPAddr("udp4", DiscoveryAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return fmt.Errorf("failed to open announcement socket: %v", err)
+	}
+
+	data, err := json.Marshal(Announcement{
+		Magic:           announceMagic,
+		ProtocolVersion: ProtocolVersion,
+		NodeID:          d.App.NodeID,
+		Name:            d.App.Config.Name,
+		Port:            port,
+		Capabilities:    SupportedCapabilities,
+		TLS:             d.App.Config.TLS,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go func() {
+		defer conn.Close()
+
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+
+		for d.App.Ready {
+			if _, err := conn.Write(data); err != nil {
+				d.Log.Debug("Failed to send announcement: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+
+	return nil
+}
+
+func (d *Discovery) Peers() []*DiscoveredPeer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers := make([]*DiscoveredPeer, 0, len(d.peers))
+	for id, peer := range d.peers {
+		if time.Since(peer.LastSeen) > peerExpiry {
+			delete(d.peers, id)
+			continue
+		}
+		copied := *peer
+		peers = append(peers, &copied)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].NodeID < peers[j].NodeID
+	})
+
+	return peers
+}
+
+func (d *Discovery) Lookup(ref string) (*DiscoveredPeer, error) {
+	var matches []*DiscoveredPeer
+	for _, peer := range d.Peers() {
+		if strings.EqualFold(peer.Name, ref) {
+			matches = append(matches, peer)
+		}
+	}
+
+	if len(matches) == 0 {
+		for _, peer := range d.Peers() {
+			if strings.HasPrefix(peer.NodeID, strings.ToLower(ref)) {
+				matches = append(matches, peer)
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no peer named %s has been discovered, use DISCOVER to list peers", ref)
+	case 1:
+		return matches[0], nil
+	}
+
+	return nil, fmt.Errorf("several peers are named %s, connect by node ID prefix instead", ref)
+}
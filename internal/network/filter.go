@@ -0,0 +1,80 @@
+package network
+
+import (
+	"fmt"
+	"local-file-sharer/internal/util"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	peerFilterDir     = "filters"
+	defaultPeerFilter = "default"
+)
+
+func (c *Connection) shareFilter() (*util.IgnoreList, error) {
+	filter, err := util.LoadIgnoreFile(c.App.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := c.peerFilterFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := filter.AddPeerFile(source); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func (a *App) reservedPath(fullPath string) bool {
+	absPath, err := filepath.Abs(fullPath)
+	if err != nil {
+		return true
+	}
+
+	rel, err := filepath.Rel(a.Root, absPath)
+	if err != nil {
+		return true
+	}
+
+	return util.IsBuiltinIgnored(rel) || withinRoot(a.StateDir, absPath)
+}
+
+func (c *Connection) peerFilterFile() (string, error) {
+	defaultFile := path.Join(util.StateDirName, peerFilterDir, defaultPeerFilter)
+
+	fingerprint := c.RemoteFingerprint
+	if fingerprint == "" {
+		return defaultFile, nil
+	}
+
+	peerFile := path.Join(util.StateDirName, peerFilterDir, fingerprint)
+	if _, err := os.Stat(filepath.Join(c.App.Root, filepath.FromSlash(peerFile))); err != nil {
+		if os.IsNotExist(err) {
+			return defaultFile, nil
+		}
+		return "", err
+	}
+	return peerFile, nil
+}
+
+func describeIgnorePattern(pattern util.IgnorePattern) string {
+	var notes []string
+	if pattern.IsDir {
+		notes = append(notes, "directory")
+	}
+	if pattern.Include && !strings.HasPrefix(pattern.Text, "+") {
+		notes = append(notes, "include")
+	}
+
+	if len(notes) == 0 {
+		return pattern.Text
+	}
+	return fmt.Sprintf("%s (%s)", pattern.Text, strings.Join(notes, ", "))
+}
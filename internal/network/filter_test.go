@@ -0,0 +1,152 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShareFilter(t *testing.T) {
+	const fingerprint = "4f5301ce13cac9b88dffc49d28e9b707f94481844acceee538de928cb595efdd"
+
+	tests := []struct {
+		name        string
+		remoteName  string
+		fingerprint string
+		files       map[string]string
+		hidden      []string
+		shared      []string
+	}{
+		{
+			name:        "no filters",
+			fingerprint: fingerprint,
+			shared:      []string{"public/a.txt", "private/b.txt"},
+		},
+		{
+			name:        "fingerprint filter",
+			fingerprint: fingerprint,
+			files:       map[string]string{fingerprint: "private/\n"},
+			hidden:      []string{"private/b.txt"},
+			shared:      []string{"public/a.txt"},
+		},
+		{
+			name:        "name filters are not used",
+			remoteName:  "laptop",
+			fingerprint: fingerprint,
+			files:       map[string]string{"laptop": "private/\n"},
+			shared:      []string{"public/a.txt", "private/b.txt"},
+		},
+		{
+			name:        "unknown peer gets the default filter",
+			fingerprint: fingerprint,
+			files:       map[string]string{"default": "+public/\n", "0000": "+private/\n"},
+			hidden:      []string{"private/b.txt"},
+			shared:      []string{"public/a.txt"},
+		},
+		{
+			name:   "peer without a certificate gets the default filter",
+			files:  map[string]string{"default": "*\n", fingerprint: "!*\n"},
+			hidden: []string{"public/a.txt", "private/b.txt"},
+		},
+		{
+			name:        "fingerprint filter replaces the default",
+			fingerprint: fingerprint,
+			files:       map[string]string{"default": "*\n", fingerprint: "private/\n"},
+			hidden:      []string{"private/b.txt"},
+			shared:      []string{"public/a.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, "srv", nil)
+			for name, content := range tt.files {
+				writeFilterFile(t, app, name, content)
+			}
+
+			a, _ := dialPair(t)
+			conn := NewConnection(a, app, false)
+			conn.RemoteName = tt.remoteName
+			conn.RemoteFingerprint = tt.fingerprint
+
+			filter, err := conn.shareFilter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range tt.hidden {
+				if !filter.ShouldIgnore(path, false) {
+					t.Errorf("%s is shared, want it hidden", path)
+				}
+			}
+			for _, path := range tt.shared {
+				if filter.ShouldIgnore(path, false) {
+					t.Errorf("%s is hidden, want it shared", path)
+				}
+			}
+		})
+	}
+}
+
+func TestShareFilterFailsClosed(t *testing.T) {
+	app := newTestApp(t, "srv", nil)
+	if err := os.MkdirAll(filepath.Join(app.StateDir, peerFilterDir, defaultPeerFilter), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := dialPair(t)
+	conn := NewConnection(a, app, false)
+
+	if _, err := conn.shareFilter(); err == nil {
+		t.Fatalf("shareFilter loaded an unreadable default filter")
+	}
+	if filter := conn.loadIgnoreList(); !filter.ShouldIgnore("public/a.txt", false) {
+		t.Errorf("files are shared although the filters could not be read")
+	}
+}
+
+func writeFilterFile(t *testing.T, app *App, name, content string) {
+	t.Helper()
+
+	path := filepath.Join(app.StateDir, peerFilterDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReservedPath(t *testing.T) {
+	app := newTestApp(t, "srv", nil)
+	if err := os.MkdirAll(filepath.Join(app.StateDir, peerFilterDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(app.StateDir, peerFilterDir), filepath.Join(app.Root, "filters")); err != nil {
+		t.Fatal(err)
+	}
+	sep := string(filepath.Separator)
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "docs/a.txt"},
+		{path: "notes.p2p"},
+		{path: ".p2p", want: true},
+		{path: ".p2p/known_peers", want: true},
+		{path: ".p2p/filters/default", want: true},
+		{path: ".p2pignore", want: true},
+		{path: "docs/.p2pignore", want: true},
+		{path: "docs/.p2pinclude", want: true},
+		{path: "docs" + sep + ".." + sep + ".p2p" + sep + "node.key", want: true},
+		{path: "filters/default", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := app.reservedPath(filepath.Join(app.Root, filepath.FromSlash(tt.path))); got != tt.want {
+				t.Errorf("reservedPath(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	initialWindow = 8
+	minWindow     = 2
+	maxWindow     = 64
+
+	minRTO        = 500 * time.Millisecond
+	maxRTO        = 30 * time.Second
+	maxRTOBackoff = 6
+)
+
+type inflightChunk struct {
+	Offset      int64
+	Size        int
+	FirstSentAt time.Time
+	SentAt      time.Time
+	Retries     int
+}
+
+type flowWindow struct {
+	mu           sync.Mutex
+	cond         *sync.Cond
+	size         int
+	inflight     map[int64]*inflightChunk
+	srtt         time.Duration
+	minRTT       time.Duration
+	acked        int
+	lastDecrease time.Time
+	closed       bool
+}
+
+func newFlowWindow() *flowWindow {
+	w := &flowWindow{
+		size:     initialWindow,
+		inflight: make(map[int64]*inflightChunk),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+func (w *flowWindow) Acquire(offset int64, size int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.closed && len(w.inflight) >= w.size {
+		w.cond.Wait()
+	}
+
+	if w.closed {
+		return false
+	}
+
+	now := time.Now()
+	w.inflight[offset] = &inflightChunk{Offset: offset, Size: size, FirstSentAt: now, SentAt: now}
+	return true
+}
+
+func (w *flowWindow) Ack(offset int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	chunk, ok := w.inflight[offset]
+	if !ok {
+		return
+	}
+	delete(w.inflight, offset)
+	w.sample(time.Since(chunk.FirstSentAt))
+
+	w.cond.Broadcast()
+}
+
+func (w *flowWindow) sample(rtt time.Duration) {
+	if w.minRTT == 0 || rtt < w.minRTT {
+		w.minRTT = rtt
+	}
+
+	if w.srtt == 0 {
+		w.srtt = rtt
+	} else {
+		w.srtt = (7*w.srtt + rtt) / 8
+	}
+
+	if w.srtt > 2*w.minRTT && time.Since(w.lastDecrease) > w.srtt {
+		w.size = max(minWindow, w.size*3/4)
+		w.lastDecrease = time.Now()
+		w.acked = 0
+		return
+	}
+
+	w.acked++
+	if w.acked >= w.size {
+		w.size = min(maxWindow, w.size+1)
+		w.acked = 0
+	}
+}
+
+func (w *flowWindow) rto() time.Duration {
+	if w.srtt == 0 {
+		return 2 * minRTO
+	}
+	return max(minRTO, 4*w.srtt)
+}
+
+func (w *flowWindow) Expired() []inflightChunk {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var expired []inflightChunk
+	now := time.Now()
+	for _, chunk := range w.inflight {
+		rto := w.rto()
+		timeout := min(maxRTO, rto<<min(chunk.Retries, maxRTOBackoff))
+		if now.Sub(chunk.SentAt) < timeout {
+			continue
+		}
+
+		chunk.Retries++
+		chunk.SentAt = now
+		expired = append(expired, *chunk)
+	}
+
+	if len(expired) > 0 {
+		w.size = max(minWindow, w.size/2)
+		w.lastDecrease = now
+		w.acked = 0
+	}
+
+	return expired
+}
+
+func (w *flowWindow) Sent(offset int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if chunk, ok := w.inflight[offset]; ok {
+		chunk.FirstSentAt = time.Now()
+		chunk.SentAt = chunk.FirstSentAt
+	}
+}
+
+func (w *flowWindow) Rewind() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, chunk := range w.inflight {
+		chunk.Retries = 0
+		chunk.SentAt = time.Time{}
+	}
+}
+
+func (w *flowWindow) Drain() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.closed && len(w.inflight) > 0 {
+		w.cond.Wait()
+	}
+
+	return !w.closed
+}
+
+func (w *flowWindow) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+func (w *flowWindow) Stats() (int, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size, w.srtt
+}
+
+func (c *Connection) retransmitLoop(transfer *FileTransfer, ackID string, stop chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if transfer.Status == TransferStatusFailed {
+			transfer.Window.Close()
+			return
+		}
+
+		for _, chunk := range transfer.Window.Expired() {
+			c.Log.Debug("Retransmitting %s at offset %d (attempt %d)", transfer.Name, chunk.Offset, chunk.Retries+1)
+			if err := c.sendChunk(transfer, ackID, chunk.Offset, chunk.Size); err != nil {
+				c.Log.Error("Failed to retransmit %s at offset %d: %v", transfer.Name, chunk.Offset, err)
+			}
+		}
+	}
+}
+
+func (c *Connection) sendChunk(transfer *FileTransfer, ackID string, offset int64, size int) error {
+	buffer := make([]byte, size)
+	n, err := transfer.File.ReadAt(buffer, offset)
+	if n < size {
+		return err
+	}
+
+	return c.sendData(transfer, ackID, offset, buffer)
+}
+
+func (c *Connection) requestRetransmit(transfer *FileTransfer) {
+	if transfer.AckID == "" {
+		return
+	}
+
+	c.SendMessage(Message{
+		Type:       MsgTypeACK,
+		Data:       fmt.Sprintf("%s|%d", AckResume, transfer.BytesTransferred),
+		ID:         transfer.AckID,
+		TransferID: transfer.WireID,
+	})
+}
+
+func (t *FileTransfer) expectedOffset(offset int64) (int64, bool) {
+	if len(t.Ranges) == 0 {
+		return t.BytesTransferred, true
+	}
+
+	r := findRange(t.Ranges, offset)
+	if r == nil {
+		return 0, false
+	}
+	return r.Start + r.Done, true
+}
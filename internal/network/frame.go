@@ -0,0 +1,154 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	FrameVersion = 1
+
+	FrameTypeControl = 1
+	FrameTypeData    = 2
+
+	FrameFlagOffset     = 1 << 0
+	FrameFlagCompressed = 1 << 1
+
+	frameHeaderSize = 12
+	maxFramePayload = 16 * 1024 * 1024
+	maxMessageData  = maxFramePayload - 64*1024
+)
+
+type Frame struct {
+	Type     byte
+	Flags    uint16
+	StreamID uint32
+	Payload  []byte
+}
+
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Payload) > maxFramePayload {
+		return fmt.Errorf("frame payload too large: %d bytes", len(f.Payload))
+	}
+
+	var header [frameHeaderSize]byte
+	header[0] = FrameVersion
+	header[1] = f.Type
+	binary.BigEndian.PutUint16(header[2:4], f.Flags)
+	binary.BigEndian.PutUint32(header[4:8], f.StreamID)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(f.Payload)))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(f.Payload)
+	return err
+}
+
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != FrameVersion {
+		return nil, fmt.Errorf("unsupported frame version %d", header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[8:12])
+	if length > maxFramePayload {
+		return nil, fmt.Errorf("frame payload too large: %d bytes", length)
+	}
+
+	f := &Frame{
+		Type:     header[1],
+		Flags:    binary.BigEndian.Uint16(header[2:4]),
+		StreamID: binary.BigEndian.Uint32(header[4:8]),
+		Payload:  make([]byte, length),
+	}
+
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func EncodeMessageFrame(msg Message) (Frame, error) {
+	if msg.Binary && msg.Type == MsgTypeFileData {
+		if len(msg.ID) > 0xFFFF {
+			return Frame{}, fmt.Errorf("message ID too long")
+		}
+
+		var flags uint16
+		header := 2 + len(msg.ID)
+		if msg.Offset != 0 {
+			flags |= FrameFlagOffset
+			header += 8
+		}
+		if msg.Compressed {
+			flags |= FrameFlagCompressed
+		}
+
+		payload := make([]byte, header+len(msg.Data))
+		binary.BigEndian.PutUint16(payload[0:2], uint16(len(msg.ID)))
+		copy(payload[2:], msg.ID)
+		if flags&FrameFlagOffset != 0 {
+			binary.BigEndian.PutUint64(payload[2+len(msg.ID):], uint64(msg.Offset))
+		}
+		copy(payload[header:], msg.Data)
+
+		return Frame{Type: FrameTypeData, Flags: flags, StreamID: msg.TransferID, Payload: payload}, nil
+	}
+
+	data, err := msg.Marshal()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Type: FrameTypeControl, Payload: data}, nil
+}
+
+func DecodeMessageFrame(f *Frame) (*Message, error) {
+	switch f.Type {
+	case FrameTypeControl:
+		var msg Message
+		if err := json.Unmarshal(f.Payload, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	case FrameTypeData:
+		if len(f.Payload) < 2 {
+			return nil, fmt.Errorf("data frame too short")
+		}
+
+		idLen := int(binary.BigEndian.Uint16(f.Payload[0:2]))
+		header := 2 + idLen
+		if f.Flags&FrameFlagOffset != 0 {
+			header += 8
+		}
+
+		if len(f.Payload) < header {
+			return nil, fmt.Errorf("data frame header exceeds payload")
+		}
+
+		msg := &Message{
+			Type:       MsgTypeFileData,
+			ID:         string(f.Payload[2 : 2+idLen]),
+			Data:       string(f.Payload[header:]),
+			Binary:     true,
+			TransferID: f.StreamID,
+			Compressed: f.Flags&FrameFlagCompressed != 0,
+		}
+		if f.Flags&FrameFlagOffset != 0 {
+			msg.Offset = int64(binary.BigEndian.Uint64(f.Payload[2+idLen : header]))
+		}
+
+		return msg, nil
+	default:
+		return nil, fmt.Errorf("unknown frame type %d", f.Type)
+	}
+}
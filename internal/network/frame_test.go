@@ -0,0 +1,205 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{name: "empty control", frame: Frame{Type: FrameTypeControl, Payload: []byte{}}},
+		{name: "control", frame: Frame{Type: FrameTypeControl, Payload: []byte(`{"type":"ACK"}`)}},
+		{name: "data with flags", frame: Frame{Type: FrameTypeData, Flags: FrameFlagOffset | FrameFlagCompressed, StreamID: 7, Payload: bytes.Repeat([]byte{0xab}, 1000)}},
+		{name: "largest payload", frame: Frame{Type: FrameTypeData, StreamID: 1<<32 - 1, Payload: make([]byte, maxFramePayload)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteFrame(&buf, tt.frame); err != nil {
+				t.Fatalf("WriteFrame: %v", err)
+			}
+			if buf.Len() != frameHeaderSize+len(tt.frame.Payload) {
+				t.Errorf("encoded %d bytes, want %d", buf.Len(), frameHeaderSize+len(tt.frame.Payload))
+			}
+
+			got, err := ReadFrame(&buf)
+			if err != nil {
+				t.Fatalf("ReadFrame: %v", err)
+			}
+			if got.Type != tt.frame.Type || got.Flags != tt.frame.Flags || got.StreamID != tt.frame.StreamID || !bytes.Equal(got.Payload, tt.frame.Payload) {
+				t.Errorf("ReadFrame = type %d flags %d stream %d, %d bytes", got.Type, got.Flags, got.StreamID, len(got.Payload))
+			}
+		})
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	header := func(version byte, length uint32) []byte {
+		h := make([]byte, frameHeaderSize)
+		h[0] = version
+		h[1] = FrameTypeControl
+		binary.BigEndian.PutUint32(h[8:12], length)
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "empty stream", data: nil, wantErr: "EOF"},
+		{name: "short header", data: header(FrameVersion, 0)[:5], wantErr: "unexpected EOF"},
+		{name: "unknown version", data: header(FrameVersion+1, 0), wantErr: "unsupported frame version"},
+		{name: "oversized payload", data: header(FrameVersion, maxFramePayload+1), wantErr: "too large"},
+		{name: "truncated payload", data: append(header(FrameVersion, 10), 1, 2, 3), wantErr: "unexpected EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadFrame(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ReadFrame = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := WriteFrame(io.Discard, Frame{Payload: make([]byte, maxFramePayload+1)}); err == nil {
+		t.Errorf("WriteFrame accepted an oversized payload")
+	}
+}
+
+func TestMessageFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      Message
+		wantType byte
+	}{
+		{
+			name:     "command",
+			msg:      Message{Type: MsgTypeCommand, Data: "LS docs", ID: "42"},
+			wantType: FrameTypeControl,
+		},
+		{
+			name:     "file data",
+			msg:      Message{Type: MsgTypeFileData, Data: "\x00\x01binary\xff", Binary: true, ID: "9", TransferID: 3},
+			wantType: FrameTypeData,
+		},
+		{
+			name:     "file data at an offset",
+			msg:      Message{Type: MsgTypeFileData, Data: "range", Binary: true, ID: "10", TransferID: 3, Offset: 1 << 40, Compressed: true},
+			wantType: FrameTypeData,
+		},
+		{
+			name:     "file data without an ID",
+			msg:      Message{Type: MsgTypeFileData, Data: "", Binary: true, TransferID: 1},
+			wantType: FrameTypeData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := EncodeMessageFrame(tt.msg)
+			if err != nil {
+				t.Fatalf("EncodeMessageFrame: %v", err)
+			}
+			if frame.Type != tt.wantType {
+				t.Errorf("frame type = %d, want %d", frame.Type, tt.wantType)
+			}
+
+			var buf bytes.Buffer
+			if err := WriteFrame(&buf, frame); err != nil {
+				t.Fatal(err)
+			}
+			read, err := ReadFrame(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := DecodeMessageFrame(read)
+			if err != nil {
+				t.Fatalf("DecodeMessageFrame: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.msg) {
+				t.Errorf("DecodeMessageFrame = %+v, want %+v", *got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageFrameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{name: "unknown type", frame: Frame{Type: 9, Payload: []byte("{}")}},
+		{name: "invalid JSON", frame: Frame{Type: FrameTypeControl, Payload: []byte("{")}},
+		{name: "data frame too short", frame: Frame{Type: FrameTypeData, Payload: []byte{0}}},
+		{name: "ID longer than payload", frame: Frame{Type: FrameTypeData, Payload: []byte{0, 5, 'a'}}},
+		{name: "offset missing", frame: Frame{Type: FrameTypeData, Flags: FrameFlagOffset, Payload: []byte{0, 0, 1, 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg, err := DecodeMessageFrame(&tt.frame); err == nil {
+				t.Errorf("DecodeMessageFrame = %+v, want an error", msg)
+			}
+		})
+	}
+}
+
+func TestConnectionFraming(t *testing.T) {
+	for _, binaryFraming := range []bool{false, true} {
+		name := "json lines"
+		if binaryFraming {
+			name = "binary frames"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			app := newTestApp(t, "node", nil)
+			a, b := dialPair(t)
+			sender := NewConnection(a, app, true)
+			receiver := NewConnection(b, app, false)
+			sender.binaryFraming = binaryFraming
+			receiver.binaryFraming = binaryFraming
+
+			msgs := []Message{
+				{Type: MsgTypeCommand, Data: "GET a|b.txt", ID: "1"},
+				{Type: MsgTypeFileData, Data: "line\nbreak\x00", Binary: true, ID: "2", TransferID: 5},
+				{Type: MsgTypeFileData, Data: "x", Binary: true, ID: "3", TransferID: 5, Offset: 123},
+			}
+
+			go func() {
+				for _, msg := range msgs {
+					sender.SendMessage(msg)
+				}
+			}()
+
+			for _, want := range msgs {
+				got, err := receiver.readMessage()
+				if err != nil || got == nil {
+					t.Fatalf("readMessage = %v, %v", got, err)
+				}
+
+				data, err := got.GetBinaryData()
+				if want.Binary {
+					if err != nil || string(data) != want.Data {
+						t.Errorf("file data = %q, %v, want %q", data, err, want.Data)
+					}
+				} else if got.Data != want.Data {
+					t.Errorf("data = %q, want %q", got.Data, want.Data)
+				}
+				if got.Type != want.Type || got.ID != want.ID || got.TransferID != want.TransferID || got.Offset != want.Offset {
+					t.Errorf("readMessage = %+v, want %+v", *got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	PeerTrustNew = iota
+	PeerTrustKnown
+	PeerTrustChanged
+)
+
+type KnownPeer struct {
+	NodeID      string
+	Fingerprint string
+	Addr        string
+	Name        string
+}
+
+type KnownPeers struct {
+	path  string
+	peers map[string]KnownPeer
+	mu    sync.Mutex
+}
+
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	kp := &KnownPeers{
+		path:  path,
+		peers: make(map[string]KnownPeer),
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return kp, nil
+	}
+	if err != nil {
+		return kp, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		peer := KnownPeer{NodeID: fields[0], Fingerprint: fields[1]}
+		rest := fields[2:]
+		if len(rest) > 0 && isPeerAddr(rest[0]) {
+			if rest[0] != "-" {
+				peer.Addr = rest[0]
+			}
+			rest = rest[1:]
+		}
+		peer.Name = strings.Join(rest, " ")
+		kp.peers[peer.NodeID] = peer
+	}
+
+	return kp, scanner.Err()
+}
+
+func (kp *KnownPeers) Check(nodeID, name, addr, fingerprint string) (int, *KnownPeer, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	if existing, ok := kp.peers[nodeID]; ok {
+		if existing.Fingerprint != fingerprint {
+			return PeerTrustChanged, &existing, nil
+		}
+		if addr == "" || existing.Addr == addr {
+			return PeerTrustKnown, &existing, nil
+		}
+		existing.Addr = addr
+		kp.peers[nodeID] = existing
+		return PeerTrustKnown, &existing, kp.save()
+	}
+
+	for _, existing := range kp.peers {
+		if existing.Fingerprint == fingerprint {
+			continue
+		}
+		if (name != "" && existing.Name == name) || (addr != "" && existing.Addr == addr) {
+			return PeerTrustChanged, &existing, nil
+		}
+	}
+
+	kp.peers[nodeID] = KnownPeer{NodeID: nodeID, Fingerprint: fingerprint, Addr: addr, Name: name}
+	return PeerTrustNew, nil, kp.save()
+}
+
+func isPeerAddr(field string) bool {
+	if field == "-" {
+		return true
+	}
+	_, _, err := net.SplitHostPort(field)
+	return err == nil
+}
+
+func (kp *KnownPeers) save() error {
+	if err := os.MkdirAll(filepath.Dir(kp.path), 0700); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(kp.peers))
+	for id := range kp.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b strings.Builder
+	b.WriteString("# node-id fingerprint address name\n")
+	for _, id := range ids {
+		peer := kp.peers[id]
+		addr := peer.Addr
+		if addr == "" {
+			addr = "-"
+		}
+		fmt.Fprintf(&b, "%s %s %s %s\n", peer.NodeID, peer.Fingerprint, addr, peer.Name)
+	}
+
+	tmp := kp.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, kp.path)
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownPeersCheck(t *testing.T) {
+	type check struct {
+		nodeID, name, addr, fingerprint string
+		want                            int
+	}
+
+	tests := []struct {
+		name   string
+		checks []check
+	}{
+		{
+			name: "first contact is pinned",
+			checks: []check{
+				{"n1", "srv", "10.0.0.1:8080", "fp1", PeerTrustNew},
+				{"n1", "srv", "10.0.0.1:8080", "fp1", PeerTrustKnown},
+			},
+		},
+		{
+			name: "changed fingerprint for a known node",
+			checks: []check{
+				{"n1", "srv", "", "fp1", PeerTrustNew},
+				{"n1", "srv", "", "fp2", PeerTrustChanged},
+			},
+		},
+		{
+			name: "new node ID with a known name",
+			checks: []check{
+				{"n1", "srv", "", "fp1", PeerTrustNew},
+				{"n2", "srv", "", "fp2", PeerTrustChanged},
+			},
+		},
+		{
+			name: "new node ID at a known address",
+			checks: []check{
+				{"n1", "srv", "10.0.0.1:8080", "fp1", PeerTrustNew},
+				{"n2", "other", "10.0.0.1:8080", "fp2", PeerTrustChanged},
+			},
+		},
+		{
+			name: "new node ID with the pinned certificate",
+			checks: []check{
+				{"n1", "srv", "10.0.0.1:8080", "fp1", PeerTrustNew},
+				{"n2", "srv", "10.0.0.1:8080", "fp1", PeerTrustNew},
+			},
+		},
+		{
+			name: "unrelated nodes",
+			checks: []check{
+				{"n1", "srv", "10.0.0.1:8080", "fp1", PeerTrustNew},
+				{"n2", "other", "10.0.0.2:8080", "fp2", PeerTrustNew},
+				{"n2", "other", "", "fp2", PeerTrustKnown},
+			},
+		},
+		{
+			name: "known node at a new address",
+			checks: []check{
+				{"n1", "srv", "10.0.0.1:8080", "fp1", PeerTrustNew},
+				{"n1", "srv", "10.0.0.9:8080", "fp1", PeerTrustKnown},
+				{"n2", "other", "10.0.0.9:8080", "fp2", PeerTrustChanged},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_peers")
+			kp, err := LoadKnownPeers(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, c := range tt.checks {
+				got, _, err := kp.Check(c.nodeID, c.name, c.addr, c.fingerprint)
+				if err != nil {
+					t.Fatalf("check %d: %v", i, err)
+				}
+				if got != c.want {
+					t.Fatalf("check %d (%s %s %s %s) = %d, want %d", i, c.nodeID, c.name, c.addr, c.fingerprint, got, c.want)
+				}
+			}
+
+			reloaded, err := LoadKnownPeers(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := tt.checks[0]
+			if got, _, _ := reloaded.Check(first.nodeID, first.name, "", first.fingerprint); got != PeerTrustKnown {
+				t.Errorf("after reload, %s = %d, want %d", first.nodeID, got, PeerTrustKnown)
+			}
+		})
+	}
+}
+
+func TestLoadKnownPeersFormats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	kp, _ := LoadKnownPeers(path)
+	kp.peers["n1"] = KnownPeer{NodeID: "n1", Fingerprint: "fp1", Addr: "10.0.0.1:8080", Name: "my laptop"}
+	kp.peers["n2"] = KnownPeer{NodeID: "n2", Fingerprint: "fp2", Name: "desk"}
+	if err := kp.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(file, "n3 fp3 old style name")
+	file.Close()
+	kp.peers["n3"] = KnownPeer{NodeID: "n3", Fingerprint: "fp3", Name: "old style name"}
+
+	reloaded, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range kp.peers {
+		if got := reloaded.peers[id]; got != want {
+			t.Errorf("peer %s = %+v, want %+v", id, got, want)
+		}
+	}
+}
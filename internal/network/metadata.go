@@ -0,0 +1,240 @@
+package network
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	symlinkSeparator = " -> "
+	xattrPrefix      = "xattr."
+	maxXattrBytes    = 64 * 1024
+)
+
+type fileMetadata struct {
+	Mode    os.FileMode
+	ModTime time.Time
+	Xattrs  map[string][]byte
+}
+
+func readMetadata(path string, info os.FileInfo, withXattrs bool) fileMetadata {
+	meta := fileMetadata{
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime(),
+	}
+
+	if withXattrs {
+		xattrs, err := readXattrs(path)
+		if err == nil {
+			meta.Xattrs = xattrs
+		}
+	}
+
+	return meta
+}
+
+func (m fileMetadata) encode() string {
+	values := url.Values{}
+	if m.Mode != 0 {
+		values.Set("mode", fmt.Sprintf("%o", m.Mode.Perm()))
+	}
+	if !m.ModTime.IsZero() {
+		values.Set("mtime", strconv.FormatInt(m.ModTime.UnixNano(), 10))
+	}
+
+	size := 0
+	for name, value := range m.Xattrs {
+		size += len(name) + len(value)
+		if size > maxXattrBytes {
+			break
+		}
+		values.Set(xattrPrefix+name, base64.StdEncoding.EncodeToString(value))
+	}
+
+	return values.Encode()
+}
+
+func parseMetadata(s string) (fileMetadata, error) {
+	var meta fileMetadata
+	if s == "" {
+		return meta, nil
+	}
+
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return meta, err
+	}
+
+	if mode := values.Get("mode"); mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return meta, fmt.Errorf("invalid mode %q", mode)
+		}
+		meta.Mode = os.FileMode(perm).Perm()
+	}
+
+	if mtime := values.Get("mtime"); mtime != "" {
+		nanos, err := strconv.ParseInt(mtime, 10, 64)
+		if err != nil {
+			return meta, fmt.Errorf("invalid modification time %q", mtime)
+		}
+		meta.ModTime = time.Unix(0, nanos)
+	}
+
+	for key := range values {
+		name, ok := strings.CutPrefix(key, xattrPrefix)
+		if !ok {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(values.Get(key))
+		if err != nil {
+			return meta, fmt.Errorf("invalid extended attribute %s", name)
+		}
+
+		if meta.Xattrs == nil {
+			meta.Xattrs = make(map[string][]byte)
+		}
+		meta.Xattrs[name] = value
+	}
+
+	return meta, nil
+}
+
+func (c *Connection) applyMetadata(path string, meta fileMetadata) {
+	if meta.Mode != 0 {
+		if err := os.Chmod(path, meta.Mode); err != nil {
+			c.Log.Warn("Failed to set permissions of %s: %v", path, err)
+		}
+	}
+
+	if len(meta.Xattrs) > 0 && c.App.Config.Xattrs {
+		if err := writeXattrs(path, meta.Xattrs); err != nil {
+			c.Log.Warn("Failed to set extended attributes of %s: %v", path, err)
+		}
+	}
+
+	if !meta.ModTime.IsZero() {
+		if err := os.Chtimes(path, time.Now(), meta.ModTime); err != nil {
+			c.Log.Warn("Failed to set modification time of %s: %v", path, err)
+		}
+	}
+}
+
+func resolveWithin(root, path string) (string, bool) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", false
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return realPath, true
+}
+
+func withinRoot(root, path string) bool {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+
+	parts := strings.Split(path, string(filepath.Separator))
+	for i := len(parts); i > 0; i-- {
+		prefix := strings.Join(parts[:i], string(filepath.Separator))
+		if prefix == "" {
+			prefix = string(filepath.Separator)
+		}
+
+		realPath, err := filepath.EvalSymlinks(prefix)
+		if err != nil {
+			if _, lerr := os.Lstat(prefix); lerr == nil || !os.IsNotExist(err) {
+				return false
+			}
+			continue
+		}
+
+		for _, name := range parts[i:] {
+			if name == ".." {
+				return false
+			}
+		}
+
+		rel, err := filepath.Rel(realRoot, filepath.Join(append([]string{realPath}, parts[i:]...)...))
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+
+	return false
+}
+
+func (a *App) symlinkTarget(link string) (string, bool) {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", false
+	}
+
+	absTarget := target
+	if !filepath.IsAbs(target) {
+		absTarget = filepath.Join(filepath.Dir(link), target)
+	}
+
+	if _, ok := resolveWithin(a.Root, absTarget); !ok {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(link), filepath.Clean(absTarget))
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.ToSlash(rel), true
+}
+
+func createSymlink(root, linkPath, target string) error {
+	if filepath.IsAbs(target) || strings.Contains(target, "\\") {
+		return fmt.Errorf("target %s must be a relative path", target)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(linkPath))
+	if err != nil || !withinRoot(root, dir) {
+		return fmt.Errorf("%s is outside the shared folder", filepath.Base(linkPath))
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if !withinRoot(root, dir+string(filepath.Separator)+filepath.FromSlash(target)) {
+		return fmt.Errorf("target %s points outside the shared folder", target)
+	}
+
+	if info, err := os.Lstat(linkPath); err == nil {
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if existing, err := os.Readlink(linkPath); err == nil && filepath.ToSlash(existing) == target {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s already exists", filepath.Base(linkPath))
+	}
+
+	return os.Symlink(filepath.FromSlash(target), linkPath)
+}
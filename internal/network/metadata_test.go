@@ -0,0 +1,150 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newContainmentTree(t *testing.T) (string, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "a.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"in":       "sub",
+		"out":      outside,
+		"out-rel":  filepath.Join("..", filepath.Base(outside)),
+		"dangling": filepath.Join(outside, "missing"),
+		"chain":    "out",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root, outside
+}
+
+func TestWithinRoot(t *testing.T) {
+	root, outside := newContainmentTree(t)
+	sep := string(filepath.Separator)
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{name: "root", path: root, want: true},
+		{name: "existing file", path: filepath.Join(root, "sub", "a.txt"), want: true},
+		{name: "missing path", path: filepath.Join(root, "new", "dir", "b.txt"), want: true},
+		{name: "link to a subdirectory", path: filepath.Join(root, "in", "a.txt"), want: true},
+		{name: "parent directory", path: root + sep + ".." + sep + "x"},
+		{name: "parent after a missing directory", path: filepath.Join(root, "new") + sep + ".." + sep + ".." + sep + "x"},
+		{name: "link to an outside directory", path: filepath.Join(root, "out", "secret.txt")},
+		{name: "relative link to an outside directory", path: filepath.Join(root, "out-rel", "secret.txt")},
+		{name: "missing file behind an outside link", path: filepath.Join(root, "out", "new.txt")},
+		{name: "chain of links", path: filepath.Join(root, "chain", "secret.txt")},
+		{name: "dangling link", path: filepath.Join(root, "dangling", "x")},
+		{name: "outside path", path: filepath.Join(outside, "secret.txt")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withinRoot(root, tt.path); got != tt.want {
+				t.Errorf("withinRoot(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateSymlink(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    string
+		target  string
+		wantErr bool
+	}{
+		{name: "file in a subdirectory", link: "l1", target: "sub/a.txt"},
+		{name: "sibling in a new directory", link: "new/dir/l2", target: "../../sub"},
+		{name: "missing target inside", link: "l3", target: "sub/later.txt"},
+		{name: "absolute target", link: "l4", target: "/etc/passwd", wantErr: true},
+		{name: "backslash target", link: "l5", target: `..\..\x`, wantErr: true},
+		{name: "parent of the root", link: "l6", target: "../x", wantErr: true},
+		{name: "escape after a detour", link: "sub/l7", target: "../sub/../../x", wantErr: true},
+		{name: "target through an outside link", link: "l8", target: "out/secret.txt", wantErr: true},
+		{name: "link inside an outside directory", link: "out/l9", target: "secret.txt", wantErr: true},
+		{name: "existing file", link: "sub/a.txt", target: "a.txt", wantErr: true},
+		{name: "same link again", link: "in", target: "sub"},
+		{name: "different existing link", link: "in", target: "sub/a.txt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, _ := newContainmentTree(t)
+			linkPath := filepath.Join(root, filepath.FromSlash(tt.link))
+
+			err := createSymlink(root, linkPath, tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("createSymlink(%s -> %s) = %v, want error %v", tt.link, tt.target, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			target, err := os.Readlink(linkPath)
+			if err != nil || filepath.ToSlash(target) != tt.target {
+				t.Errorf("link points to %q (%v), want %q", target, err, tt.target)
+			}
+		})
+	}
+}
+
+func TestSymlinkTarget(t *testing.T) {
+	app := newTestApp(t, "node", nil)
+	root, outside := newContainmentTree(t)
+	app.Root = root
+
+	if err := os.Symlink(filepath.Join(root, "sub", "a.txt"), filepath.Join(root, "sub", "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		link   string
+		want   string
+		wantOK bool
+	}{
+		{link: "in", want: "sub", wantOK: true},
+		{link: "sub/abs", want: "a.txt", wantOK: true},
+		{link: "out"},
+		{link: "out-rel"},
+		{link: "chain"},
+		{link: "dangling"},
+		{link: "secret"},
+		{link: "sub/a.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			got, ok := app.symlinkTarget(filepath.Join(root, filepath.FromSlash(tt.link)))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("symlinkTarget(%s) = %q, %v, want %q, %v", tt.link, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package network
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"local-file-sharer/internal/util"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	parallelRangeThreshold = 64 * 1024 * 1024
+	rangeChunkSize         = 1024 * 1024
+	maxRanges              = 16
+)
+
+type fileRange struct {
+	Start    int64
+	End      int64
+	Done     int64
+	Hash     hash.Hash
+	Verified bool
+}
+
+func (r *fileRange) Len() int64 {
+	return r.End - r.Start
+}
+
+func (r *fileRange) Complete() bool {
+	return atomic.LoadInt64(&r.Done) == r.Len()
+}
+
+func splitRanges(size int64, streams int) []*fileRange {
+	rangeSize := (size + int64(streams) - 1) / int64(streams)
+	rangeSize = (rangeSize + rangeChunkSize - 1) / rangeChunkSize * rangeChunkSize
+
+	var ranges []*fileRange
+	for start := int64(0); start < size; start += rangeSize {
+		ranges = append(ranges, &fileRange{
+			Start: start,
+			End:   min(start+rangeSize, size),
+			Hash:  sha256.New(),
+		})
+	}
+	return ranges
+}
+
+func contiguousBytes(ranges []*fileRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		done := atomic.LoadInt64(&r.Done)
+		total += done
+		if done < r.Len() {
+			break
+		}
+	}
+	return total
+}
+
+func rangesDone(ranges []*fileRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += atomic.LoadInt64(&r.Done)
+	}
+	return total
+}
+
+func findRange(ranges []*fileRange, offset int64) *fileRange {
+	for _, r := range ranges {
+		if offset >= r.Start && offset < r.End {
+			return r
+		}
+	}
+	return nil
+}
+
+func (c *Connection) transferRanges(size, offset int64) int {
+	if offset > 0 || size < parallelRangeThreshold || !c.HasCapability(CapMultiStream) {
+		return 1
+	}
+	return max(1, min(c.App.Config.Ranges, maxRanges))
+}
+
+func (c *Connection) streamRanges(transfer *FileTransfer, ackID string, failChan chan string) bool {
+	var workers [][]*fileRange
+	if transfer.Dedup {
+		count := min(len(transfer.Ranges), c.transferRanges(rangesLen(transfer.Ranges), 0))
+		c.Log.Debug("Sending %d missing ranges of %s, %d at a time", len(transfer.Ranges), transfer.Name, count)
+		workers = make([][]*fileRange, count)
+		for i, r := range transfer.Ranges {
+			workers[i%count] = append(workers[i%count], r)
+		}
+	} else if transfer.Delta {
+		c.Log.Debug("Sending %d changed ranges of %s", len(transfer.Ranges), transfer.Name)
+		workers = append(workers, transfer.Ranges)
+	} else {
+		c.Log.Debug("Sending %s as %d parallel ranges over this connection", transfer.Name, len(transfer.Ranges))
+		for _, r := range transfer.Ranges {
+			workers = append(workers, []*fileRange{r})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, ranges := range workers {
+		wg.Add(1)
+		go func(ranges []*fileRange) {
+			defer wg.Done()
+			for _, r := range ranges {
+				if err := c.streamRange(transfer, r, ackID); err != nil && transfer.Status != TransferStatusFailed {
+					transfer.Status = TransferStatusFailed
+					c.Log.Error("Failed to send %s at offset %d: %v", transfer.Name, r.Start, err)
+					return
+				}
+			}
+		}(ranges)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	lastUpdate := time.Now()
+	lastBytes := transfer.DeltaCopied
+
+	for {
+		select {
+		case <-done:
+			if transfer.Status == TransferStatusFailed || !transfer.Window.Drain() {
+				c.reportStopped(transfer, failChan)
+				return false
+			}
+			c.sendRangeProgress(transfer, ackID, transfer.DeltaCopied+rangesDone(transfer.Ranges), time.Since(lastUpdate), lastBytes)
+			if transfer.Delta {
+				return true
+			}
+			return c.sendRangeEnds(transfer, ackID, failChan)
+		case now := <-ticker.C:
+			sent := transfer.DeltaCopied + rangesDone(transfer.Ranges)
+			c.sendRangeProgress(transfer, ackID, sent, now.Sub(lastUpdate), lastBytes)
+			lastUpdate = now
+			lastBytes = sent
+		}
+	}
+}
+
+func (c *Connection) sendRangeProgress(transfer *FileTransfer, ackID string, sent int64, interval time.Duration, lastBytes int64) {
+	var speed float64
+	if interval > 0 {
+		speed = float64(sent-lastBytes) / interval.Seconds() / 1024
+	}
+
+	transfer.UpdateProgress(sent, max(speed, 0))
+
+	c.SendMessage(Message{
+		Type:       MsgTypeProgress,
+		Data:       fmt.Sprintf("%s|%d|%d|%.2f", transfer.Name, sent, transfer.TotalSize, max(speed, 0)),
+		ID:         ackID,
+		TransferID: transfer.WireID,
+	})
+}
+
+func (c *Connection) streamRange(transfer *FileTransfer, r *fileRange, ackID string) error {
+	buffer := make([]byte, rangeChunkSize)
+	offset := r.Start
+
+	for offset < r.End {
+		if transfer.Status == TransferStatusPaused {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if transfer.Status == TransferStatusFailed {
+			return nil
+		}
+
+		n, err := transfer.File.ReadAt(buffer[:min(int64(len(buffer)), r.End-offset)], offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if n == 0 {
+			return fmt.Errorf("file shrank while sending")
+		}
+
+		r.Hash.Write(buffer[:n])
+
+		if !transfer.Window.Acquire(offset, n) {
+			return nil
+		}
+
+		if err := c.sendData(transfer, ackID, offset, buffer[:n]); err != nil {
+			return err
+		}
+
+		offset += int64(n)
+		atomic.AddInt64(&r.Done, int64(n))
+	}
+
+	return nil
+}
+
+func (c *Connection) sendRangeEnds(transfer *FileTransfer, ackID string, failChan chan string) bool {
+	for _, r := range transfer.Ranges {
+		err := c.SendMessage(Message{
+			Type:       MsgTypeRangeEnd,
+			Data:       fmt.Sprintf("%d|%x", r.Start, r.Hash.Sum(nil)),
+			ID:         ackID,
+			TransferID: transfer.WireID,
+		})
+		if err != nil {
+			c.Log.Error("Failed to finish range at offset %d of %s: %v", r.Start, transfer.Name, err)
+			c.reportStopped(transfer, failChan)
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Connection) writeRange(transfer *FileTransfer, offset int64, data []byte) error {
+	r := findRange(transfer.Ranges, offset)
+	if r == nil {
+		return fmt.Errorf("unexpected data at offset %d", offset)
+	}
+
+	if int64(len(data)) > r.End-offset {
+		return fmt.Errorf("data at offset %d overruns its range", offset)
+	}
+
+	n, err := transfer.File.WriteAt(data, offset)
+	if err != nil {
+		return err
+	}
+
+	r.Hash.Write(data[:n])
+	atomic.AddInt64(&r.Done, int64(n))
+	transfer.BytesTransferred += int64(n)
+	return nil
+}
+
+func (c *Connection) handleRangeEnd(msg Message) {
+	transfer := c.App.FindTransfer(c, TransferTypeReceive, msg.TransferID)
+	if transfer == nil || len(transfer.Ranges) == 0 {
+		if c.wasSkipped(msg.TransferID) {
+			return
+		}
+		c.sendTransferError(msg, fmt.Sprintf("No ranged transfer with ID %d", msg.TransferID))
+		return
+	}
+
+	parts := strings.Split(msg.Data, "|")
+	if len(parts) != 2 {
+		c.sendTransferError(msg, "Invalid range end format")
+		return
+	}
+
+	start, err := util.ParseInt64(parts[0])
+	if err != nil {
+		c.sendTransferError(msg, "Invalid range offset")
+		return
+	}
+
+	r := findRange(transfer.Ranges, start)
+	if r == nil || r.Start != start || !r.Complete() {
+		c.sendTransferError(msg, fmt.Sprintf("Range at offset %d of %s is incomplete", start, transfer.Name))
+		return
+	}
+
+	if c.App.Config.Verify {
+		actualSum := fmt.Sprintf("%x", r.Hash.Sum(nil))
+		if actualSum != parts[1] {
+			c.rejectCorruptTransfer(msg, transfer,
+				fmt.Sprintf("range %d-%d expected %s, got %s", r.Start, r.End, parts[1], actualSum))
+			return
+		}
+	}
+
+	r.Verified = true
+	c.Log.Debug("Range %d-%d of %s verified", r.Start, r.End, transfer.Name)
+}
+
+func (t *FileTransfer) rangesVerified(verify bool) error {
+	for _, r := range t.Ranges {
+		if !r.Complete() {
+			return fmt.Errorf("range %d-%d is incomplete", r.Start, r.End)
+		}
+		if verify && !r.Verified {
+			return fmt.Errorf("range %d-%d was not verified", r.Start, r.End)
+		}
+	}
+	return nil
+}
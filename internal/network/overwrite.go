@@ -0,0 +1,172 @@
+package network
+
+import (
+	"fmt"
+	"local-file-sharer/internal/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const overwritePromptTimeout = 5 * time.Minute
+
+func parseOverwriteFlag(args []string) ([]string, string, error) {
+	var rest []string
+	var policy string
+
+	for _, arg := range args {
+		value, ok := strings.CutPrefix(arg, "--overwrite=")
+		if !ok {
+			rest = append(rest, arg)
+			continue
+		}
+
+		parsed, err := util.ParseOverwritePolicy(value)
+		if err != nil {
+			return nil, "", err
+		}
+		policy = parsed
+	}
+
+	return rest, policy, nil
+}
+
+func parseUploadOverwriteFlag(args []string) ([]string, string, error) {
+	rest, policy, err := parseOverwriteFlag(args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if policy != "" && peerOverwritePolicy(policy) == "" {
+		return nil, "", fmt.Errorf("uploads can only ask the peer to %s, %s or %s, its own --overwrite policy decides otherwise",
+			util.OverwriteSkip, util.OverwriteRename, util.OverwriteBackup)
+	}
+
+	return rest, policy, nil
+}
+
+func peerOverwritePolicy(requested string) string {
+	switch requested {
+	case util.OverwriteSkip, util.OverwriteRename, util.OverwriteBackup:
+		return requested
+	}
+	return ""
+}
+
+func (c *Connection) checkExisting(msg Message, transfer *FileTransfer) bool {
+	if transfer.Overwrite == "" {
+		transfer.Overwrite = c.App.Config.Overwrite
+	}
+
+	existing, err := os.Stat(transfer.Path)
+	if err != nil || existing.IsDir() {
+		return true
+	}
+
+	switch transfer.Overwrite {
+	case util.OverwriteSkip:
+		c.skipIncoming(msg, transfer, "file already exists")
+		return false
+	case util.OverwriteNewer:
+		if transfer.Metadata.ModTime.IsZero() {
+			c.skipIncoming(msg, transfer, "peer did not send a modification time")
+			return false
+		}
+		if !transfer.Metadata.ModTime.Truncate(time.Second).After(existing.ModTime().Truncate(time.Second)) {
+			c.skipIncoming(msg, transfer, "local copy is not older")
+			return false
+		}
+		transfer.Overwrite = util.OverwriteOverwrite
+	case util.OverwriteAsk:
+		transfer.Status = TransferStatusPaused
+		go c.askOverwrite(msg, transfer)
+	}
+
+	return true
+}
+
+func (c *Connection) askOverwrite(msg Message, transfer *FileTransfer) {
+	question := fmt.Sprintf("%s already exists. [o]verwrite, [r]ename, [b]ackup or [s]kip?", transfer.Name)
+
+	answer, ok := c.App.Prompt(question, []string{"o", "r", "b", "s"}, overwritePromptTimeout)
+	if transfer.Status != TransferStatusPaused {
+		return
+	}
+
+	if !ok {
+		c.skipIncoming(msg, transfer, "no answer from the user")
+		return
+	}
+
+	policy := map[string]string{
+		"o": util.OverwriteOverwrite,
+		"r": util.OverwriteRename,
+		"b": util.OverwriteBackup,
+	}[answer]
+	if policy == "" {
+		c.skipIncoming(msg, transfer, "declined by the user")
+		return
+	}
+
+	transfer.Overwrite = policy
+	transfer.LastProgressTime = time.Now()
+	transfer.Status = TransferStatusInProgress
+	c.Log.Info("Receiving %s (%s)", transfer.Name, policy)
+	c.requestRetransmit(transfer)
+}
+
+func (c *Connection) skipIncoming(msg Message, transfer *FileTransfer, reason string) {
+	transfer.CloseFile()
+	if transfer.Offset == 0 {
+		os.Remove(partFilePath(transfer.Path))
+	}
+
+	transfer.Status = TransferStatusSkipped
+	transfer.Skipped = reason
+	c.skipped.Store(transfer.WireID, true)
+	c.Log.Info("Skipping %s: %s", transfer.Name, reason)
+	c.App.RemoveTransfer(transfer)
+
+	c.SendMessage(Message{
+		Type:       MsgTypeACK,
+		Data:       fmt.Sprintf("%s|%s|%s", AckSkip, transfer.Name, reason),
+		ID:         msg.ID,
+		TransferID: transfer.WireID,
+	})
+}
+
+func (c *Connection) wasSkipped(wireID uint32) bool {
+	_, ok := c.skipped.Load(wireID)
+	return ok
+}
+
+func (c *Connection) placeDownload(transfer *FileTransfer) (string, error) {
+	finalPath := transfer.Path
+
+	if _, err := os.Stat(finalPath); err == nil {
+		switch transfer.Overwrite {
+		case util.OverwriteOverwrite:
+			c.Log.Info("Overwriting existing %s", transfer.Name)
+		case util.OverwriteBackup:
+			backup, err := c.App.BackupFile(finalPath)
+			if err != nil {
+				return "", fmt.Errorf("failed to back up existing file: %v", err)
+			}
+			c.Log.Info("Previous version of %s moved to %s", transfer.Name, backup)
+		default:
+			finalPath = createUniqueFilename(finalPath)
+			c.Log.Info("File already exists, using unique name: %s", filepath.Base(finalPath))
+		}
+	}
+
+	return finalPath, os.Rename(partFilePath(transfer.Path), finalPath)
+}
+
+func skipReason(data string) string {
+	parts := strings.SplitN(data, "|", 3)
+	if len(parts) < 3 {
+		return "skipped by peer"
+	}
+	return parts[2]
+}
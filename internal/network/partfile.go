@@ -0,0 +1,91 @@
+package network
+
+import (
+	"io/fs"
+	"local-file-sharer/internal/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	partFileSuffix = ".p2ppart"
+	stalePartAge   = 7 * 24 * time.Hour
+)
+
+func partFilePath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+partFileSuffix)
+}
+
+func finalFilePath(partPath string) string {
+	dir, name := filepath.Split(partPath)
+	return filepath.Join(dir, strings.TrimSuffix(strings.TrimPrefix(name, "."), partFileSuffix))
+}
+
+func isPartFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, partFileSuffix) && len(name) > len(partFileSuffix)+1
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (a *App) sweepPartFiles() {
+	queued := make(map[string]bool)
+	for _, item := range a.Queue.Items() {
+		if item.Op == QueueOpGet {
+			queued[item.Path] = true
+		}
+	}
+
+	filepath.WalkDir(a.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.IsDir() {
+			if path == a.StateDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !isPartFile(path) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(a.Root, finalFilePath(path))
+		if err != nil {
+			return nil
+		}
+		rel = util.NormalizePath(rel)
+
+		switch {
+		case queued[rel]:
+			a.Log.Debug("Interrupted download of %s will be resumed from the queue", rel)
+		case time.Since(info.ModTime()) > stalePartAge:
+			if err := os.Remove(path); err != nil {
+				a.Log.Warn("Failed to remove stale partial download of %s: %v", rel, err)
+			} else {
+				a.Log.Info("Removed stale partial download of %s (last written %s)", rel, info.ModTime().Format("2006-01-02"))
+			}
+		default:
+			a.Log.Info("Found interrupted download of %s (%s), use RESUME %s to continue", rel, util.FormatFileSize(info.Size()), rel)
+		}
+
+		return nil
+	})
+}
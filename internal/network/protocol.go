@@ -3,8 +3,44 @@ package network
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 )
 
+const (
+	ProtocolVersion         = 5
+	MinProtocolVersion      = 1
+	TransferProtocolVersion = 3
+	AuthProtocolVersion     = 5
+	SoftwareVersion         = "0.5.0"
+
+	CapChecksum      = "checksum"
+	CapResume        = "resume"
+	CapBinaryFraming = "binary-framing"
+	CapReconnect     = "reconnect"
+	CapMultiStream   = "multistream"
+	CapCompression   = "compression"
+	CapMetadata      = "metadata"
+	CapSync          = "sync"
+	CapDelta         = "delta"
+	CapDedup         = "dedup"
+	CapDirs          = "dirs"
+)
+
+var SupportedCapabilities = []string{
+	CapChecksum,
+	CapResume,
+	CapBinaryFraming,
+	CapReconnect,
+	CapMultiStream,
+	CapCompression,
+	CapMetadata,
+	CapSync,
+	CapDelta,
+	CapDedup,
+	CapDirs,
+}
+
 const (
 	MsgTypeHandshake     = "HANDSHAKE"
 	MsgTypeCommand       = "COMMAND"
@@ -16,13 +52,112 @@ const (
 	MsgTypeProgress      = "PROGRESS"
 	MsgTypeACK           = "ACK"
 	MsgTypeMessage       = "MESSAGE"
+	MsgTypeAuth          = "AUTH"
+	MsgTypeRangeEnd      = "RANGEEND"
+	MsgTypeDelta         = "DELTA"
+	MsgTypeChunks        = "CHUNKS"
+)
+
+const (
+	AckChunk  = "CHUNK"
+	AckDone   = "DONE"
+	AckSkip   = "SKIP"
+	AckResume = "RESUME"
+	AckNeed   = "NEED"
 )
 
 type Message struct {
-	Type   string `json:"type"`
-	Data   string `json:"data"`
-	Binary bool   `json:"binary,omitempty"`
-	ID     string `json:"id,omitempty"`
+	Type       string `json:"type"`
+	Data       string `json:"data"`
+	Binary     bool   `json:"binary,omitempty"`
+	ID         string `json:"id,omitempty"`
+	TransferID uint32 `json:"transfer,omitempty"`
+	Offset     int64  `json:"offset,omitempty"`
+	Compressed bool   `json:"compressed,omitempty"`
+	Code       string `json:"code,omitempty"`
+}
+
+const (
+	ErrCodeBusy    = "busy"
+	ErrCodeRefused = "refused"
+)
+
+type commandError struct {
+	Code    string
+	Message string
+}
+
+func (e *commandError) Error() string {
+	return e.Message
+}
+
+func refusedf(format string, args ...interface{}) error {
+	return &commandError{Code: ErrCodeRefused, Message: fmt.Sprintf(format, args...)}
+}
+
+func errorCode(err error) string {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code
+	}
+	return ""
+}
+
+func errorMessage(err error) Message {
+	return Message{Type: MsgTypeError, Data: err.Error(), Code: errorCode(err)}
+}
+
+type Hello struct {
+	ProtocolVersion    int      `json:"protocol"`
+	MinProtocolVersion int      `json:"min_protocol"`
+	SoftwareVersion    string   `json:"software"`
+	NodeID             string   `json:"node_id"`
+	Name               string   `json:"name"`
+	Capabilities       []string `json:"capabilities"`
+	Auth               bool     `json:"auth,omitempty"`
+	SessionID          string   `json:"session_id,omitempty"`
+}
+
+func ParseHello(data string) Hello {
+	var hello Hello
+	if err := json.Unmarshal([]byte(data), &hello); err != nil || hello.ProtocolVersion == 0 {
+		return Hello{
+			ProtocolVersion:    1,
+			MinProtocolVersion: 1,
+			SoftwareVersion:    "unknown",
+			Name:               data,
+		}
+	}
+	return hello
+}
+
+func (h Hello) CheckCompatibility() error {
+	if h.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("incompatible peer %q: protocol version %d is too old (this node requires %d or newer)",
+			h.Name, h.ProtocolVersion, MinProtocolVersion)
+	}
+
+	if h.MinProtocolVersion > ProtocolVersion {
+		return fmt.Errorf("incompatible peer %q: requires protocol version %d or newer (this node speaks %d)",
+			h.Name, h.MinProtocolVersion, ProtocolVersion)
+	}
+
+	return nil
+}
+
+func NegotiateCapabilities(local, remote []string) map[string]bool {
+	remoteSet := make(map[string]bool, len(remote))
+	for _, c := range remote {
+		remoteSet[c] = true
+	}
+
+	agreed := make(map[string]bool)
+	for _, c := range local {
+		if remoteSet[c] {
+			agreed[c] = true
+		}
+	}
+	return agreed
 }
 
 func NewMessage(msgType, data string) Message {
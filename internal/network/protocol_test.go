@@ -0,0 +1,270 @@
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"local-file-sharer/internal/config"
+	"local-file-sharer/internal/util"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestApp(t *testing.T, name string, configure func(*config.Config)) *App {
+	t.Helper()
+
+	cfg := &config.Config{
+		Folder:     t.TempDir(),
+		Name:       name,
+		Verify:     true,
+		TLS:        true,
+		Compress:   true,
+		Concurrent: 1,
+		Overwrite:  util.OverwriteRename,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	return NewApp(cfg, util.NewLogger(false, name))
+}
+
+func dialPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func connectApps(t *testing.T, clientApp, serverApp *App) (*Connection, *Connection, error, error) {
+	t.Helper()
+
+	clientConn, serverConn := dialPair(t)
+	if clientApp.Config.TLS {
+		clientConn = tls.Client(clientConn, clientApp.TLSConfig(true))
+	}
+	if serverApp.Config.TLS {
+		serverConn = tls.Server(serverConn, serverApp.TLSConfig(false))
+	}
+
+	client := NewConnection(clientConn, clientApp, true)
+	server := NewConnection(serverConn, serverApp, false)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+	}()
+	clientErr := client.Handshake()
+	if clientErr != nil {
+		clientConn.Close()
+	}
+	return client, server, clientErr, <-serverErr
+}
+
+func TestParseHello(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Hello
+	}{
+		{
+			name: "current peer",
+			data: `{"protocol":4,"min_protocol":1,"software":"0.4.0","node_id":"n1","name":"srv","capabilities":["checksum","sync"]}`,
+			want: Hello{ProtocolVersion: 4, MinProtocolVersion: 1, SoftwareVersion: "0.4.0", NodeID: "n1", Name: "srv", Capabilities: []string{"checksum", "sync"}},
+		},
+		{
+			name: "protocol 1 peer sends its name",
+			data: "old-node",
+			want: Hello{ProtocolVersion: 1, MinProtocolVersion: 1, SoftwareVersion: "unknown", Name: "old-node"},
+		},
+		{
+			name: "JSON without a protocol version",
+			data: `{"name":"srv"}`,
+			want: Hello{ProtocolVersion: 1, MinProtocolVersion: 1, SoftwareVersion: "unknown", Name: `{"name":"srv"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseHello(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHello(%q) = %+v, want %+v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   Hello
+		wantErr bool
+	}{
+		{name: "same version", hello: Hello{ProtocolVersion: ProtocolVersion, MinProtocolVersion: MinProtocolVersion}},
+		{name: "protocol 1 peer", hello: Hello{ProtocolVersion: 1, MinProtocolVersion: 1}},
+		{name: "newer peer that still speaks ours", hello: Hello{ProtocolVersion: ProtocolVersion + 3, MinProtocolVersion: ProtocolVersion}},
+		{name: "newer peer that dropped ours", hello: Hello{ProtocolVersion: ProtocolVersion + 3, MinProtocolVersion: ProtocolVersion + 1}, wantErr: true},
+		{name: "below the minimum", hello: Hello{ProtocolVersion: MinProtocolVersion - 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.hello.CheckCompatibility(); (err != nil) != tt.wantErr {
+				t.Errorf("CheckCompatibility() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	got := NegotiateCapabilities([]string{CapChecksum, CapResume, CapDelta}, []string{CapDelta, CapChecksum, "future"})
+	want := map[string]bool{CapChecksum: true, CapDelta: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NegotiateCapabilities = %v, want %v", got, want)
+	}
+
+	if got := NegotiateCapabilities(SupportedCapabilities, nil); len(got) != 0 {
+		t.Errorf("NegotiateCapabilities with a protocol 1 peer = %v, want none", got)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	clientApp := newTestApp(t, "cli", nil)
+	serverApp := newTestApp(t, "srv", func(cfg *config.Config) { cfg.Compress = false })
+
+	client, server, clientErr, serverErr := connectApps(t, clientApp, serverApp)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+
+	if client.RemoteName != "srv" || server.RemoteName != "cli" {
+		t.Errorf("remote names = %q, %q", client.RemoteName, server.RemoteName)
+	}
+	if client.RemoteNodeID != serverApp.NodeID || server.RemoteNodeID != clientApp.NodeID {
+		t.Errorf("remote node IDs were not exchanged")
+	}
+	if client.RemoteFingerprint != serverApp.Fingerprint || server.RemoteFingerprint != clientApp.Fingerprint {
+		t.Errorf("remote fingerprints were not taken from the TLS certificates")
+	}
+	if client.ProtocolVersion != ProtocolVersion || server.ProtocolVersion != ProtocolVersion {
+		t.Errorf("protocol versions = %d, %d, want %d", client.ProtocolVersion, server.ProtocolVersion, ProtocolVersion)
+	}
+	if !client.binaryFraming || !server.binaryFraming {
+		t.Errorf("binary framing was not negotiated")
+	}
+	if client.HasCapability(CapCompression) || server.HasCapability(CapCompression) {
+		t.Errorf("compression was negotiated although the server disabled it")
+	}
+	if !client.HasCapability(CapDelta) || !server.HasCapability(CapDelta) {
+		t.Errorf("delta was not negotiated")
+	}
+	if !client.authenticated || !server.authenticated {
+		t.Errorf("peers without secrets should be authenticated after the handshake")
+	}
+	if client.checkTransferProtocol() != nil {
+		t.Errorf("transfers refused between current peers")
+	}
+}
+
+func TestHandshakeWithProtocol1Peer(t *testing.T) {
+	serverApp := newTestApp(t, "srv", func(cfg *config.Config) { cfg.TLS = false })
+
+	peerConn, serverConn := dialPair(t)
+	server := NewConnection(serverConn, serverApp, false)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+	}()
+
+	hello, _ := json.Marshal(Message{Type: MsgTypeHandshake, Data: "old-node"})
+	if _, err := peerConn.Write(append(hello, '\n')); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(peerConn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, MsgTypeHandshake) {
+		t.Errorf("server answered with %s, want a handshake", line)
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server rejected a protocol 1 peer: %v", err)
+	}
+
+	if server.RemoteName != "old-node" || server.ProtocolVersion != 1 {
+		t.Errorf("remote = %q protocol %d, want old-node protocol 1", server.RemoteName, server.ProtocolVersion)
+	}
+	if server.binaryFraming || len(server.Capabilities) != 0 {
+		t.Errorf("protocol 1 peer negotiated framing %v, capabilities %v", server.binaryFraming, server.Capabilities)
+	}
+	if err := server.checkTransferProtocol(); errorCode(err) != ErrCodeRefused {
+		t.Errorf("checkTransferProtocol() = %v, want a refusal", err)
+	}
+}
+
+func TestHandshakeRejectsIncompatiblePeer(t *testing.T) {
+	serverApp := newTestApp(t, "srv", func(cfg *config.Config) { cfg.TLS = false })
+
+	peerConn, serverConn := dialPair(t)
+	server := NewConnection(serverConn, serverApp, false)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+	}()
+
+	data, _ := json.Marshal(Hello{ProtocolVersion: ProtocolVersion + 2, MinProtocolVersion: ProtocolVersion + 1, Name: "future"})
+	hello, _ := json.Marshal(Message{Type: MsgTypeHandshake, Data: string(data)})
+	if _, err := peerConn.Write(append(hello, '\n')); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(peerConn)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply Message
+	if err := json.Unmarshal([]byte(line), &reply); err != nil || reply.Type != MsgTypeError {
+		t.Errorf("server answered %s, want an error", line)
+	}
+	if err := <-serverErr; err == nil {
+		t.Errorf("server accepted a peer that requires protocol %d", ProtocolVersion+1)
+	}
+}
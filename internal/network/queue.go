@@ -0,0 +1,589 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-file-sharer/internal/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QueueOpGet = "GET"
+	QueueOpPut = "PUT"
+
+	QueueStatusQueued = "queued"
+	QueueStatusActive = "active"
+	QueueStatusFailed = "failed"
+
+	queueInterrupted  = "interrupted"
+	queueCanceled     = "canceled"
+	queueFileName     = "queue.json"
+	maxQueueAttempts  = 3
+	queueRetryDelay   = 5 * time.Second
+	queueStartTimeout = 30 * time.Second
+)
+
+type QueueItem struct {
+	ID        int         `json:"id"`
+	Op        string      `json:"op"`
+	Path      string      `json:"path"`
+	Dir       string      `json:"dir,omitempty"`
+	RemoteDir string      `json:"remote_dir,omitempty"`
+	PeerID    string      `json:"peer"`
+	PeerName  string      `json:"peer_name"`
+	Overwrite string      `json:"overwrite,omitempty"`
+	Batch     int         `json:"batch,omitempty"`
+	Sync      *syncRecord `json:"sync,omitempty"`
+	Priority  int         `json:"priority"`
+	Attempts  int         `json:"attempts"`
+	Status    string      `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	Added     time.Time   `json:"added"`
+	RetryAt   time.Time   `json:"retry_at,omitempty"`
+
+	watch *queueWatch
+}
+
+type queueWatch struct {
+	conn  *Connection
+	typ   string
+	name  string
+	bound bool
+	done  chan string
+}
+
+var (
+	errQueueInterrupted = fmt.Errorf("connection was interrupted")
+	errQueueCanceled    = fmt.Errorf("transfer was canceled")
+	errQueueSkipped     = fmt.Errorf("file was skipped")
+)
+
+type queueBatch struct {
+	ID          int    `json:"id"`
+	Label       string `json:"label"`
+	Transferred int    `json:"transferred"`
+	Skipped     int    `json:"skipped"`
+	Failed      int    `json:"failed"`
+
+	open bool
+}
+
+type queueJournal struct {
+	NextID  int           `json:"next_id"`
+	Items   []*QueueItem  `json:"items"`
+	Batches []*queueBatch `json:"batches,omitempty"`
+}
+
+type TransferQueue struct {
+	app     *App
+	path    string
+	mu      sync.Mutex
+	items   []*QueueItem
+	batches []*queueBatch
+	nextID  int
+	wake    chan struct{}
+}
+
+func LoadTransferQueue(app *App) (*TransferQueue, error) {
+	q := &TransferQueue{
+		app:    app,
+		path:   filepath.Join(app.StateDir, queueFileName),
+		nextID: 1,
+		wake:   make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return q, err
+	}
+
+	var journal queueJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return q, fmt.Errorf("invalid queue journal: %v", err)
+	}
+
+	q.items = journal.Items
+	q.batches = journal.Batches
+	q.nextID = max(1, journal.NextID)
+	for _, item := range q.items {
+		if item.Status == QueueStatusActive {
+			item.Status = QueueStatusQueued
+		}
+		q.nextID = max(q.nextID, item.ID+1)
+	}
+	for _, batch := range q.batches {
+		q.nextID = max(q.nextID, batch.ID+1)
+	}
+
+	return q, nil
+}
+
+func (q *TransferQueue) save() {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0700); err != nil {
+		q.app.Log.Warn("Failed to save transfer queue: %v", err)
+		return
+	}
+
+	data, err := json.MarshalIndent(queueJournal{NextID: q.nextID, Items: q.items, Batches: q.batches}, "", "  ")
+	if err != nil {
+		q.app.Log.Warn("Failed to save transfer queue: %v", err)
+		return
+	}
+
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		q.app.Log.Warn("Failed to save transfer queue: %v", err)
+		return
+	}
+
+	if err := os.Rename(tmp, q.path); err != nil {
+		q.app.Log.Warn("Failed to save transfer queue: %v", err)
+	}
+}
+
+func (q *TransferQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *TransferQueue) Add(conn *Connection, request QueueItem) (*QueueItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	path := util.NormalizePath(request.Path)
+	for _, item := range q.items {
+		if item.Op != request.Op || item.Path != path || item.Dir != request.Dir || item.RemoteDir != request.RemoteDir || item.PeerID != conn.RemoteNodeID {
+			continue
+		}
+
+		if item.Status == QueueStatusFailed {
+			item.Status = QueueStatusQueued
+			item.Attempts = 0
+			item.Error = ""
+			item.RetryAt = time.Time{}
+			item.Overwrite = request.Overwrite
+			item.Batch = request.Batch
+			item.Sync = request.Sync
+			q.save()
+			q.notify()
+		}
+
+		copied := *item
+		return &copied, false
+	}
+
+	item := &QueueItem{
+		ID:        q.nextID,
+		Op:        request.Op,
+		Path:      path,
+		Dir:       request.Dir,
+		RemoteDir: request.RemoteDir,
+		PeerID:    conn.RemoteNodeID,
+		PeerName:  conn.RemoteName,
+		Overwrite: request.Overwrite,
+		Batch:     request.Batch,
+		Sync:      request.Sync,
+		Priority:  request.Priority,
+		Status:    QueueStatusQueued,
+		Added:     time.Now(),
+	}
+	q.nextID++
+	q.items = append(q.items, item)
+	q.save()
+	q.notify()
+
+	copied := *item
+	return &copied, true
+}
+
+func (q *TransferQueue) NewBatch(label string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch := &queueBatch{ID: q.nextID, Label: label, open: true}
+	q.nextID++
+	q.batches = append(q.batches, batch)
+	return batch.ID
+}
+
+func (q *TransferQueue) CloseBatch(id int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, batch := range q.batches {
+		if batch.ID == id {
+			batch.open = false
+		}
+	}
+	q.reportBatches()
+	q.save()
+}
+
+func (q *TransferQueue) reportBatches() {
+	pending := make(map[int]bool)
+	for _, item := range q.items {
+		if item.Batch != 0 && item.Status != QueueStatusFailed {
+			pending[item.Batch] = true
+		}
+	}
+
+	var kept []*queueBatch
+	for _, batch := range q.batches {
+		if batch.open || pending[batch.ID] {
+			kept = append(kept, batch)
+			continue
+		}
+
+		if batch.Transferred+batch.Skipped+batch.Failed > 0 {
+			q.app.Log.Info("%s finished: %d transferred, %d skipped, %d failed",
+				batch.Label, batch.Transferred, batch.Skipped, batch.Failed)
+		}
+	}
+	q.batches = kept
+}
+
+func (q *TransferQueue) countBatch(item *QueueItem, count func(*queueBatch)) {
+	for _, batch := range q.batches {
+		if batch.ID == item.Batch {
+			count(batch)
+			return
+		}
+	}
+}
+
+func (q *TransferQueue) Items() []QueueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := make([]QueueItem, 0, len(q.items))
+	for _, item := range q.ordered() {
+		items = append(items, *item)
+	}
+	return items
+}
+
+func (q *TransferQueue) ordered() []*QueueItem {
+	items := append([]*QueueItem(nil), q.items...)
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Priority != items[j].Priority {
+			return items[i].Priority > items[j].Priority
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+func (q *TransferQueue) SetPriority(id, priority int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, item := range q.items {
+		if item.ID == id {
+			item.Priority = priority
+			q.save()
+			q.notify()
+			return nil
+		}
+	}
+	return fmt.Errorf("no queued transfer with ID %d", id)
+}
+
+func (q *TransferQueue) Clear(id int) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var kept []*QueueItem
+	removed := 0
+	for _, item := range q.items {
+		if (id == 0 || item.ID == id) && item.Status != QueueStatusActive {
+			removed++
+			continue
+		}
+		kept = append(kept, item)
+	}
+
+	if id != 0 && removed == 0 {
+		return 0, fmt.Errorf("no waiting transfer with ID %d", id)
+	}
+
+	q.items = kept
+	q.reportBatches()
+	q.save()
+	return removed, nil
+}
+
+func (q *TransferQueue) Run() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for q.app.Ready {
+		q.schedule()
+
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *TransferQueue) schedule() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	active := 0
+	for _, item := range q.items {
+		if item.Status == QueueStatusActive {
+			active++
+		}
+	}
+
+	limit := max(1, q.app.Config.Concurrent)
+	now := time.Now()
+	started := false
+
+	for _, item := range q.ordered() {
+		if active >= limit {
+			break
+		}
+
+		if item.Status != QueueStatusQueued || now.Before(item.RetryAt) {
+			continue
+		}
+
+		conn := q.app.findPeerConnection(item.PeerID)
+		if conn == nil {
+			continue
+		}
+
+		item.Status = QueueStatusActive
+		item.Attempts++
+		item.Error = ""
+		active++
+		started = true
+
+		go q.runItem(item, conn)
+	}
+
+	if started {
+		q.save()
+	}
+}
+
+func (a *App) findPeerConnection(nodeID string) *Connection {
+	for _, conn := range a.GetActiveConnections() {
+		if conn.RemoteNodeID == nodeID && conn.established && !conn.Reconnecting() {
+			return conn
+		}
+	}
+	return nil
+}
+
+func (q *TransferQueue) runItem(item *QueueItem, conn *Connection) {
+	var err error
+	switch item.Op {
+	case QueueOpGet:
+		err = q.runDownload(item, conn)
+	case QueueOpPut:
+		err = q.runUpload(item, conn)
+	default:
+		err = fmt.Errorf("unknown queue operation %s", item.Op)
+	}
+
+	q.finish(item, conn, err)
+}
+
+func (q *TransferQueue) runDownload(item *QueueItem, conn *Connection) error {
+	done := q.watch(item, conn, TransferTypeReceive)
+
+	if err := conn.requestDownload(item.Path, item.RemoteDir, q.localDir(item), item.Overwrite); err != nil {
+		return err
+	}
+
+	return q.wait(item, conn, done)
+}
+
+func (q *TransferQueue) runUpload(item *QueueItem, conn *Connection) error {
+	if _, _, _, err := conn.validateSend(q.localDir(item), item.Path); err != nil {
+		return err
+	}
+
+	if _, err := conn.ExecuteCommand("PUT", item.Path, conn.dirFlag(item.RemoteDir)); err != nil {
+		return err
+	}
+
+	done := q.watch(item, conn, TransferTypeSend)
+
+	result := conn.sendFile(q.localDir(item), &Command{Name: "GET", Args: []string{item.Path}})
+	if result.Type == MsgTypeError {
+		return &commandError{Code: result.Code, Message: result.Data}
+	}
+
+	return q.wait(item, conn, done)
+}
+
+func (q *TransferQueue) localDir(item *QueueItem) string {
+	if item.Dir != "" {
+		return item.Dir
+	}
+	return q.app.Config.Folder
+}
+
+func (q *TransferQueue) watch(item *QueueItem, conn *Connection, transferType string) chan string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item.watch = &queueWatch{
+		conn: conn,
+		typ:  transferType,
+		name: item.Path,
+		done: make(chan string, 1),
+	}
+	return item.watch.done
+}
+
+func (q *TransferQueue) wait(item *QueueItem, conn *Connection, done chan string) error {
+	started := time.Now()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case status := <-done:
+			switch status {
+			case TransferStatusComplete:
+				return nil
+			case queueInterrupted:
+				return errQueueInterrupted
+			case queueCanceled:
+				return errQueueCanceled
+			case TransferStatusSkipped:
+				return errQueueSkipped
+			}
+			return fmt.Errorf("transfer of %s failed", item.Path)
+		case <-ticker.C:
+		}
+
+		q.mu.Lock()
+		bound := item.watch != nil && item.watch.bound
+		q.mu.Unlock()
+
+		if bound {
+			continue
+		}
+
+		if conn.closed || conn.Reconnecting() {
+			return errQueueInterrupted
+		}
+
+		if time.Since(started) > queueStartTimeout {
+			return fmt.Errorf("transfer of %s did not start", item.Path)
+		}
+	}
+}
+
+func (q *TransferQueue) transferAdded(t *FileTransfer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, item := range q.items {
+		w := item.watch
+		if w != nil && !w.bound && w.conn == t.Conn && w.typ == t.Type && w.name == t.Name {
+			w.bound = true
+			t.QueueID = item.ID
+			if t.Overwrite == "" {
+				t.Overwrite = item.Overwrite
+			}
+			return
+		}
+	}
+}
+
+func (q *TransferQueue) transferRemoved(t *FileTransfer) {
+	q.signal(t, t.Status)
+}
+
+func (q *TransferQueue) transferInterrupted(t *FileTransfer) {
+	q.signal(t, queueInterrupted)
+}
+
+func (q *TransferQueue) transferCanceled(t *FileTransfer) {
+	q.signal(t, queueCanceled)
+}
+
+func (q *TransferQueue) signal(t *FileTransfer, status string) {
+	if t.QueueID == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, item := range q.items {
+		if item.ID == t.QueueID && item.watch != nil && item.watch.bound {
+			select {
+			case item.watch.done <- status:
+			default:
+			}
+			return
+		}
+	}
+}
+
+func (q *TransferQueue) finish(item *QueueItem, conn *Connection, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.notify()
+
+	item.watch = nil
+
+	if err == nil || err == errQueueCanceled || err == errQueueSkipped {
+		switch err {
+		case nil:
+			q.countBatch(item, func(b *queueBatch) { b.Transferred++ })
+			if item.Sync != nil {
+				q.app.recordSynced(item.Sync)
+			}
+		case errQueueSkipped:
+			q.countBatch(item, func(b *queueBatch) { b.Skipped++ })
+		}
+
+		for i, existing := range q.items {
+			if existing == item {
+				q.items = append(q.items[:i], q.items[i+1:]...)
+				break
+			}
+		}
+		q.reportBatches()
+		q.save()
+		return
+	}
+
+	item.Error = err.Error()
+	item.RetryAt = time.Now().Add(queueRetryDelay)
+
+	switch {
+	case err == errQueueInterrupted || conn.Reconnecting() || errorCode(err) == ErrCodeBusy:
+		item.Attempts--
+		item.Status = QueueStatusQueued
+	case item.Attempts >= maxQueueAttempts || errorCode(err) == ErrCodeRefused:
+		item.Status = QueueStatusFailed
+		q.app.Log.Error("Queued %s of %s failed after %d attempts: %v", strings.ToLower(item.Op), item.Path, item.Attempts, err)
+		q.countBatch(item, func(b *queueBatch) { b.Failed++ })
+		q.reportBatches()
+	default:
+		item.Status = QueueStatusQueued
+		q.app.Log.Warn("Queued %s of %s failed, retrying: %v", strings.ToLower(item.Op), item.Path, err)
+	}
+
+	q.save()
+}
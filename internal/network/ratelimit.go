@@ -0,0 +1,99 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (l *rateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+	l.last = time.Now()
+}
+
+func (l *rateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *rateLimiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens = min(float64(l.rate), l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+func reserveAll(n int, limiters ...*rateLimiter) time.Duration {
+	var delay time.Duration
+	for _, l := range limiters {
+		delay = max(delay, l.Reserve(n))
+	}
+	return delay
+}
+
+func (c *Connection) sendLimiters(transfer *FileTransfer) []*rateLimiter {
+	return []*rateLimiter{c.App.sendLimiter, c.sendLimiter, transfer.Limiter}
+}
+
+func (c *Connection) recvLimiters(transfer *FileTransfer) []*rateLimiter {
+	return []*rateLimiter{c.App.recvLimiter, c.recvLimiter, transfer.Limiter}
+}
+
+func (c *Connection) delayAck(msg Message, transfer *FileTransfer, delay time.Duration) {
+	transfer.heldAcks.Store(msg.Offset, true)
+	time.AfterFunc(delay, func() {
+		transfer.heldAcks.Delete(msg.Offset)
+		c.ackChunk(msg, transfer)
+	})
+}
+
+func (c *Connection) limiter(inbound bool) *rateLimiter {
+	if inbound {
+		return c.recvLimiter
+	}
+	return c.sendLimiter
+}
+
+func (a *App) limiter(inbound bool) *rateLimiter {
+	if inbound {
+		return a.recvLimiter
+	}
+	return a.sendLimiter
+}
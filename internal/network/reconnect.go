@@ -0,0 +1,270 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"local-file-sharer/internal/util"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	reconnectBaseDelay   = 1 * time.Second
+	reconnectMaxDelay    = 30 * time.Second
+	maxReconnectAttempts = 20
+	sessionExpiry        = 10 * time.Minute
+)
+
+type detachedSession struct {
+	NodeID          string
+	Cwd             string
+	ExpectedUploads map[string]expectedUpload
+	DetachedAt      time.Time
+}
+
+func newSessionID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (a *App) detachSession(c *Connection) {
+	if c.SessionID == "" || !c.authenticated || !c.HasCapability(CapReconnect) {
+		return
+	}
+
+	c.uploadsMu.Lock()
+	expected := make(map[string]expectedUpload, len(c.expectedUploads))
+	for path, upload := range c.expectedUploads {
+		expected[path] = upload
+	}
+	c.uploadsMu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for id, session := range a.sessions {
+		if time.Since(session.DetachedAt) > sessionExpiry {
+			delete(a.sessions, id)
+		}
+	}
+
+	a.sessions[c.SessionID] = &detachedSession{
+		NodeID:          c.RemoteNodeID,
+		Cwd:             c.cwd,
+		ExpectedUploads: expected,
+		DetachedAt:      time.Now(),
+	}
+}
+
+func (a *App) attachSession(c *Connection) bool {
+	if c.SessionID == "" || !c.HasCapability(CapReconnect) {
+		return false
+	}
+
+	a.mu.Lock()
+	session, ok := a.sessions[c.SessionID]
+	if ok {
+		delete(a.sessions, c.SessionID)
+	}
+	a.mu.Unlock()
+
+	if !ok || session.NodeID != c.RemoteNodeID || time.Since(session.DetachedAt) > sessionExpiry {
+		return false
+	}
+
+	c.cwd = session.Cwd
+
+	c.uploadsMu.Lock()
+	for path, upload := range session.ExpectedUploads {
+		c.expectedUploads[path] = upload
+	}
+	c.uploadsMu.Unlock()
+
+	return true
+}
+
+func (c *Connection) Disconnect() {
+	c.closed = true
+	c.Conn.Close()
+}
+
+func (c *Connection) Reconnecting() bool {
+	return c.reconnecting
+}
+
+func (c *Connection) canReconnect() bool {
+	return c.isClient && c.established && c.dialAddr != "" && !c.closed && c.App.Ready
+}
+
+func (c *Connection) redial() error {
+	conn, err := net.DialTimeout("tcp", c.dialAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	if c.App.Config.TLS {
+		conn = tls.Client(conn, c.App.TLSConfig(true))
+	}
+
+	c.attach(conn)
+
+	if err := c.Handshake(); err != nil {
+		conn.Close()
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Connection) reconnect(interrupted []*FileTransfer) {
+	c.reconnecting = true
+	delay := reconnectBaseDelay
+
+	for attempt := 1; attempt <= maxReconnectAttempts; attempt++ {
+		time.Sleep(delay)
+
+		if c.closed || !c.App.Ready {
+			break
+		}
+
+		c.Log.Info("Reconnecting to %s (attempt %d/%d)", c.dialAddr, attempt, maxReconnectAttempts)
+
+		if err := c.redial(); err != nil {
+			c.Log.Warn("Reconnect failed: %v", err)
+			delay = min(delay*2, reconnectMaxDelay)
+			continue
+		}
+
+		c.reconnecting = false
+		c.Log.Success("Reconnected to %s", c.RemoteName)
+
+		go c.run()
+
+		c.resumeTransfers(interrupted)
+		return
+	}
+
+	c.reconnecting = false
+	c.App.RemoveConnection(c)
+
+	if !c.closed {
+		c.Log.Error("Giving up on %s after %d reconnect attempts", c.dialAddr, maxReconnectAttempts)
+	}
+
+	for _, t := range interrupted {
+		if t.Type == TransferTypeReceive {
+			c.Log.Warn("Transfer of %s interrupted at %s, use RESUME %s to continue",
+				t.Name, util.FormatFileSize(t.BytesTransferred), t.Name)
+		}
+	}
+}
+
+func (c *Connection) resumeTransfers(interrupted []*FileTransfer) {
+	for _, t := range interrupted {
+		if t.QueueID != 0 {
+			continue
+		}
+
+		for c.App.IsActiveTransferInProgress() {
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		if c.Reconnecting() || c.closed {
+			return
+		}
+
+		var err error
+		switch t.Type {
+		case TransferTypeReceive:
+			err = c.resumeDownload(t)
+		case TransferTypeSend:
+			err = c.resumeUpload(t)
+		}
+
+		if err != nil {
+			c.Log.Error("Failed to resume %s: %v", t.Name, err)
+		}
+	}
+}
+
+func (c *Connection) resumeDownload(t *FileTransfer) error {
+	if _, err := os.Stat(partFilePath(t.Path)); err != nil {
+		c.Log.Info("Restarting download of %s", t.Name)
+	}
+
+	dir := t.BaseDir
+	if dir == "" {
+		dir = c.App.Config.Folder
+	}
+	return c.requestDownload(t.Name, "", dir, t.Overwrite)
+}
+
+func (c *Connection) requestDownload(name, remoteDir, dir, overwrite string) error {
+	path := filepath.Join(dir, name)
+	dirFlag := c.dirFlag(remoteDir)
+
+	info, err := os.Stat(partFilePath(path))
+	if err != nil || info.Size() == 0 || !c.HasCapability(CapResume) {
+		if c.wantsDelta(path, overwrite) {
+			sig, err := computeSignature(path)
+			if err != nil {
+				c.Log.Warn("Failed to read existing copy of %s, downloading it in full: %v", name, err)
+			} else if encoded := sig.encode(); len(encoded) > maxMessageData {
+				c.Log.Info("Block signature of %s is too large for a delta, downloading it in full", name)
+			} else {
+				c.Log.Debug("Requesting a delta of %s against %d blocks of the existing copy", name, len(sig.Weak))
+				return c.executeDownload(name, dir, true, "GET", name, "--delta="+encoded, dirFlag)
+			}
+		}
+
+		return c.executeDownload(name, dir, false, "GET", name, dirFlag)
+	}
+
+	offset := info.Size()
+	prefixHash, err := util.HashFilePrefix(partFilePath(path), offset)
+	if err != nil {
+		return fmt.Errorf("failed to hash partial file: %v", err)
+	}
+
+	c.Log.Info("Resuming download of %s from %s", name, util.FormatFileSize(offset))
+	return c.executeDownload(name, dir, false, "GET", name, fmt.Sprintf("%d", offset), prefixHash, dirFlag)
+}
+
+func (c *Connection) executeDownload(name, dir string, delta bool, cmdName string, args ...string) error {
+	c.expectDownload(name, dir, delta)
+	if _, err := c.ExecuteCommand(cmdName, args...); err != nil {
+		c.takeExpectedDownload(name)
+		return err
+	}
+	return nil
+}
+
+func (c *Connection) resumeUpload(t *FileTransfer) error {
+	if t.BaseDir == "" {
+		return fmt.Errorf("upload source is unknown")
+	}
+
+	c.Log.Info("Restarting upload of %s", t.Name)
+
+	if _, _, _, err := c.validateSend(t.BaseDir, t.Name); err != nil {
+		return err
+	}
+
+	if _, err := c.ExecuteCommand("PUT", t.Name); err != nil {
+		return err
+	}
+
+	result := c.sendFile(t.BaseDir, &Command{Name: "GET", Args: []string{t.Name}})
+	if result.Type == MsgTypeError {
+		return fmt.Errorf("%s", result.Data)
+	}
+
+	return nil
+}
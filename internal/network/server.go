@@ -1,6 +1,7 @@
 package network
 
 import (
+	"crypto/tls"
 	"local-file-sharer/internal/util"
 	"net"
 	"sync"
@@ -15,9 +16,35 @@ func StartListening(app *App) {
 		return
 	}
 
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if app.Config.TLS {
+		listener = tls.NewListener(listener, app.TLSConfig(false))
+		log.Info("TLS enabled, node fingerprint: %s", app.Fingerprint)
+	}
+
 	log.Info("Listening on %s", app.Config.ListenAddr)
+
+	if app.Pairing != nil {
+		log.Info("Pairing code: %s (connect with --secret=%s)", app.Pairing.Code(), app.Pairing.Code())
+	}
 	log.Info("Waiting for connections...")
 
+	app.StartDiscovery()
+
+	if app.Config.Announce && app.Discovery != nil {
+		if err := app.Discovery.Announce(port); err != nil {
+			log.Warn("Failed to announce on the local network: %v", err)
+		} else {
+			log.Info("Announcing %s on the local network (%s)", app.Config.Name, DiscoveryAddr)
+		}
+	}
+
+	if app.Config.Discover {
+		app.CommandParser.handleDiscover()
+		app.interfaceOnce.Do(func() { go StartCommandInterface(app) })
+	}
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
@@ -37,9 +64,7 @@ func StartListening(app *App) {
 
 			go connection.Start()
 
-			if len(app.Connections) == 1 {
-				go StartCommandInterface(app)
-			}
+			app.interfaceOnce.Do(func() { go StartCommandInterface(app) })
 		}
 	}()
 
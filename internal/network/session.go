@@ -0,0 +1,126 @@
+package network
+
+import (
+	"fmt"
+	"local-file-sharer/internal/util"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func (c *Connection) sessionDir() string {
+	return filepath.Join(c.App.Root, filepath.FromSlash(c.cwd))
+}
+
+func (c *Connection) resolveSessionPath(requested string) (string, string, error) {
+	normalized := util.NormalizePath(requested)
+
+	relPath := path.Clean(path.Join(c.cwd, normalized))
+	if relPath == "." {
+		relPath = ""
+	}
+
+	if relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", "", fmt.Errorf("access denied: path is outside the shared folder")
+	}
+
+	return relPath, filepath.Join(c.App.Root, filepath.FromSlash(relPath)), nil
+}
+
+func (c *Connection) rootRelative(fullPath string) string {
+	absPath, err := filepath.Abs(fullPath)
+	if err != nil {
+		return util.NormalizePath(fullPath)
+	}
+
+	relPath, err := filepath.Rel(c.App.Root, absPath)
+	if err != nil {
+		return util.NormalizePath(fullPath)
+	}
+
+	return filepath.ToSlash(relPath)
+}
+
+type expectedUpload struct {
+	Dir   string
+	IsDir bool
+}
+
+func (c *Connection) expectUpload(relPath string, isDir bool) {
+	c.expectUploadIn(c.cwd, relPath, isDir)
+}
+
+func (c *Connection) expectUploadIn(dir, relPath string, isDir bool) {
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	c.expectedUploads[util.NormalizePath(relPath)] = expectedUpload{Dir: dir, IsDir: isDir}
+}
+
+func (c *Connection) takeExpectedUpload(relPath string) (string, bool) {
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+
+	relPath = util.NormalizePath(relPath)
+	if expected, ok := c.expectedUploads[relPath]; ok && !expected.IsDir {
+		delete(c.expectedUploads, relPath)
+		return filepath.Join(c.App.Root, filepath.FromSlash(expected.Dir)), true
+	}
+
+	for dir, expected := range c.expectedUploads {
+		if expected.IsDir && (dir == "." || dir == "" || strings.HasPrefix(relPath, dir+"/")) {
+			return filepath.Join(c.App.Root, filepath.FromSlash(expected.Dir)), true
+		}
+	}
+
+	return "", false
+}
+
+type expectedDownload struct {
+	Dir   string
+	Delta bool
+}
+
+func (c *Connection) expectDownload(relPath, dir string, delta bool) {
+	c.downloadsMu.Lock()
+	defer c.downloadsMu.Unlock()
+	c.expectedDownloads[util.NormalizePath(relPath)] = expectedDownload{Dir: dir, Delta: delta}
+}
+
+func (c *Connection) takeExpectedDownload(relPath string) (expectedDownload, bool) {
+	c.downloadsMu.Lock()
+	defer c.downloadsMu.Unlock()
+
+	relPath = util.NormalizePath(relPath)
+	expected, ok := c.expectedDownloads[relPath]
+	if ok {
+		delete(c.expectedDownloads, relPath)
+	}
+	return expected, ok
+}
+
+func (c *Connection) parseDirFlag(args []string) ([]string, string, error) {
+	var rest []string
+	dir := c.cwd
+	for _, arg := range args {
+		value, ok := strings.CutPrefix(arg, "--dir=")
+		if !ok {
+			rest = append(rest, arg)
+			continue
+		}
+
+		dir = path.Clean(util.NormalizePath(value))
+		if dir == "." {
+			dir = ""
+		} else if !util.IsValidRelativePath(dir) {
+			return nil, "", refusedf("Access denied: %s is outside the shared folder", value)
+		}
+	}
+	return rest, dir, nil
+}
+
+func (c *Connection) dirFlag(remoteDir string) string {
+	if remoteDir == "" || !c.HasCapability(CapDirs) {
+		return ""
+	}
+	return "--dir=" + remoteDir
+}
@@ -0,0 +1,536 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-file-sharer/internal/util"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SyncPush = "push"
+	SyncPull = "pull"
+	SyncBoth = "both"
+
+	syncActionPush         = "push"
+	syncActionPull         = "pull"
+	syncActionDeleteLocal  = "delete local"
+	syncActionDeleteRemote = "delete on peer"
+
+	syncStateFileName  = "sync.json"
+	syncCommandTimeout = 5 * time.Minute
+)
+
+type manifestEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+type syncManifest struct {
+	Dir         string          `json:"dir"`
+	ReadOnly    bool            `json:"read_only,omitempty"`
+	WriteOnly   bool            `json:"write_only,omitempty"`
+	AllowDelete bool            `json:"allow_delete,omitempty"`
+	Files       []manifestEntry `json:"files"`
+}
+
+type syncAction struct {
+	Op        string
+	Path      string
+	Hash      string
+	Overwrite string
+	Reason    string
+}
+
+type syncPlan struct {
+	Actions []syncAction
+	Synced  map[string]string
+	Kept    int
+}
+
+type syncRecord struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+type cachedHash struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+func (a *App) fileHash(path string, info os.FileInfo) (string, error) {
+	a.hashMu.Lock()
+	cached, ok := a.hashes[path]
+	a.hashMu.Unlock()
+
+	if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached.Hash, nil
+	}
+
+	hash, err := util.HashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	a.hashMu.Lock()
+	a.hashes[path] = cachedHash{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+	a.hashMu.Unlock()
+
+	return hash, nil
+}
+
+func (c *Connection) buildManifest(baseDir, dir string) (*syncManifest, error) {
+	dirPath := util.NormalizePath(dir)
+
+	if !util.IsValidRelativePath(dirPath) {
+		return nil, fmt.Errorf("Invalid path: %s (contains invalid characters or points to a parent directory)", dirPath)
+	}
+
+	if !isPathSafe(dirPath, baseDir) {
+		return nil, fmt.Errorf("Access denied: path is outside the shared folder")
+	}
+
+	fullPath := filepath.Join(baseDir, dirPath)
+	manifest := &syncManifest{
+		Dir:         c.rootRelative(fullPath),
+		ReadOnly:    c.App.Config.ReadOnly,
+		WriteOnly:   c.App.Config.WriteOnly,
+		AllowDelete: c.App.Config.AllowDelete,
+	}
+
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to access directory: %v", err)
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("SYNC can only synchronize directories")
+	}
+
+	files, err := c.walkDirectory(baseDir, fullPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		filePath := filepath.Join(baseDir, file)
+
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+		}
+
+		hash, err := c.App.fileHash(filePath, info)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to hash %s: %v", file, err)
+		}
+
+		relPath, err := filepath.Rel(fullPath, filePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+		}
+
+		manifest.Files = append(manifest.Files, manifestEntry{
+			Path:    filepath.ToSlash(relPath),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+			Hash:    hash,
+		})
+	}
+
+	return manifest, nil
+}
+
+func (m *syncManifest) index() map[string]manifestEntry {
+	files := make(map[string]manifestEntry, len(m.Files))
+	for _, file := range m.Files {
+		files[file.Path] = file
+	}
+	return files
+}
+
+func planSync(mode string, local, remote map[string]manifestEntry, base map[string]string, deletes bool) syncPlan {
+	plan := syncPlan{Synced: make(map[string]string)}
+
+	var paths []string
+	for p := range local {
+		paths = append(paths, p)
+	}
+	for p := range remote {
+		if _, ok := local[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		l, inLocal := local[p]
+		r, inRemote := remote[p]
+		baseHash, inBase := base[p]
+
+		switch {
+		case inLocal && inRemote && l.Hash == r.Hash:
+			plan.Synced[p] = l.Hash
+		case inLocal && inRemote:
+			plan.resolveChanged(mode, l, r, baseHash, inBase)
+		case inLocal:
+			plan.resolveOneSided(mode, l, baseHash, inBase, deletes, true)
+		default:
+			plan.resolveOneSided(mode, r, baseHash, inBase, deletes, false)
+		}
+	}
+
+	return plan
+}
+
+func (plan *syncPlan) add(op string, entry manifestEntry, overwrite, reason string) {
+	plan.Actions = append(plan.Actions, syncAction{
+		Op:        op,
+		Path:      entry.Path,
+		Hash:      entry.Hash,
+		Overwrite: overwrite,
+		Reason:    reason,
+	})
+}
+
+func (plan *syncPlan) resolveChanged(mode string, local, remote manifestEntry, baseHash string, inBase bool) {
+	switch {
+	case mode == SyncPush:
+		plan.add(syncActionPush, local, util.OverwriteBackup, "differs on peer")
+	case mode == SyncPull:
+		plan.add(syncActionPull, remote, util.OverwriteOverwrite, "differs locally")
+	case inBase && remote.Hash == baseHash:
+		plan.add(syncActionPush, local, util.OverwriteBackup, "changed locally")
+	case inBase && local.Hash == baseHash:
+		plan.add(syncActionPull, remote, util.OverwriteOverwrite, "changed on peer")
+	case remote.ModTime > local.ModTime:
+		plan.add(syncActionPull, remote, util.OverwriteBackup, "changed on both sides, peer copy is newer")
+	default:
+		plan.add(syncActionPush, local, util.OverwriteBackup, "changed on both sides, local copy is newer")
+	}
+}
+
+func (plan *syncPlan) resolveOneSided(mode string, entry manifestEntry, baseHash string, inBase, deletes, isLocal bool) {
+	copyOp, deleteOp, source, overwrite := syncActionPush, syncActionDeleteLocal, SyncPush, util.OverwriteBackup
+	if !isLocal {
+		copyOp, deleteOp, source, overwrite = syncActionPull, syncActionDeleteRemote, SyncPull, util.OverwriteOverwrite
+	}
+
+	switch {
+	case mode == source:
+		plan.add(copyOp, entry, overwrite, "new")
+	case mode != SyncBoth:
+		if deletes {
+			plan.add(deleteOp, entry, "", "not on the other side")
+			return
+		}
+		plan.Kept++
+	case !inBase:
+		plan.add(copyOp, entry, overwrite, "new")
+	case entry.Hash != baseHash:
+		plan.add(copyOp, entry, overwrite, "changed here, deleted on the other side")
+	case deletes:
+		plan.add(deleteOp, entry, "", "deleted on the other side")
+	default:
+		plan.Synced[entry.Path] = baseHash
+		plan.Kept++
+	}
+}
+
+func (plan syncPlan) print(dir, mode string) {
+	if len(plan.Actions) == 0 {
+		fmt.Printf("%s is already in sync (%d files)\n", dir, len(plan.Synced))
+	} else {
+		fmt.Printf("Sync plan for %s (%s):\n", dir, mode)
+	}
+
+	counts := make(map[string]int)
+	for _, action := range plan.Actions {
+		counts[action.Op]++
+		fmt.Printf("  %-14s %s (%s)\n", action.Op, path.Join(dir, action.Path), action.Reason)
+	}
+
+	if len(plan.Actions) > 0 {
+		fmt.Printf("%d to push, %d to pull, %d to delete locally, %d to delete on peer, %d unchanged\n",
+			counts[syncActionPush], counts[syncActionPull], counts[syncActionDeleteLocal], counts[syncActionDeleteRemote], len(plan.Synced))
+	}
+
+	if plan.Kept > 0 {
+		fmt.Printf("%d files exist on one side only and were left alone, use --delete to propagate deletions\n", plan.Kept)
+	}
+}
+
+func (plan syncPlan) check(local, remote *syncManifest, peer string) error {
+	for _, action := range plan.Actions {
+		switch action.Op {
+		case syncActionPush:
+			if local.ReadOnly {
+				return fmt.Errorf("this node is in read-only mode and cannot send files")
+			}
+			if remote.WriteOnly {
+				return fmt.Errorf("peer %s is in write-only mode and cannot receive files", peer)
+			}
+		case syncActionPull:
+			if remote.ReadOnly {
+				return fmt.Errorf("peer %s is in read-only mode and cannot send files", peer)
+			}
+			if local.WriteOnly {
+				return fmt.Errorf("this node is in write-only mode and cannot receive files")
+			}
+		case syncActionDeleteRemote:
+			if remote.WriteOnly {
+				return fmt.Errorf("peer %s is in write-only mode and cannot delete files", peer)
+			}
+			if !remote.AllowDelete {
+				return fmt.Errorf("peer %s does not accept deletions, it must be started with --allow-delete", peer)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *CommandParser) syncDirectory(conn *Connection, dir, mode string, dryRun, deletes bool) error {
+	local, err := conn.buildManifest(p.App.Config.Folder, dir)
+	if err != nil {
+		return err
+	}
+
+	result, err := conn.executeCommand(syncCommandTimeout, "MANIFEST", dir)
+	if err != nil {
+		return err
+	}
+
+	var remote syncManifest
+	if err := json.Unmarshal([]byte(result), &remote); err != nil {
+		return fmt.Errorf("invalid manifest from peer: %v", err)
+	}
+
+	key := fmt.Sprintf("%s|%s|%s", conn.RemoteNodeID, local.Dir, remote.Dir)
+	plan := planSync(mode, local.index(), remote.index(), p.App.loadSyncBase(key), deletes)
+	plan.print(dir, mode)
+
+	if dryRun {
+		fmt.Println("Dry run, nothing was changed")
+		return nil
+	}
+
+	if err := plan.check(local, &remote, conn.PeerLabel()); err != nil {
+		return err
+	}
+
+	p.App.saveSyncBase(key, plan.Synced)
+
+	batch := p.App.Queue.NewBatch("SYNC " + dir)
+	defer p.App.Queue.CloseBatch(batch)
+
+	var remoteDeletes []string
+	for _, action := range plan.Actions {
+		filePath := path.Join(dir, action.Path)
+		record := &syncRecord{Key: key, Path: action.Path, Hash: action.Hash}
+
+		switch action.Op {
+		case syncActionPush, syncActionPull:
+			op := QueueOpPut
+			if action.Op == syncActionPull {
+				op = QueueOpGet
+			}
+
+			if err := p.enqueue(QueueItem{Op: op, Path: filePath, Overwrite: action.Overwrite, Batch: batch, Sync: record}); err != nil {
+				return err
+			}
+		case syncActionDeleteLocal:
+			backup, err := conn.removeFile(p.App.Config.Folder, filePath)
+			if err != nil {
+				fmt.Printf("Failed to delete %s: %v\n", filePath, err)
+				continue
+			}
+			fmt.Printf("Deleted %s (previous version kept in %s)\n", filePath, backup)
+		case syncActionDeleteRemote:
+			remoteDeletes = append(remoteDeletes, filePath)
+		}
+	}
+
+	if len(remoteDeletes) > 0 {
+		result, err := conn.ExecuteCommand("REMOVE", remoteDeletes...)
+		if err != nil {
+			return err
+		}
+		fmt.Println(result)
+	}
+
+	return nil
+}
+
+func (c *Connection) handleManifestCommand(baseDir string, cmd *Command) Message {
+	dir := "."
+	if len(cmd.Args) > 0 {
+		dir = cmd.Args[0]
+	}
+
+	manifest, err := c.buildManifest(baseDir, dir)
+	if err != nil {
+		return Message{
+			Type: MsgTypeError,
+			Data: err.Error(),
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return Message{
+			Type: MsgTypeError,
+			Data: fmt.Sprintf("Failed to encode manifest: %v", err),
+		}
+	}
+
+	return Message{
+		Type: MsgTypeCommandResult,
+		Data: string(data),
+	}
+}
+
+func (c *Connection) handleRemoveCommand(cmd *Command) Message {
+	if len(cmd.Args) < 1 {
+		return Message{
+			Type: MsgTypeError,
+			Data: "REMOVE requires at least one file",
+		}
+	}
+
+	if c.App.Config.WriteOnly {
+		return Message{
+			Type: MsgTypeError,
+			Data: "This node is in write-only mode and cannot delete files",
+		}
+	}
+
+	if !c.App.Config.AllowDelete {
+		return errorMessage(refusedf("This node does not accept deletions from peers (start it with --allow-delete)"))
+	}
+
+	removed := 0
+	var failed []string
+	for _, file := range cmd.Args {
+		backup, err := c.removeFile(c.sessionDir(), file)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", file, err))
+			continue
+		}
+
+		c.Log.Info("Peer %s deleted %s, previous version kept in %s", c.PeerLabel(), file, backup)
+		removed++
+	}
+
+	result := fmt.Sprintf("Deleted %d files on %s", removed, c.Name)
+	if len(failed) > 0 {
+		result += "\nFailed to delete: " + strings.Join(failed, ", ")
+	}
+
+	return Message{
+		Type: MsgTypeCommandResult,
+		Data: result,
+	}
+}
+
+func (c *Connection) removeFile(baseDir, file string) (string, error) {
+	if !util.IsValidRelativePath(file) || !isPathSafe(file, baseDir) {
+		return "", fmt.Errorf("invalid path")
+	}
+
+	fullPath := filepath.Join(baseDir, file)
+	c.loadIgnoreList()
+	if c.App.reservedPath(fullPath) || isPartFile(fullPath) || c.ignoreList.ShouldIgnore(c.rootRelative(fullPath), false) {
+		return "", fmt.Errorf("file cannot be removed")
+	}
+
+	if absPath, err := filepath.Abs(fullPath); err != nil || !withinRoot(c.App.Root, filepath.Dir(absPath)) {
+		return "", fmt.Errorf("file cannot be removed")
+	}
+
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("file not found")
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("is a directory")
+	}
+
+	return c.App.BackupFile(fullPath)
+}
+
+func (a *App) loadSyncState() map[string]map[string]string {
+	state := make(map[string]map[string]string)
+
+	data, err := os.ReadFile(filepath.Join(a.StateDir, syncStateFileName))
+	if err != nil {
+		return state
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		a.Log.Warn("Ignoring invalid sync state: %v", err)
+	}
+	return state
+}
+
+func (a *App) writeSyncState(state map[string]map[string]string) {
+	statePath := filepath.Join(a.StateDir, syncStateFileName)
+	if err := os.MkdirAll(a.StateDir, 0700); err != nil {
+		a.Log.Warn("Failed to save sync state: %v", err)
+		return
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		a.Log.Warn("Failed to save sync state: %v", err)
+		return
+	}
+
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		a.Log.Warn("Failed to save sync state: %v", err)
+		return
+	}
+
+	if err := os.Rename(tmp, statePath); err != nil {
+		a.Log.Warn("Failed to save sync state: %v", err)
+	}
+}
+
+func (a *App) loadSyncBase(key string) map[string]string {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	return a.loadSyncState()[key]
+}
+
+func (a *App) saveSyncBase(key string, base map[string]string) {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	state := a.loadSyncState()
+	state[key] = base
+	a.writeSyncState(state)
+}
+
+func (a *App) recordSynced(record *syncRecord) {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	state := a.loadSyncState()
+	if state[record.Key] == nil {
+		state[record.Key] = make(map[string]string)
+	}
+	state[record.Key][record.Path] = record.Hash
+	a.writeSyncState(state)
+}
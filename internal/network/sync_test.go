@@ -0,0 +1,203 @@
+package network
+
+import (
+	"local-file-sharer/internal/util"
+	"reflect"
+	"testing"
+)
+
+func TestPlanSync(t *testing.T) {
+	entry := func(path, hash string, mtime int64) manifestEntry {
+		return manifestEntry{Path: path, Hash: hash, ModTime: mtime}
+	}
+	files := func(entries ...manifestEntry) map[string]manifestEntry {
+		m := make(map[string]manifestEntry)
+		for _, e := range entries {
+			m[e.Path] = e
+		}
+		return m
+	}
+
+	type action struct {
+		Op        string
+		Path      string
+		Hash      string
+		Overwrite string
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		local   map[string]manifestEntry
+		remote  map[string]manifestEntry
+		base    map[string]string
+		deletes bool
+		want    []action
+		synced  int
+		kept    int
+	}{
+		{
+			name:   "identical",
+			mode:   SyncBoth,
+			local:  files(entry("a", "h1", 1)),
+			remote: files(entry("a", "h1", 2)),
+			synced: 1,
+		},
+		{
+			name:   "push replaces differing copy",
+			mode:   SyncPush,
+			local:  files(entry("a", "h1", 1)),
+			remote: files(entry("a", "h2", 2)),
+			want:   []action{{syncActionPush, "a", "h1", util.OverwriteBackup}},
+		},
+		{
+			name:   "pull replaces differing copy",
+			mode:   SyncPull,
+			local:  files(entry("a", "h1", 2)),
+			remote: files(entry("a", "h2", 1)),
+			want:   []action{{syncActionPull, "a", "h2", util.OverwriteOverwrite}},
+		},
+		{
+			name:   "changed locally",
+			mode:   SyncBoth,
+			local:  files(entry("a", "h2", 1)),
+			remote: files(entry("a", "h1", 2)),
+			base:   map[string]string{"a": "h1"},
+			want:   []action{{syncActionPush, "a", "h2", util.OverwriteBackup}},
+		},
+		{
+			name:   "changed on peer",
+			mode:   SyncBoth,
+			local:  files(entry("a", "h1", 2)),
+			remote: files(entry("a", "h2", 1)),
+			base:   map[string]string{"a": "h1"},
+			want:   []action{{syncActionPull, "a", "h2", util.OverwriteOverwrite}},
+		},
+		{
+			name:   "conflict with newer peer copy",
+			mode:   SyncBoth,
+			local:  files(entry("a", "h2", 1)),
+			remote: files(entry("a", "h3", 2)),
+			base:   map[string]string{"a": "h1"},
+			want:   []action{{syncActionPull, "a", "h3", util.OverwriteBackup}},
+		},
+		{
+			name:   "conflict with newer local copy",
+			mode:   SyncBoth,
+			local:  files(entry("a", "h2", 2)),
+			remote: files(entry("a", "h3", 1)),
+			base:   map[string]string{"a": "h1"},
+			want:   []action{{syncActionPush, "a", "h2", util.OverwriteBackup}},
+		},
+		{
+			name:   "conflict without previous sync",
+			mode:   SyncBoth,
+			local:  files(entry("a", "h2", 1)),
+			remote: files(entry("a", "h3", 2)),
+			want:   []action{{syncActionPull, "a", "h3", util.OverwriteBackup}},
+		},
+		{
+			name:   "new on either side",
+			mode:   SyncBoth,
+			local:  files(entry("b", "h1", 1)),
+			remote: files(entry("a", "h2", 1)),
+			want: []action{
+				{syncActionPull, "a", "h2", util.OverwriteOverwrite},
+				{syncActionPush, "b", "h1", util.OverwriteBackup},
+			},
+		},
+		{
+			name:   "deleted on peer without deletes",
+			mode:   SyncBoth,
+			local:  files(entry("a", "h1", 1)),
+			base:   map[string]string{"a": "h1"},
+			synced: 1,
+			kept:   1,
+		},
+		{
+			name:    "deleted on peer with deletes",
+			mode:    SyncBoth,
+			local:   files(entry("a", "h1", 1)),
+			base:    map[string]string{"a": "h1"},
+			deletes: true,
+			want:    []action{{syncActionDeleteLocal, "a", "h1", ""}},
+		},
+		{
+			name:    "deleted locally with deletes",
+			mode:    SyncBoth,
+			remote:  files(entry("a", "h1", 1)),
+			base:    map[string]string{"a": "h1"},
+			deletes: true,
+			want:    []action{{syncActionDeleteRemote, "a", "h1", ""}},
+		},
+		{
+			name:    "changed here and deleted on peer",
+			mode:    SyncBoth,
+			local:   files(entry("a", "h2", 1)),
+			base:    map[string]string{"a": "h1"},
+			deletes: true,
+			want:    []action{{syncActionPush, "a", "h2", util.OverwriteBackup}},
+		},
+		{
+			name:    "changed on peer and deleted here",
+			mode:    SyncBoth,
+			remote:  files(entry("a", "h2", 1)),
+			base:    map[string]string{"a": "h1"},
+			deletes: true,
+			want:    []action{{syncActionPull, "a", "h2", util.OverwriteOverwrite}},
+		},
+		{
+			name:   "push leaves peer-only files alone",
+			mode:   SyncPush,
+			local:  files(entry("a", "h1", 1)),
+			remote: files(entry("b", "h2", 1)),
+			want:   []action{{syncActionPush, "a", "h1", util.OverwriteBackup}},
+			kept:   1,
+		},
+		{
+			name:    "push with deletes removes peer-only files",
+			mode:    SyncPush,
+			remote:  files(entry("b", "h2", 1)),
+			deletes: true,
+			want:    []action{{syncActionDeleteRemote, "b", "h2", ""}},
+		},
+		{
+			name:    "pull with deletes removes local-only files",
+			mode:    SyncPull,
+			local:   files(entry("b", "h2", 1)),
+			deletes: true,
+			want:    []action{{syncActionDeleteLocal, "b", "h2", ""}},
+		},
+		{
+			name:   "actions are sorted by path",
+			mode:   SyncPush,
+			local:  files(entry("c", "h3", 1), entry("a", "h1", 1), entry("b/x", "h2", 1)),
+			remote: files(),
+			want: []action{
+				{syncActionPush, "a", "h1", util.OverwriteBackup},
+				{syncActionPush, "b/x", "h2", util.OverwriteBackup},
+				{syncActionPush, "c", "h3", util.OverwriteBackup},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planSync(tt.mode, tt.local, tt.remote, tt.base, tt.deletes)
+
+			var got []action
+			for _, a := range plan.Actions {
+				got = append(got, action{a.Op, a.Path, a.Hash, a.Overwrite})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("actions = %v, want %v", got, tt.want)
+			}
+			if len(plan.Synced) != tt.synced {
+				t.Errorf("synced = %d, want %d", len(plan.Synced), tt.synced)
+			}
+			if plan.Kept != tt.kept {
+				t.Errorf("kept = %d, want %d", plan.Kept, tt.kept)
+			}
+		})
+	}
+}
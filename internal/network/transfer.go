@@ -1,8 +1,12 @@
 package network
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"local-file-sharer/internal/util"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -15,10 +19,12 @@ const (
 	TransferStatusFailed     = "failed"
 	TransferStatusWaitingAck = "waiting_ack"
 	TransferStatusPaused     = "paused"
+	TransferStatusSkipped    = "skipped"
 )
 
 type FileTransfer struct {
 	ID               int
+	WireID           uint32
 	Name             string
 	Type             string
 	Status           string
@@ -29,12 +35,31 @@ type FileTransfer struct {
 	Speed            float64
 	Conn             *Connection
 	File             *os.File
+	Path             string
+	BaseDir          string
+	Hash             hash.Hash
+	AckID            string
+	Offset           int64
 	LastProgress     int64
 	LastProgressTime time.Time
 	LastSpeedUpdate  time.Time
 	Retries          int
-	AckIDs           map[string]bool
+	Window           *flowWindow
+	Compressed       bool
+	WireBytes        int64
+	Limiter          *rateLimiter
+	heldAcks         sync.Map
+	QueueID          int
+	Overwrite        string
+	Skipped          string
+	Metadata         fileMetadata
 	LastBytes        int64
+	Ranges           []*fileRange
+	Delta            bool
+	DeltaApplied     bool
+	DeltaCopied      int64
+	Dedup            bool
+	Chunks           []fileChunk
 }
 
 func NewFileTransfer(name string, size int64, transferType string, conn *Connection) *FileTransfer {
@@ -51,7 +76,8 @@ func NewFileTransfer(name string, size int64, transferType string, conn *Connect
 		LastSpeedUpdate:  now,
 		Speed:            0,
 		Conn:             conn,
-		AckIDs:           make(map[string]bool),
+		Hash:             sha256.New(),
+		Limiter:          newRateLimiter(0),
 		LastBytes:        0,
 	}
 }
@@ -124,9 +150,14 @@ func (t *FileTransfer) UpdateProgress(bytesTransferred int64, calculatedSpeed fl
 		displaySpeed = 0.01
 	}
 
+	var wire string
+	if t.Compressed {
+		wire = fmt.Sprintf(" [%s wire / %s data]", util.FormatFileSize(t.WireBytes), util.FormatFileSize(t.BytesTransferred-t.Offset))
+	}
+
 	fmt.Printf("\r%-90s", " ")
-	fmt.Printf("\r%s %s: %s %.1f%% (%.2f KB/s) ETA: %s",
-		typeStr, t.Name, progBar, percentage, displaySpeed, eta)
+	fmt.Printf("\r%s %s: %s %.1f%% (%.2f KB/s) ETA: %s%s",
+		typeStr, t.Name, progBar, percentage, displaySpeed, eta, wire)
 }
 
 func (t *FileTransfer) Pause() {
@@ -145,30 +176,26 @@ func (t *FileTransfer) Resume() {
 	}
 }
 
-func (t *FileTransfer) WaitForAcknowledgment(timeout time.Duration) bool {
-	if len(t.AckIDs) == 0 {
-		return true
+func (t *FileTransfer) CloseFile() {
+	if t.File == nil {
+		return
 	}
 
-	checkInterval := 100 * time.Millisecond
-	endTime := time.Now().Add(timeout)
-
-	for time.Now().Before(endTime) {
-		if len(t.AckIDs) == 0 {
-			return true
-		}
-		time.Sleep(checkInterval)
+	if t.Type == TransferTypeReceive && t.Delta {
+		t.File.Truncate(t.deltaPrefix())
+	} else if t.Type == TransferTypeReceive && len(t.Ranges) > 0 {
+		t.File.Truncate(contiguousBytes(t.Ranges))
 	}
 
-	return false
+	t.File.Close()
+	t.File = nil
 }
 
-func (t *FileTransfer) RegisterAckID(id string) {
-	t.AckIDs[id] = true
-}
-
-func (t *FileTransfer) AcknowledgeID(id string) {
-	delete(t.AckIDs, id)
+func (t *FileTransfer) SyncFile() error {
+	if t.File == nil {
+		return nil
+	}
+	return t.File.Sync()
 }
 
 func generateProgressBar(percentage float64, width int) string {
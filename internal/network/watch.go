@@ -0,0 +1,372 @@
+package network
+
+import (
+	"fmt"
+	"io/fs"
+	"local-file-sharer/internal/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	watchDebounce     = 2 * time.Second
+	watchTick         = 500 * time.Millisecond
+	watchPollInterval = 2 * time.Second
+	watchEventBuffer  = 1024
+)
+
+type notifier interface {
+	Events() <-chan string
+	Close() error
+}
+
+type dirWatch struct {
+	Dir       string
+	PeerID    string
+	PeerName  string
+	Overwrite string
+	Polling   bool
+
+	debounce time.Duration
+	app      *App
+	path     string
+	notifier notifier
+	pending  map[string]time.Time
+	stop     chan struct{}
+}
+
+type receivedFile struct {
+	Size    int64
+	ModTime time.Time
+}
+
+func (a *App) StartWatch(dir string, conn *Connection, overwrite string) (*dirWatch, error) {
+	fullPath, err := filepath.Abs(filepath.Join(a.Config.Folder, util.NormalizePath(dir)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %v", err)
+	}
+
+	rel, err := filepath.Rel(a.Root, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("access denied: %s is outside the shared folder", dir)
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("directory not found: %s", dir)
+	}
+
+	if overwrite == "" {
+		overwrite = a.Config.Overwrite
+	}
+
+	w := &dirWatch{
+		Dir:       filepath.ToSlash(rel),
+		Overwrite: overwrite,
+		debounce:  watchDebounce,
+		app:       a,
+		path:      fullPath,
+		pending:   make(map[string]time.Time),
+		stop:      make(chan struct{}),
+	}
+	if conn != nil {
+		w.PeerID = conn.RemoteNodeID
+		w.PeerName = conn.RemoteName
+	}
+
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+
+	for _, existing := range a.watches {
+		if existing.path == w.path && existing.PeerID == w.PeerID {
+			return nil, fmt.Errorf("%s is already being watched", w.Dir)
+		}
+	}
+
+	skip := func(path string) bool { return path == a.StateDir }
+	w.notifier, err = newNotifier(fullPath, skip)
+	if err != nil {
+		a.Log.Warn("Filesystem notifications unavailable for %s, scanning every %v instead: %v", w.Dir, watchPollInterval, err)
+		w.notifier = newPollNotifier(fullPath, skip)
+		w.Polling = true
+		w.debounce += watchPollInterval
+	}
+
+	a.watches = append(a.watches, w)
+	go w.run()
+	return w, nil
+}
+
+func (a *App) StopWatch(dir string) (int, error) {
+	fullPath, err := filepath.Abs(filepath.Join(a.Config.Folder, util.NormalizePath(dir)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve path: %v", err)
+	}
+
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+
+	var kept []*dirWatch
+	stopped := 0
+	for _, w := range a.watches {
+		if w.path != fullPath {
+			kept = append(kept, w)
+			continue
+		}
+		close(w.stop)
+		stopped++
+	}
+
+	if stopped == 0 {
+		return 0, fmt.Errorf("%s is not being watched", dir)
+	}
+
+	a.watches = kept
+	return stopped, nil
+}
+
+func (a *App) removeWatch(w *dirWatch) {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+
+	for i, existing := range a.watches {
+		if existing == w {
+			a.watches = append(a.watches[:i], a.watches[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *App) Watches() []*dirWatch {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	return append([]*dirWatch(nil), a.watches...)
+}
+
+func (a *App) markReceived(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+
+	if len(a.watches) > 0 {
+		a.received[path] = receivedFile{Size: info.Size(), ModTime: info.ModTime()}
+	}
+}
+
+func (a *App) wasReceived(path string, info os.FileInfo) bool {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+
+	received, ok := a.received[path]
+	if !ok {
+		return false
+	}
+	if received.Size == info.Size() && received.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+
+	delete(a.received, path)
+	return false
+}
+
+func (w *dirWatch) run() {
+	ticker := time.NewTicker(watchTick)
+	defer ticker.Stop()
+
+	events := w.notifier.Events()
+	for {
+		select {
+		case <-w.stop:
+			w.notifier.Close()
+			return
+		case path, ok := <-events:
+			if !ok {
+				w.app.Log.Warn("Stopped watching %s: notifications ended", w.Dir)
+				w.app.removeWatch(w)
+				return
+			}
+			w.pending[path] = time.Now()
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *dirWatch) flush() {
+	var due []string
+	for path, last := range w.pending {
+		if time.Since(last) >= w.debounce {
+			due = append(due, path)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.Strings(due)
+
+	filters := make(map[*Connection]*util.IgnoreList)
+	for _, path := range due {
+		if w.push(path, filters) {
+			delete(w.pending, path)
+		}
+	}
+}
+
+func (w *dirWatch) push(path string, filters map[*Connection]*util.IgnoreList) bool {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || isPartFile(path) {
+		return true
+	}
+
+	rootRel, err := filepath.Rel(w.app.Root, path)
+	if err != nil {
+		return true
+	}
+	rootRel = filepath.ToSlash(rootRel)
+
+	if w.app.wasReceived(path, info) {
+		return true
+	}
+
+	conns := w.connections()
+	if len(conns) == 0 {
+		return false
+	}
+
+	done := true
+	for _, conn := range conns {
+		filter, ok := filters[conn]
+		if !ok {
+			filter, err = conn.shareFilter()
+			if err != nil {
+				w.app.Log.Warn("Failed to load share filters for %s: %v", conn.PeerLabel(), err)
+			}
+			filters[conn] = filter
+		}
+		if filter == nil || filter.ShouldIgnore(rootRel, false) {
+			continue
+		}
+
+		item, added := w.app.Queue.Add(conn, QueueItem{Op: QueueOpPut, Path: rootRel, Dir: w.app.Root, Overwrite: w.Overwrite})
+		switch {
+		case added:
+			w.app.Log.Info("Pushing changed %s to %s [%d]", rootRel, conn.PeerLabel(), item.ID)
+		case item.Status == QueueStatusActive:
+			done = false
+		}
+	}
+	return done
+}
+
+func (w *dirWatch) connections() []*Connection {
+	if w.PeerID != "" {
+		if conn := w.app.findPeerConnection(w.PeerID); conn != nil {
+			return []*Connection{conn}
+		}
+		return nil
+	}
+
+	var conns []*Connection
+	for _, conn := range w.app.GetActiveConnections() {
+		if conn.established && !conn.Reconnecting() && conn.checkTransferProtocol() == nil {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+type pollNotifier struct {
+	events chan string
+	stop   chan struct{}
+}
+
+type polledFile struct {
+	Size    int64
+	ModTime int64
+}
+
+func newPollNotifier(root string, skip func(string) bool) *pollNotifier {
+	n := &pollNotifier{
+		events: make(chan string, watchEventBuffer),
+		stop:   make(chan struct{}),
+	}
+	go n.run(root, skip)
+	return n
+}
+
+func (n *pollNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *pollNotifier) Close() error {
+	close(n.stop)
+	return nil
+}
+
+func (n *pollNotifier) run(root string, skip func(string) bool) {
+	defer close(n.events)
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	known := scanFiles(root, skip)
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := scanFiles(root, skip)
+		for path, state := range current {
+			if known[path] == state {
+				continue
+			}
+
+			select {
+			case n.events <- path:
+			case <-n.stop:
+				return
+			}
+		}
+		known = current
+	}
+}
+
+func scanFiles(root string, skip func(string) bool) map[string]polledFile {
+	files := make(map[string]polledFile)
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.IsDir() {
+			if skip(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		files[path] = polledFile{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		return nil
+	})
+
+	return files
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+type inotifyNotifier struct {
+	fd     int
+	file   *os.File
+	dirs   map[int32]string
+	skip   func(string) bool
+	events chan string
+	closed chan struct{}
+}
+
+func newNotifier(root string, skip func(string) bool) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &inotifyNotifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+		skip:   skip,
+		events: make(chan string, watchEventBuffer),
+		closed: make(chan struct{}),
+	}
+
+	if err := n.addTree(root, false); err != nil {
+		n.file.Close()
+		return nil, err
+	}
+
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *inotifyNotifier) Close() error {
+	close(n.closed)
+	return n.file.Close()
+}
+
+func (n *inotifyNotifier) send(path string) {
+	select {
+	case n.events <- path:
+	case <-n.closed:
+	}
+}
+
+func (n *inotifyNotifier) addTree(dir string, report bool) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+
+		if !entry.IsDir() {
+			if report {
+				n.send(path)
+			}
+			return nil
+		}
+
+		if n.skip(path) {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(n.fd, path, inotifyMask)
+		if err != nil {
+			return err
+		}
+		n.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (n *inotifyNotifier) read() {
+	defer close(n.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			name := strings.TrimRight(string(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+length]), "\x00")
+			offset += syscall.SizeofInotifyEvent + length
+
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(n.dirs, wd)
+				continue
+			}
+
+			dir, ok := n.dirs[wd]
+			if !ok || name == "" {
+				continue
+			}
+
+			path := filepath.Join(dir, name)
+			if mask&syscall.IN_ISDIR == 0 {
+				n.send(path)
+				continue
+			}
+
+			if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				n.addTree(path, true)
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package network
+
+import "errors"
+
+func newNotifier(root string, skip func(string) bool) (notifier, error) {
+	return nil, errors.New("filesystem notifications are not supported on this platform")
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+)
+
+const userXattrPrefix = "user."
+
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if !strings.HasPrefix(string(name), userXattrPrefix) {
+			continue
+		}
+
+		valueSize, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+
+		value := make([]byte, valueSize)
+		valueSize, err = syscall.Getxattr(path, string(name), value)
+		if err != nil {
+			continue
+		}
+		xattrs[string(name)] = value[:valueSize]
+	}
+
+	return xattrs, nil
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if !strings.HasPrefix(name, userXattrPrefix) {
+			continue
+		}
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
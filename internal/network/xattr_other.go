@@ -0,0 +1,15 @@
+//go:build !linux
+
+package network
+
+import "errors"
+
+var errXattrsUnsupported = errors.New("extended attributes are not supported on this platform")
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, errXattrsUnsupported
+}
+
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	return errXattrsUnsupported
+}
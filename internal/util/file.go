@@ -1,7 +1,9 @@
 package util
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -110,6 +112,63 @@ func FormatFileSize(size int64) string {
 	return fmt.Sprintf("%.1f GB", float64(size)/(1024*1024*1024))
 }
 
+func FormatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return FormatFileSize(rate) + "/s"
+}
+
+func ParseRate(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "/S")
+	value = strings.TrimSuffix(value, "B")
+
+	if value == "" || value == "0" || value == "OFF" || value == "UNLIMITED" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	switch value[len(value)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+	return int64(number * multiplier), nil
+}
+
+const (
+	OverwriteRename    = "rename"
+	OverwriteOverwrite = "overwrite"
+	OverwriteSkip      = "skip"
+	OverwriteNewer     = "newer"
+	OverwriteAsk       = "ask"
+	OverwriteBackup    = "backup"
+)
+
+var OverwritePolicies = []string{OverwriteRename, OverwriteOverwrite, OverwriteSkip, OverwriteNewer, OverwriteAsk, OverwriteBackup}
+
+func ParseOverwritePolicy(s string) (string, error) {
+	policy := strings.ToLower(strings.TrimSpace(s))
+	for _, known := range OverwritePolicies {
+		if policy == known {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("invalid overwrite policy %q (use %s)", s, strings.Join(OverwritePolicies, ", "))
+}
+
 func ListFilesRecursive(dirPath string) ([]string, error) {
 	var files []string
 
@@ -233,7 +292,7 @@ func ResolvePath(path, baseDir string) (string, error) {
 }
 
 func FilterIgnoredFiles(files []string, baseDir string, ignoreList *IgnoreList) []string {
-	if ignoreList == nil || len(ignoreList.Patterns) == 0 {
+	if ignoreList == nil {
 		return files
 	}
 
@@ -279,3 +338,38 @@ func EnsureUniqueFilename(filePath string) string {
 		counter++
 	}
 }
+
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+func HashFilePrefix(path string, length int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	n, err := io.CopyN(hasher, file, length)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if n != length {
+		return "", fmt.Errorf("file is shorter than %d bytes", length)
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
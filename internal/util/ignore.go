@@ -3,130 +3,482 @@ package util
 import (
 	"bufio"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+)
+
+const (
+	IgnoreFileName  = ".p2pignore"
+	IncludeFileName = ".p2pinclude"
 )
 
 type IgnorePattern struct {
-	Pattern string
-	IsDir   bool
+	Pattern  string
+	IsDir    bool
+	Negate   bool
+	Include  bool
+	Anchored bool
+	Source   string
+	Line     int
+	Text     string
+
+	base     string
+	regex    *regexp.Regexp
+	segments []*regexp.Regexp
 }
 
 type IgnoreList struct {
-	Patterns []IgnorePattern
-	RawLines []string
+	Patterns     []IgnorePattern
+	PeerPatterns []IgnorePattern
+	RawLines     []string
+	Root         string
+
+	mu     sync.Mutex
+	nested map[string][]IgnorePattern
 }
 
-func LoadIgnoreFile(baseFolder string) (*IgnoreList, error) {
-	ignoreFile := filepath.Join(baseFolder, ".p2pignore")
+type IgnoreMatch struct {
+	Pattern     *IgnorePattern
+	Path        string
+	Ignored     bool
+	NotIncluded bool
+}
 
-	if _, err := os.Stat(ignoreFile); os.IsNotExist(err) {
+var builtinIgnores = []IgnorePattern{
+	{Pattern: IgnoreFileName, Source: "built-in", Text: IgnoreFileName},
+	{Pattern: IncludeFileName, Source: "built-in", Text: IncludeFileName},
+	{Pattern: StateDirName, Anchored: true, Source: "built-in", Text: "/" + StateDirName},
+}
 
-		return &IgnoreList{
-			Patterns: []IgnorePattern{},
-			RawLines: []string{},
-		}, nil
+func LoadIgnoreFile(baseFolder string) (*IgnoreList, error) {
+	ignoreList := &IgnoreList{
+		Patterns: []IgnorePattern{},
+		RawLines: []string{},
+		Root:     baseFolder,
+		nested:   make(map[string][]IgnorePattern),
 	}
 
-	file, err := os.Open(ignoreFile)
+	patterns, lines, err := readIgnoreFile(baseFolder, "")
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	ignoreList := &IgnoreList{
-		Patterns: []IgnorePattern{},
-		RawLines: []string{},
+	ignoreList.Patterns = patterns
+	ignoreList.RawLines = lines
+	ignoreList.nested[""] = patterns
+	return ignoreList, nil
+}
+
+func DenyAllIgnoreList(source string) *IgnoreList {
+	pattern, _ := parseIgnorePattern("*", false)
+	pattern.Source = source
+
+	return &IgnoreList{
+		Patterns: []IgnorePattern{pattern},
+		RawLines: []string{pattern.Text},
+	}
+}
+
+func (il *IgnoreList) AddPeerFile(source string) error {
+	patterns, _, err := readPatternFile(il.Root, source, "", false)
+	if err != nil {
+		return err
+	}
+
+	il.PeerPatterns = append(il.PeerPatterns, patterns...)
+	return nil
+}
+
+func readIgnoreFile(root, dir string) ([]IgnorePattern, []string, error) {
+	patterns, lines, err := readPatternFile(root, path.Join(dir, IgnoreFileName), dir, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	includes, includeLines, err := readPatternFile(root, path.Join(dir, IncludeFileName), dir, true)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	return append(patterns, includes...), append(lines, includeLines...), nil
+}
+
+func readPatternFile(root, source, base string, include bool) ([]IgnorePattern, []string, error) {
+	file, err := os.Open(filepath.Join(root, filepath.FromSlash(source)))
+	if os.IsNotExist(err) {
+		return []IgnorePattern{}, []string{}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	patterns := []IgnorePattern{}
+	lines := []string{}
+
 	scanner := bufio.NewScanner(file)
+	lineNo := 0
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		lineNo++
 
+		line := trimIgnoreLine(strings.TrimSuffix(scanner.Text(), "\r"))
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
-		ignoreList.RawLines = append(ignoreList.RawLines, line)
+		pattern, ok := parseIgnorePattern(line, include)
+		if !ok {
+			continue
+		}
 
-		isDir := strings.HasSuffix(line, "/")
-		if isDir {
-			line = line[:len(line)-1]
+		pattern.Source = source
+		pattern.Line = lineNo
+		pattern.base = base
+		lines = append(lines, line)
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, lines, scanner.Err()
+}
+
+func trimIgnoreLine(line string) string {
+	end := len(line)
+	for end > 0 && (line[end-1] == ' ' || line[end-1] == '\t') {
+		if end > 1 && line[end-2] == '\\' {
+			break
 		}
+		end--
+	}
+	return line[:end]
+}
+
+func parseIgnorePattern(line string, include bool) (IgnorePattern, bool) {
+	pattern := IgnorePattern{Text: line, Include: include}
+
+	if strings.HasPrefix(line, "+") {
+		pattern.Include = true
+		line = line[1:]
+	}
+
+	switch {
+	case strings.HasPrefix(line, "!"):
+		pattern.Negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`), strings.HasPrefix(line, `\+`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.IsDir = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	pattern.Anchored = strings.Contains(line, "/")
+	line = strings.TrimLeft(line, "/")
+	if line == "" {
+		return pattern, false
+	}
+	pattern.Pattern = line
 
-		ignoreList.Patterns = append(ignoreList.Patterns, IgnorePattern{
-			Pattern: line,
-			IsDir:   isDir,
-		})
+	regex, err := regexp.Compile(globToRegexp(line, pattern.Anchored))
+	if err != nil {
+		return pattern, false
 	}
+	pattern.regex = regex
+
+	if pattern.Anchored {
+		for _, segment := range strings.Split(line, "/") {
+			if segment == "**" {
+				pattern.segments = append(pattern.segments, nil)
+				continue
+			}
 
-	return ignoreList, scanner.Err()
+			var b strings.Builder
+			writeGlobSegment(&b, segment)
+			regex, err := regexp.Compile("^" + b.String() + "$")
+			if err != nil {
+				return pattern, false
+			}
+			pattern.segments = append(pattern.segments, regex)
+		}
+	}
+
+	return pattern, true
 }
 
-func (il *IgnoreList) ShouldIgnore(path string, isDir bool) bool {
-	if il == nil {
-		return false
+func globToRegexp(pattern string, anchored bool) string {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
 	}
 
-	filename := filepath.Base(path)
-	if filename == ".p2pignore" {
-		return true
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		if segment == "**" {
+			if last {
+				b.WriteString(".*")
+			} else {
+				b.WriteString("(?:.*/)?")
+			}
+			continue
+		}
+
+		writeGlobSegment(&b, segment)
+		if !last {
+			b.WriteString("/")
+		}
 	}
 
-	if len(il.Patterns) == 0 {
+	b.WriteString("$")
+	return b.String()
+}
+
+func writeGlobSegment(b *strings.Builder, segment string) {
+	for i := 0; i < len(segment); i++ {
+		switch ch := segment[i]; ch {
+		case '\\':
+			if i+1 < len(segment) {
+				i++
+				b.WriteString(regexp.QuoteMeta(segment[i : i+1]))
+			}
+		case '*':
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := i + 1
+			if end < len(segment) && (segment[end] == '!' || segment[end] == '^') {
+				end++
+			}
+			if end < len(segment) && segment[end] == ']' {
+				end++
+			}
+			for end < len(segment) && segment[end] != ']' {
+				end++
+			}
+			if end >= len(segment) {
+				b.WriteString(`\[`)
+				continue
+			}
+
+			class := segment[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(segment[i : i+1]))
+		}
+	}
+}
+
+func (p *IgnorePattern) matches(relPath string, isDir bool) bool {
+	if p.IsDir && !isDir {
 		return false
 	}
 
-	for _, pattern := range il.Patterns {
+	if p.regex == nil {
+		if p.Anchored {
+			return relPath == p.Pattern
+		}
+		return path.Base(relPath) == p.Pattern
+	}
+
+	return p.regex.MatchString(relPath)
+}
+
+func (p *IgnorePattern) mayContain(dir string) bool {
+	if !p.Anchored || dir == "" {
+		return true
+	}
 
-		if pattern.Pattern == filename {
+	for i, name := range strings.Split(dir, "/") {
+		if i >= len(p.segments) || p.segments[i] == nil {
 			return true
 		}
+		if !p.segments[i].MatchString(name) {
+			return false
+		}
 	}
+	return true
+}
 
-	normalizedPath := filepath.ToSlash(path)
-	for _, pattern := range il.Patterns {
+func (il *IgnoreList) patternsIn(dir string) []IgnorePattern {
+	il.mu.Lock()
+	defer il.mu.Unlock()
 
-		if pattern.IsDir && !isDir {
-			continue
+	if il.nested == nil {
+		il.nested = map[string][]IgnorePattern{"": il.Patterns}
+	}
+
+	if patterns, ok := il.nested[dir]; ok {
+		return patterns
+	}
+
+	var patterns []IgnorePattern
+	if il.Root != "" {
+		patterns, _, _ = readIgnoreFile(il.Root, dir)
+	}
+	il.nested[dir] = patterns
+	return patterns
+}
+
+func (il *IgnoreList) matchEntry(relPath string, isDir, include bool) *IgnorePattern {
+	if !include {
+		for i := range builtinIgnores {
+			if builtinIgnores[i].matches(relPath, isDir) {
+				return &builtinIgnores[i]
+			}
 		}
+	}
 
-		if pattern.Pattern == normalizedPath {
-			return true
+	for i := len(il.PeerPatterns) - 1; i >= 0; i-- {
+		if il.PeerPatterns[i].Include == include && il.PeerPatterns[i].matches(relPath, isDir) {
+			return &il.PeerPatterns[i]
 		}
+	}
 
-		if strings.Contains(pattern.Pattern, "*") || strings.Contains(pattern.Pattern, "?") {
+	dir := path.Dir(relPath)
+	for {
+		if dir == "." {
+			dir = ""
+		}
 
-			matched, err := filepath.Match(pattern.Pattern, normalizedPath)
-			if err == nil && matched {
-				return true
+		patterns := il.patternsIn(dir)
+		rel := relPath
+		if dir != "" {
+			rel = strings.TrimPrefix(relPath, dir+"/")
+		}
+
+		for i := len(patterns) - 1; i >= 0; i-- {
+			if patterns[i].Include == include && patterns[i].matches(rel, isDir) {
+				return &patterns[i]
 			}
+		}
+
+		if dir == "" {
+			return nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+func (il *IgnoreList) hasIncludes(relPath string) bool {
+	for _, pattern := range il.PeerPatterns {
+		if pattern.Include {
+			return true
+		}
+	}
 
-			matched, err = filepath.Match(pattern.Pattern, filename)
-			if err == nil && matched {
+	for dir := path.Dir(relPath); ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+
+		for _, pattern := range il.patternsIn(dir) {
+			if pattern.Include {
 				return true
 			}
+		}
 
-			pathParts := strings.Split(normalizedPath, "/")
-			for _, part := range pathParts {
-				matched, err := filepath.Match(pattern.Pattern, part)
-				if err == nil && matched {
-					return true
-				}
-			}
+		if dir == "" {
+			return false
 		}
+	}
+}
 
-		if pattern.IsDir && strings.HasPrefix(normalizedPath, pattern.Pattern+"/") {
+func (il *IgnoreList) mayInclude(dirPath string) bool {
+	for _, pattern := range il.PeerPatterns {
+		if pattern.Include && !pattern.Negate && pattern.mayContain(dirPath) {
 			return true
 		}
+	}
 
-		if strings.HasPrefix(pattern.Pattern, "*.") {
-			ext := pattern.Pattern[1:]
-			if strings.HasSuffix(filename, ext) {
+	for dir := dirPath; ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(dirPath, dir), "/")
+		for _, pattern := range il.patternsIn(dir) {
+			if pattern.Include && !pattern.Negate && pattern.mayContain(rel) {
 				return true
 			}
 		}
+
+		if dir == "" {
+			return false
+		}
+	}
+}
+
+func (il *IgnoreList) included(relPath string, isDir bool) (bool, *IgnorePattern) {
+	if !il.hasIncludes(relPath) {
+		return true, nil
+	}
+
+	for current := relPath; current != "."; current = path.Dir(current) {
+		if pattern := il.matchEntry(current, current != relPath || isDir, true); pattern != nil {
+			return !pattern.Negate, pattern
+		}
 	}
 
+	return isDir && il.mayInclude(relPath), nil
+}
+
+func (il *IgnoreList) Match(filePath string, isDir bool) IgnoreMatch {
+	normalized := strings.Trim(path.Clean(filepath.ToSlash(filePath)), "/")
+	if il == nil || normalized == "." || normalized == "" || strings.HasPrefix(normalized, "../") {
+		return IgnoreMatch{Path: normalized}
+	}
+
+	parts := strings.Split(normalized, "/")
+	for i := range parts {
+		current := strings.Join(parts[:i+1], "/")
+		last := i == len(parts)-1
+
+		pattern := il.matchEntry(current, !last || isDir, false)
+		if pattern != nil && !pattern.Negate {
+			return IgnoreMatch{Pattern: pattern, Path: current, Ignored: true}
+		}
+		if !last {
+			continue
+		}
+
+		ok, include := il.included(current, isDir)
+		if !ok {
+			return IgnoreMatch{Pattern: include, Path: current, Ignored: true, NotIncluded: true}
+		}
+		if pattern == nil {
+			pattern = include
+		}
+		return IgnoreMatch{Pattern: pattern, Path: current}
+	}
+
+	return IgnoreMatch{Path: normalized}
+}
+
+func (il *IgnoreList) ShouldIgnore(path string, isDir bool) bool {
+	return il.Match(path, isDir).Ignored
+}
+
+func IsBuiltinIgnored(relPath string) bool {
+	normalized := strings.Trim(path.Clean(filepath.ToSlash(relPath)), "/")
+	parts := strings.Split(normalized, "/")
+	for i := range parts {
+		current := strings.Join(parts[:i+1], "/")
+		for j := range builtinIgnores {
+			if builtinIgnores[j].matches(current, i < len(parts)-1) {
+				return true
+			}
+		}
+	}
 	return false
 }
@@ -0,0 +1,352 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnorePattern(t *testing.T) {
+	tests := []struct {
+		line    string
+		include bool
+		want    IgnorePattern
+		ok      bool
+	}{
+		{line: "*.log", want: IgnorePattern{Pattern: "*.log"}, ok: true},
+		{line: "build/", want: IgnorePattern{Pattern: "build", IsDir: true}, ok: true},
+		{line: "/build", want: IgnorePattern{Pattern: "build", Anchored: true}, ok: true},
+		{line: "docs/*.md", want: IgnorePattern{Pattern: "docs/*.md", Anchored: true}, ok: true},
+		{line: "/cache/", want: IgnorePattern{Pattern: "cache", IsDir: true, Anchored: true}, ok: true},
+		{line: "**/logs", want: IgnorePattern{Pattern: "**/logs", Anchored: true}, ok: true},
+		{line: "!keep.log", want: IgnorePattern{Pattern: "keep.log", Negate: true}, ok: true},
+		{line: "+*.pdf", want: IgnorePattern{Pattern: "*.pdf", Include: true}, ok: true},
+		{line: "+!draft.pdf", want: IgnorePattern{Pattern: "draft.pdf", Include: true, Negate: true}, ok: true},
+		{line: "reports/", include: true, want: IgnorePattern{Pattern: "reports", IsDir: true, Include: true}, ok: true},
+		{line: `\!important`, want: IgnorePattern{Pattern: "!important"}, ok: true},
+		{line: `\#hash`, want: IgnorePattern{Pattern: "#hash"}, ok: true},
+		{line: `\+plus`, want: IgnorePattern{Pattern: "+plus"}, ok: true},
+		{line: "/", ok: false},
+		{line: "!", ok: false},
+		{line: "+", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, ok := parseIgnorePattern(tt.line, tt.include)
+			if ok != tt.ok {
+				t.Fatalf("parseIgnorePattern(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+
+			if got.Text != tt.line {
+				t.Errorf("Text = %q, want %q", got.Text, tt.line)
+			}
+			if got.Pattern != tt.want.Pattern || got.IsDir != tt.want.IsDir || got.Negate != tt.want.Negate ||
+				got.Include != tt.want.Include || got.Anchored != tt.want.Anchored {
+				t.Errorf("parseIgnorePattern(%q) = {Pattern:%q IsDir:%v Negate:%v Include:%v Anchored:%v}, want {Pattern:%q IsDir:%v Negate:%v Include:%v Anchored:%v}",
+					tt.line, got.Pattern, got.IsDir, got.Negate, got.Include, got.Anchored,
+					tt.want.Pattern, tt.want.IsDir, tt.want.Negate, tt.want.Include, tt.want.Anchored)
+			}
+			if got.regex == nil {
+				t.Errorf("parseIgnorePattern(%q) did not compile a regexp", tt.line)
+			}
+		})
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		anchored bool
+		want     string
+	}{
+		{pattern: "*.log", want: `^(?:.*/)?[^/]*\.log$`},
+		{pattern: "build", anchored: true, want: `^build$`},
+		{pattern: "file?.txt", want: `^(?:.*/)?file[^/]\.txt$`},
+		{pattern: "docs/*.md", anchored: true, want: `^docs/[^/]*\.md$`},
+		{pattern: "a/**/b", anchored: true, want: `^a/(?:.*/)?b$`},
+		{pattern: "a/**", anchored: true, want: `^a/.*$`},
+		{pattern: "**/tmp", anchored: true, want: `^(?:.*/)?tmp$`},
+		{pattern: "[a-c]x", want: `^(?:.*/)?[a-c]x$`},
+		{pattern: "[!a-c]x", want: `^(?:.*/)?[^a-c]x$`},
+		{pattern: "[]]x", want: `^(?:.*/)?[]]x$`},
+		{pattern: "[abc", want: `^(?:.*/)?\[abc$`},
+		{pattern: `\*x`, want: `^(?:.*/)?\*x$`},
+		{pattern: "a+b(1)", want: `^(?:.*/)?a\+b\(1\)$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			if got := globToRegexp(tt.pattern, tt.anchored); got != tt.want {
+				t.Errorf("globToRegexp(%q, %v) = %q, want %q", tt.pattern, tt.anchored, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnorePatternMatches(t *testing.T) {
+	tests := []struct {
+		line  string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{line: "*.log", path: "a.log", want: true},
+		{line: "*.log", path: "a/b/c.log", want: true},
+		{line: "*.log", path: "a.log.txt", want: false},
+		{line: "/build", path: "build", isDir: true, want: true},
+		{line: "/build", path: "src/build", isDir: true, want: false},
+		{line: "build", path: "src/build", isDir: true, want: true},
+		{line: "docs/*.md", path: "docs/a.md", want: true},
+		{line: "docs/*.md", path: "docs/sub/a.md", want: false},
+		{line: "docs/*.md", path: "x/docs/a.md", want: false},
+		{line: "a/**/b", path: "a/b", want: true},
+		{line: "a/**/b", path: "a/x/y/b", want: true},
+		{line: "a/**/b", path: "x/a/b", want: false},
+		{line: "a/**", path: "a/x/y", want: true},
+		{line: "a/**", path: "a", isDir: true, want: false},
+		{line: "**/tmp", path: "tmp", isDir: true, want: true},
+		{line: "**/tmp", path: "x/y/tmp", isDir: true, want: true},
+		{line: "logs/", path: "logs", isDir: true, want: true},
+		{line: "logs/", path: "logs", want: false},
+		{line: "file?.txt", path: "file1.txt", want: true},
+		{line: "file?.txt", path: "file10.txt", want: false},
+		{line: "[!a-c]x", path: "dx", want: true},
+		{line: "[!a-c]x", path: "bx", want: false},
+		{line: "*", path: "a/b", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line+" "+tt.path, func(t *testing.T) {
+			pattern, ok := parseIgnorePattern(tt.line, false)
+			if !ok {
+				t.Fatalf("parseIgnorePattern(%q) failed", tt.line)
+			}
+			if got := pattern.matches(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("%q matches(%q, %v) = %v, want %v", tt.line, tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreListMatch(t *testing.T) {
+	type check struct {
+		path        string
+		isDir       bool
+		ignored     bool
+		notIncluded bool
+	}
+
+	tests := []struct {
+		name   string
+		files  map[string]string
+		peer   string
+		checks []check
+	}{
+		{
+			name: "built-in",
+			checks: []check{
+				{path: "a.txt"},
+				{path: ".p2pignore", ignored: true},
+				{path: "sub/.p2pignore", ignored: true},
+				{path: "sub/.p2pinclude", ignored: true},
+				{path: ".p2p", isDir: true, ignored: true},
+				{path: ".p2p/known_peers", ignored: true},
+				{path: "sub/.p2p", isDir: true},
+			},
+		},
+		{
+			name:  "negation",
+			files: map[string]string{".p2pignore": "*.log\n!keep.log\n"},
+			checks: []check{
+				{path: "a.log", ignored: true},
+				{path: "d/x.log", ignored: true},
+				{path: "keep.log"},
+				{path: "d/keep.log"},
+				{path: "a.txt"},
+			},
+		},
+		{
+			name:  "last match wins",
+			files: map[string]string{".p2pignore": "!keep.log\n*.log\n"},
+			checks: []check{
+				{path: "keep.log", ignored: true},
+			},
+		},
+		{
+			name:  "excluded directory stays excluded",
+			files: map[string]string{".p2pignore": "build/\n!build/keep.txt\n"},
+			checks: []check{
+				{path: "build", isDir: true, ignored: true},
+				{path: "build/keep.txt", ignored: true},
+				{path: "src/build/a.o", ignored: true},
+				{path: "build.txt"},
+			},
+		},
+		{
+			name:  "anchoring",
+			files: map[string]string{".p2pignore": "/out\ndocs/*.tmp\n"},
+			checks: []check{
+				{path: "out", isDir: true, ignored: true},
+				{path: "out/a.txt", ignored: true},
+				{path: "src/out/a.txt"},
+				{path: "docs/a.tmp", ignored: true},
+				{path: "docs/sub/a.tmp"},
+				{path: "x/docs/a.tmp"},
+			},
+		},
+		{
+			name:  "double star",
+			files: map[string]string{".p2pignore": "**/cache/\nsrc/**/*.gen.go\n"},
+			checks: []check{
+				{path: "cache/a", ignored: true},
+				{path: "x/y/cache/a", ignored: true},
+				{path: "cache"},
+				{path: "src/a.gen.go", ignored: true},
+				{path: "src/x/y/a.gen.go", ignored: true},
+				{path: "lib/a.gen.go"},
+			},
+		},
+		{
+			name: "nested files",
+			files: map[string]string{
+				".p2pignore":     "*.tmp\nsecret.txt\n",
+				"sub/.p2pignore": "!x.tmp\n/local.txt\n",
+			},
+			checks: []check{
+				{path: "a.tmp", ignored: true},
+				{path: "other/x.tmp", ignored: true},
+				{path: "sub/x.tmp"},
+				{path: "sub/deep/x.tmp"},
+				{path: "sub/y.tmp", ignored: true},
+				{path: "sub/local.txt", ignored: true},
+				{path: "sub/deep/local.txt"},
+				{path: "local.txt"},
+				{path: "sub/secret.txt", ignored: true},
+			},
+		},
+		{
+			name:  "include file",
+			files: map[string]string{".p2pinclude": "reports/**/*.pdf\n"},
+			checks: []check{
+				{path: "reports", isDir: true},
+				{path: "reports/a.pdf"},
+				{path: "reports/2024/q1/a.pdf"},
+				{path: "reports/a.txt", ignored: true, notIncluded: true},
+				{path: "other.pdf", ignored: true, notIncluded: true},
+				{path: "other", isDir: true, ignored: true, notIncluded: true},
+			},
+		},
+		{
+			name: "include and exclude",
+			files: map[string]string{
+				".p2pinclude": "docs/\n",
+				".p2pignore":  "*.bak\n",
+			},
+			checks: []check{
+				{path: "docs/a.txt"},
+				{path: "docs/sub/a.txt"},
+				{path: "docs/a.bak", ignored: true},
+				{path: "b.txt", ignored: true, notIncluded: true},
+			},
+		},
+		{
+			name:  "plus prefix",
+			files: map[string]string{".p2pignore": "+*.md\n+!draft.md\n"},
+			checks: []check{
+				{path: "a.md"},
+				{path: "sub/a.md"},
+				{path: "draft.md", ignored: true, notIncluded: true},
+				{path: "a.txt", ignored: true, notIncluded: true},
+			},
+		},
+		{
+			name:  "nested include",
+			files: map[string]string{"sub/.p2pinclude": "*.go\n"},
+			checks: []check{
+				{path: "a.txt"},
+				{path: "sub/a.go"},
+				{path: "sub/a.txt", ignored: true, notIncluded: true},
+			},
+		},
+		{
+			name:  "peer filter",
+			files: map[string]string{".p2pignore": "!private/\n"},
+			peer:  "private/\n",
+			checks: []check{
+				{path: "private/a.txt", ignored: true},
+				{path: "public/a.txt"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range tt.files {
+				writeTestFile(t, root, name, content)
+			}
+
+			il, err := LoadIgnoreFile(root)
+			if err != nil {
+				t.Fatalf("LoadIgnoreFile: %v", err)
+			}
+			if tt.peer != "" {
+				writeTestFile(t, root, ".p2p/filters/peer", tt.peer)
+				if err := il.AddPeerFile(".p2p/filters/peer"); err != nil {
+					t.Fatalf("AddPeerFile: %v", err)
+				}
+			}
+
+			for _, c := range tt.checks {
+				match := il.Match(c.path, c.isDir)
+				if match.Ignored != c.ignored || match.NotIncluded != c.notIncluded {
+					t.Errorf("Match(%q, %v) = {Ignored:%v NotIncluded:%v}, want {Ignored:%v NotIncluded:%v}",
+						c.path, c.isDir, match.Ignored, match.NotIncluded, c.ignored, c.notIncluded)
+				}
+			}
+		})
+	}
+}
+
+func TestIsBuiltinIgnored(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "a.txt", want: false},
+		{path: ".p2pignore", want: true},
+		{path: "a/b/.p2pignore", want: true},
+		{path: ".p2pinclude", want: true},
+		{path: "a/.p2pinclude", want: true},
+		{path: ".p2p", want: true},
+		{path: ".p2p/known_peers", want: true},
+		{path: "./.p2p/backups/a.txt", want: true},
+		{path: "a/../.p2p/chunks.json", want: true},
+		{path: "a/.p2p/x", want: false},
+		{path: ".p2pignore.txt", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := IsBuiltinIgnored(tt.path); got != tt.want {
+				t.Errorf("IsBuiltinIgnored(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, root, name, content string) {
+	t.Helper()
+
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"strings"
 )
 
+const StateDirName = ".p2p"
+
 func NormalizePath(path string) string {
 
 	normalized := strings.ReplaceAll(path, "\\", "/")